@@ -3,6 +3,9 @@
  * With heartbeat and connection status monitoring
  */
 
+// Storage key prefix for the staff key of each user ID
+const staffKeyStorage = 'secChat_staffKey_';
+
 class SecWebSocket {
     constructor() {
         this.socket = null;
@@ -19,6 +22,12 @@ class SecWebSocket {
         this.serverVersion = null;
         // Store auth credentials for reconnection
         this.authCredentials = null;
+        // REST session token issued on auth_success
+        this.sessionToken = null;
+        // Online users, kept current from presence_snapshot and delta events
+        this.presence = { synced: false, version: 0, users: new Map() };
+        // Delay requested by a server_restarting notice, used for the next reconnect
+        this.restartDelay = null;
     }
 
     connect(serverUrl) {
@@ -55,7 +64,8 @@ class SecWebSocket {
                                 this.authCredentials.passwordHash,
                                 this.authCredentials.userId,
                                 this.authCredentials.userName,
-                                this.authCredentials.avatar
+                                this.authCredentials.avatar,
+                                this.authCredentials.staffKey
                             );
                         }
                         
@@ -80,6 +90,7 @@ class SecWebSocket {
                         this.authenticated = false;
                         this.stopHeartbeat();
                         this.emit('disconnected');
+                        if (this.isBanned(event.code, event.reason) || this.needsStaffKey(event.code, event.reason)) return;
                         this.scheduleReconnect();
                     };
                 } catch (error) {
@@ -113,7 +124,8 @@ class SecWebSocket {
                                 this.authCredentials.passwordHash,
                                 this.authCredentials.userId,
                                 this.authCredentials.userName,
-                                this.authCredentials.avatar
+                                this.authCredentials.avatar,
+                                this.authCredentials.staffKey
                             );
                         }
                         
@@ -142,6 +154,7 @@ class SecWebSocket {
                         this.authenticated = false;
                         this.stopHeartbeat();
                         this.emit('disconnected', res);
+                        if (this.isBanned(res && res.code, res && res.reason) || this.needsStaffKey(res && res.code, res && res.reason)) return;
                         this.scheduleReconnect();
                     });
                 } catch (error) {
@@ -236,10 +249,34 @@ class SecWebSocket {
                 return;
             }
             
+            if (type === 'presence_snapshot' || type === 'presence_join' ||
+                type === 'presence_leave' || (type === 'user_updated' && message.version)) {
+                this.applyPresence(message);
+                if (type !== 'user_updated') return;
+            }
+
+            // The server is going away; reconnect after its hint instead of backing off
+            if (type === 'server_restarting') {
+                this.restartDelay = message.reconnectIn || this.baseReconnectDelay;
+            }
+
             if (type === 'auth_success') { 
                 this.authenticated = true; 
+                this.sessionToken = message.token || null;
+                // A newly issued staff key is only sent once
+                if (message.staffKey && this.authCredentials) {
+                    this.authCredentials.staffKey = message.staffKey;
+                    this.saveStaffKey(this.authCredentials.userId, message.staffKey);
+                }
             }
             
+            // A message dropped by the server's flood protection will never be echoed
+            if (type === 'rate_limited' && message.id && this.pendingMessages.has(message.id)) {
+                const callback = this.pendingMessages.get(message.id);
+                this.pendingMessages.delete(message.id);
+                if (callback) callback(false, message);
+            }
+
             // Handle message delivery confirmation
             if ((type === 'text' || type === 'image') && message.id) {
                 if (this.pendingMessages.has(message.id)) {
@@ -249,16 +286,75 @@ class SecWebSocket {
                 }
             }
             
-            this.emit(type === 'text' || type === 'image' ? 'message' : type, message);
+            const chat = type === 'text' || type === 'image' || type === 'bot';
+            this.emit(chat ? 'message' : type, message);
         } catch (error) {
             console.error('Parse failed:', error);
         }
     }
 
-    authenticate(passwordHash, userId, userName, avatar) {
+    // Close code 4001 means this account needs its staff key; reconnecting
+    // without it would only be refused again
+    needsStaffKey(code, reason) {
+        if (code !== 4001) return false;
+        this.reconnectAttempts = 999;
+        this.emit('staff_key_required', { reason });
+        return true;
+    }
+
+    // Close code 4003 means the server banned this user; reconnecting would
+    // only be refused again
+    isBanned(code, reason) {
+        if (code !== 4003) return false;
+        this.reconnectAttempts = 999;
+        this.emit('banned', { reason });
+        return true;
+    }
+
+    applyPresence(message) {
+        const presence = this.presence;
+        if (message.type === 'presence_snapshot') {
+            presence.users = new Map((message.users || []).map(u => [u.id, u]));
+            presence.version = message.version;
+            presence.synced = true;
+        } else {
+            if (!presence.synced || message.version <= presence.version) return;
+            if (message.version !== presence.version + 1) {
+                // Missed an event; ask for a fresh snapshot
+                presence.synced = false;
+                this.send({ type: 'presence_sync' });
+                return;
+            }
+            presence.version = message.version;
+            if (message.type === 'presence_join') {
+                presence.users.set(message.user.id, message.user);
+            } else if (message.type === 'presence_leave') {
+                presence.users.delete(message.userId);
+            } else if (presence.users.has(message.user.id)) {
+                presence.users.set(message.user.id, { ...presence.users.get(message.user.id), ...message.user });
+            }
+        }
+        this.emit('users', { type: 'users', users: [...presence.users.values()] });
+    }
+
+    // staffKey is only needed by moderators and admins; the one last issued
+    // to this user is remembered when none is given
+    authenticate(passwordHash, userId, userName, avatar, staffKey) {
+        if (staffKey) this.saveStaffKey(userId, staffKey);
+        else staffKey = uni.getStorageSync(staffKeyStorage + userId) || '';
         // Store credentials for reconnection
-        this.authCredentials = { passwordHash, userId, userName, avatar };
-        this.send({ type: 'auth', payload: { passwordHash, userId, userName, avatar } });
+        this.authCredentials = { passwordHash, userId, userName, avatar, staffKey };
+        // Events before the next snapshot belong to the old connection
+        this.presence.synced = false;
+        this.send({ type: 'auth', payload: { passwordHash, userId, userName, avatar, staffKey } });
+    }
+
+    saveStaffKey(userId, staffKey) {
+        try {
+            uni.setStorageSync(staffKeyStorage + userId, staffKey);
+        } catch (e) {
+            console.error('Staff key save failed:', e);
+        }
     }
 
     send(data) {
@@ -324,10 +420,23 @@ class SecWebSocket {
     sendTyping() { this.send({ type: 'typing' }); }
     sendRecall(messageId) { this.send({ type: 'recall', id: messageId }); }
     sendRead(messageId) { this.send({ type: 'read', id: messageId }); }
+    sendPresence(state) { this.send({ type: 'presence', payload: { state } }); }
+
+    // Runs a slash command such as "/who"; the reply arrives as command_result
+    sendCommand(text) {
+        const id = Date.now().toString(36) + Math.random().toString(36).substr(2, 9);
+        return this.send({ type: 'command', id, payload: { text } }) ? id : null;
+    }
 
     scheduleReconnect() {
         this.reconnectAttempts++;
-        const delay = Math.min(this.baseReconnectDelay * this.reconnectAttempts, this.maxReconnectDelay);
+        let delay = Math.min(this.baseReconnectDelay * this.reconnectAttempts, this.maxReconnectDelay);
+        if (this.restartDelay !== null) {
+            // Spread reconnects so a restart doesn't bring every client back at once
+            delay = this.restartDelay + Math.floor(Math.random() * this.restartDelay);
+            this.restartDelay = null;
+            this.reconnectAttempts = 0;
+        }
         this.emit('reconnecting', { attempt: this.reconnectAttempts, delay });
         console.log(`[WebSocket] Reconnecting in ${delay}ms (attempt ${this.reconnectAttempts})`);
         setTimeout(() => {
@@ -339,6 +448,7 @@ class SecWebSocket {
         this.stopHeartbeat();
         this.reconnectAttempts = 999; // Prevent auto-reconnect
         this.authCredentials = null; // Clear stored credentials
+        this.sessionToken = null;
         
         const isH5 = typeof window !== 'undefined' && typeof document !== 'undefined';
 
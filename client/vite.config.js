@@ -13,6 +13,10 @@ export default defineConfig({
         target: 'http://localhost:8081',
         changeOrigin: true
       },
+      '/uploads': {
+        target: 'http://localhost:8081',
+        changeOrigin: true
+      },
       '/ws': {
         target: 'http://localhost:8081',
         ws: true,
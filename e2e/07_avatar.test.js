@@ -50,7 +50,6 @@ describe('Avatar Functionality', () => {
 
         // Wait for backend updates to complete
         try {
-            await page.waitForResponse(res => res.url().includes('/api/upload') && res.status() === 200, { timeout: 20000 });
             await page.waitForResponse(res => res.url().includes('/api/user/avatar') && res.status() === 200, { timeout: 20000 });
         } catch (e) {
             await screenshot(page, 'avatar_api_calls_missing');
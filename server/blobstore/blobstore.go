@@ -0,0 +1,68 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"time"
+
+	"sec-chat/server/config"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Store persists upload blobs by name
+type Store interface {
+	// Put stores size bytes from r under name, replacing any existing blob
+	Put(name string, r io.Reader, size int64) error
+	// Get opens a blob for reading. Local blobs also implement io.Seeker.
+	Get(name string) (io.ReadCloser, error)
+	// Exists reports whether a blob is stored under name
+	Exists(name string) (bool, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(name string) error
+	// URL returns a time-limited direct download URL, or "" if the
+	// backend cannot serve blobs itself and they must be proxied
+	URL(name string, expires time.Duration) (string, error)
+	// Check verifies that the backend is reachable and accepts writes
+	Check() error
+}
+
+var instance Store
+
+// Init creates the blob store selected by the configuration
+func Init(cfg *config.Config) (Store, error) {
+	switch cfg.StorageBackend {
+	case "", "local":
+		instance = NewLocal(cfg.UploadDir)
+	case "s3":
+		instance = NewS3(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+	return instance, nil
+}
+
+// Get returns the blob store instance
+func Get() Store {
+	return instance
+}
+
+// contentType guesses the MIME type from the blob name
+func contentType(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
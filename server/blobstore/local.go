@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Local stores blobs as files in a directory
+type Local struct {
+	dir string
+}
+
+// NewLocal creates a filesystem blob store rooted at dir
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// Put writes the blob to a temp file and renames it into place
+func (l *Local) Put(name string, r io.Reader, size int64) error {
+	tmp, err := os.CreateTemp(l.dir, ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path(name))
+}
+
+// Get opens the blob file
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Exists checks whether the blob file exists
+func (l *Local) Exists(name string) (bool, error) {
+	_, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes the blob file
+func (l *Local) Delete(name string) error {
+	if err := os.Remove(l.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// URL returns "" because local blobs are served by the server itself
+func (l *Local) URL(name string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// Check creates and removes a temp file to confirm the directory is writable
+func (l *Local) Check() error {
+	tmp, err := os.CreateTemp(l.dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// path maps a blob name to a file inside the store directory
+func (l *Local) path(name string) string {
+	return filepath.Join(l.dir, filepath.Base(name))
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/crypto"
+	"sec-chat/server/handlers"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+// command is an admin subcommand of the server binary. Commands read the
+// same config file, environment and flags as the server and work on its
+// database directly, so they are meant for when the server is offline.
+type command struct {
+	name     string // One or two words, e.g. "users list"
+	synopsis string // Arguments after the name
+	summary  string
+	run      func(cmd *command, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"users list", "[-json]", "List users with their role and status", usersList},
+		{"users reset-avatar", "-user ID", "Remove a user's avatar", usersResetAvatar},
+		{"users staff-key", "-user ID", "Issue a new staff key to a moderator or admin", usersStaffKey},
+		{"messages purge", "-user ID [-yes]", "Permanently delete every message sent by a user", messagesPurge},
+		{"rooms create", "NAME", "Create a chat room (not supported: one room per server)", roomsCreate},
+		{"backup", "[-out FILE]", "Write a consistent copy of the database", backup},
+		{"export", "[-out FILE]", "Export users and messages as JSON", export},
+		{"rotate-password", "[-new-password PASSWORD]", "Change the room password and sign everyone out", rotatePassword},
+		{"db migrate", "", "Create or upgrade the database schema", dbMigrate},
+	}
+}
+
+// errUsage reports bad arguments after the usage has been printed
+var errUsage = errors.New("usage")
+
+// runCommand runs the admin command named by args and returns the exit code
+func runCommand(args []string) int {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != cmd.name {
+			continue
+		}
+		err := cmd.run(cmd, args[len(words):])
+		if s := store.Get(); s != nil {
+			s.Close()
+		}
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		return 1
+	}
+
+	if args[0] != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+	}
+	printCommands(os.Stderr)
+	if args[0] == "help" {
+		return 0
+	}
+	return 2
+}
+
+// printCommands lists the admin commands
+func printCommands(w io.Writer) {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, "Usage: %s [flags]            Run the server\n", name)
+	fmt.Fprintf(w, "       %s COMMAND [flags]    Run an admin command\n\nCommands:\n", name)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nServer flags such as -config and -db are accepted after the command.\n")
+}
+
+// flags returns an empty flag set for the command
+func (cmd *command) flags() *flag.FlagSet {
+	return flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+}
+
+// load parses args into fs, which holds the command's own flags, along with
+// the server settings. Usage only lists the command's own flags.
+func (cmd *command) load(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	own := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { own[f.Name] = true })
+	usageShown := false
+	fs.Usage = func() {
+		usageShown = true
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s %s\n\n%s.\n", filepath.Base(os.Args[0]), cmd.name, cmd.synopsis, cmd.summary)
+		if len(own) > 0 {
+			fmt.Fprintf(out, "\nFlags:\n")
+			fs.VisitAll(func(f *flag.Flag) {
+				if own[f.Name] {
+					fmt.Fprintf(out, "  -%s\n    \t%s\n", f.Name, f.Usage)
+				}
+			})
+		}
+		fmt.Fprintf(out, "\nServer flags such as -config and -db are accepted as well.\n")
+	}
+
+	cfg, err := config.Load(fs, args)
+	if err != nil && usageShown {
+		// The flag package has already explained the problem
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, errUsage
+	}
+	return cfg, err
+}
+
+// open loads the configuration and opens the existing database
+func (cmd *command) open(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	cfg, err := cmd.load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		return nil, fmt.Errorf("no database at %s (use -db or -config to point at it)", cfg.DBPath)
+	}
+	if _, err := store.Init(cfg.DBPath); err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	return cfg, nil
+}
+
+// auditCommand records an admin command in the audit log
+func auditCommand(cmd *command, targetID string, details map[string]string) {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details["command"] = cmd.name
+	if u, err := user.Current(); err == nil {
+		details["osUser"] = u.Username
+	}
+	err := store.Get().AppendAudit(&models.AuditEvent{
+		Time:     time.Now().UnixMilli(),
+		Type:     models.AuditAdminCommand,
+		TargetID: targetID,
+		Details:  details,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not write the audit log: %v\n", err)
+	}
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// formatTime formats Unix milliseconds for listings, or "-" for zero
+func formatTime(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).Format("2006-01-02 15:04")
+}
+
+// usersList prints every user
+func usersList(cmd *command, args []string) error {
+	fs := cmd.flags()
+	asJSON := fs.Bool("json", false, "Print JSON instead of a table")
+	if _, err := cmd.open(fs, args); err != nil {
+		return err
+	}
+
+	users, err := store.Get().GetUsers()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	}
+
+	now := time.Now().UnixMilli()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tROLE\tLAST SEEN\tSTATUS")
+	for _, u := range users {
+		status := "-"
+		if ban, err := store.Get().GetBan(u.ID, now); err == nil && ban != nil {
+			status = "banned"
+		} else if u.IsMuted(now) {
+			status = "muted until " + formatTime(u.MutedUntil)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.ID, u.Name, u.Role, formatTime(u.LastSeen), status)
+	}
+	return tw.Flush()
+}
+
+// usersResetAvatar clears a user's avatar. The image itself is deleted by
+// the server's orphan upload sweep once nothing refers to it.
+func usersResetAvatar(cmd *command, args []string) error {
+	fs := cmd.flags()
+	userID := fs.String("user", "", "ID of the user")
+	if _, err := cmd.open(fs, args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	u, err := store.Get().GetUser(*userID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("no user %q", *userID)
+	}
+	if u.Avatar == "" {
+		fmt.Printf("%s has no avatar\n", u.ID)
+		return nil
+	}
+
+	if _, err := store.Get().SetUserAvatar(u.ID, ""); err != nil {
+		return err
+	}
+	if _, err := store.Get().ReleaseUploadRefs(models.UploadRefAvatar, u.ID); err != nil {
+		return err
+	}
+	auditCommand(cmd, u.ID, nil)
+	fmt.Printf("Reset the avatar of %s (%s)\n", u.ID, u.Name)
+	return nil
+}
+
+// usersStaffKey replaces a moderator's or admin's staff key, for staff who
+// lost theirs or were promoted before keys existed
+func usersStaffKey(cmd *command, args []string) error {
+	fs := cmd.flags()
+	userID := fs.String("user", "", "ID of the user")
+	if _, err := cmd.open(fs, args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	u, err := store.Get().GetUser(*userID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("no user %q", *userID)
+	}
+	if !u.CanModerate() {
+		return fmt.Errorf("%s is a %s; only moderators and admins have staff keys", u.ID, u.Role)
+	}
+
+	key := crypto.RandomToken(32)
+	if err := store.Get().SetStaffKey(u.ID, crypto.HashPassword(key)); err != nil {
+		return err
+	}
+	auditCommand(cmd, u.ID, nil)
+	fmt.Printf("New staff key for %s (%s), shown once:\n%s\n", u.ID, u.Name, key)
+	return nil
+}
+
+// messagesPurge deletes every message a user sent
+func messagesPurge(cmd *command, args []string) error {
+	fs := cmd.flags()
+	userID := fs.String("user", "", "ID of the user whose messages are deleted")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	if _, err := cmd.open(fs, args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Permanently delete every message sent by %s?", *userID)) {
+		return errors.New("aborted")
+	}
+	n, err := store.Get().PurgeUserMessages(*userID)
+	if err != nil {
+		return err
+	}
+	auditCommand(cmd, *userID, map[string]string{"messages": fmt.Sprint(n)})
+	fmt.Printf("Deleted %d messages from %s\n", n, *userID)
+	return nil
+}
+
+// roomsCreate exists for parity with multi-room deployments; this server
+// hosts one room, so it explains that instead of creating anything
+func roomsCreate(cmd *command, args []string) error {
+	if _, err := cmd.load(cmd.flags(), args); err != nil {
+		return err
+	}
+	return errors.New("rooms are not supported: this server hosts a single chat room; run another server with its own database for another room")
+}
+
+// backup copies the database to a new file
+func backup(cmd *command, args []string) error {
+	fs := cmd.flags()
+	out := fs.String("out", "", "File to write (default: secchat-TIMESTAMP.db next to the database)")
+	cfg, err := cmd.open(fs, args)
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = filepath.Join(filepath.Dir(cfg.DBPath), "secchat-"+time.Now().Format("20060102-150405")+".db")
+	}
+
+	if err := store.Get().Backup(path); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s (%d bytes)\n", cfg.DBPath, path, info.Size())
+	if cfg.StorageBackend == "local" {
+		fmt.Printf("Uploads are not included; copy %s separately\n", cfg.UploadDir)
+	}
+	return nil
+}
+
+// export writes users and messages as one JSON document. Message content
+// stays end-to-end encrypted.
+func export(cmd *command, args []string) error {
+	fs := cmd.flags()
+	out := fs.String("out", "", "File to write (default: stdout)")
+	if _, err := cmd.open(fs, args); err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	users, err := store.Get().GetUsers()
+	if err != nil {
+		return err
+	}
+	usersJSON, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, "{\"exportedAt\":%d,\"users\":%s,\"messages\":[", time.Now().UnixMilli(), usersJSON)
+
+	count := 0
+	err = store.Get().EachMessage(func(msg *models.Message) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			bw.WriteByte(',')
+		}
+		count++
+		_, err = bw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString("]}\n")
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Printf("Exported %d users and %d messages to %s\n", len(users), count, *out)
+	}
+	return nil
+}
+
+// rotatePassword sets a new room password, in the config file when one is
+// used, and revokes every REST session
+func rotatePassword(cmd *command, args []string) error {
+	fs := cmd.flags()
+	password := fs.String("new-password", "", "The new password (default: a random one)")
+	cfg, err := cmd.open(fs, args)
+	if err != nil {
+		return err
+	}
+	generated := *password == ""
+	if generated {
+		*password = crypto.RandomToken(12)
+	}
+
+	if cfg.ConfigFile != "" {
+		if err := config.WriteSetting(cfg.ConfigFile, "password", *password); err != nil {
+			return fmt.Errorf("updating %s: %w", cfg.ConfigFile, err)
+		}
+	}
+	if err := store.Get().DeleteAllSessions(); err != nil {
+		return err
+	}
+	// The rotation is recorded here only when the server will read the new
+	// password from the file; otherwise the server records it when it is
+	// started with the new password
+	if cfg.ConfigFile != "" && os.Getenv("PASSWORD") == "" {
+		handlers.RecordPasswordRotation(crypto.HashPassword(*password))
+	}
+
+	if generated {
+		fmt.Printf("New password: %s\n", *password)
+	}
+	if cfg.ConfigFile != "" {
+		fmt.Printf("Saved the password in %s\n", cfg.ConfigFile)
+	}
+	if cfg.ConfigFile == "" || os.Getenv("PASSWORD") != "" {
+		fmt.Println("Set PASSWORD (or -password) to the new password where the server is started")
+	}
+	fmt.Println("All sessions were revoked; restart the server to apply the new password")
+	return nil
+}
+
+// dbMigrate creates the database if needed and brings its schema up to date
+func dbMigrate(cmd *command, args []string) error {
+	cfg, err := cmd.load(cmd.flags(), args)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0755); err != nil {
+		return err
+	}
+	if _, err := store.Init(cfg.DBPath); err != nil {
+		return err
+	}
+	fmt.Printf("Database %s is up to date\n", cfg.DBPath)
+	return nil
+}
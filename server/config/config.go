@@ -3,11 +3,24 @@ package config
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sec-chat/server/logging"
 )
 
 // Config holds the server configuration
@@ -18,71 +31,502 @@ type Config struct {
 	DBPath       string
 	UploadDir    string
 	Version      string
+
+	// ConfigFile is the file settings were read from, if any
+	ConfigFile string
+
+	// Upload storage: "local" (UploadDir) or "s3"
+	StorageBackend string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3Prefix       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3PathStyle    bool
+	// S3Presign redirects /uploads/ to presigned URLs instead of proxying bytes
+	S3Presign bool
+	// OrphanUploadRetention is how long an upload may stay unreferenced
+	// before it is deleted
+	OrphanUploadRetention time.Duration
+	// AuditRetention is how long audit events are kept; zero keeps them
+	// forever
+	AuditRetention time.Duration
+
+	// BootstrapAdmin is a user ID that is made admin when it authenticates;
+	// without it the first user to join becomes admin
+	BootstrapAdmin string
+	// AdminSecret, when set, authorizes /api/admin/ requests that send it in
+	// the X-Admin-Secret header, besides sessions of admin users. The
+	// bootstrap admin must then also present it as their staff key.
+	AdminSecret string
+
+	// TrustedProxies lists proxy addresses or CIDRs whose X-Forwarded-For
+	// header is believed; TrustedProxyNets is the parsed form
+	TrustedProxies   string
+	TrustedProxyNets []*net.IPNet
+
+	// AuthLockoutThreshold failed auths lock an IP or user ID out for
+	// AuthLockoutDuration
+	AuthLockoutThreshold int
+	AuthLockoutDuration  time.Duration
+
+	// Per-connection frame limits as a rate per second and a burst:
+	// chat messages, read receipts, and all other frames
+	MessageRate  float64
+	MessageBurst int
+	ReadRate     float64
+	ReadBurst    int
+	FrameRate    float64
+	FrameBurst   int
+	// TypingInterval is the minimum gap between relayed typing events
+	TypingInterval time.Duration
+	// RateLimitStrikes is how many rate limit warnings a client gets before
+	// it is disconnected
+	RateLimitStrikes int
+
+	// SendQueueSize is how many outgoing frames are buffered per connection.
+	// When a queue is full, SlowClientAction decides what happens: "disconnect"
+	// closes the connection with 1013 (try again later), "drop" discards frames.
+	SendQueueSize    int
+	SlowClientAction string
+
+	// ShutdownTimeout bounds how long a graceful shutdown waits for clients
+	// and requests before exiting anyway
+	ShutdownTimeout time.Duration
+
+	// TLSCert and TLSKey enable HTTPS and wss:// on Port. The files are
+	// reloaded when they change or on SIGHUP.
+	TLSCert string
+	TLSKey  string
+	// HTTPRedirectPort, when set with TLS, serves redirects from plain HTTP
+	// to HTTPS on a second port
+	HTTPRedirectPort int
+
+	// AllowedOrigins lists extra origins (scheme://host[:port]) that may open
+	// WebSockets and make cross-origin API calls; the server's own origin is
+	// always allowed. AllowedOriginList is the parsed form. AllowAnyOrigin is
+	// a development mode that accepts every origin.
+	AllowedOrigins    string
+	AllowedOriginList []string
+	AllowAnyOrigin    bool
+
+	// MetricsAddr serves /metrics on a separate listener, such as
+	// 127.0.0.1:9100, instead of the main port
+	MetricsAddr string
+
+	// LogLevel is debug, info, warn or error; LogFormat is text or json
+	LogLevel  string
+	LogFormat string
+
+	// TraceExporter sends OpenTelemetry spans nowhere ("none"), to stdout,
+	// or over OTLP/HTTP to OTLPEndpoint. TraceSampleRatio is the fraction
+	// of new traces kept.
+	TraceExporter    string
+	OTLPEndpoint     string
+	TraceSampleRatio float64
 }
 
-var cfg *Config
+// current holds the running configuration. A published Config is never
+// modified; Reload swaps in a new one, so what Get returns is a consistent
+// snapshot.
+var current atomic.Pointer[Config]
 var AppVersion string
 
-// Init initializes configuration from command line arguments and environment variables
+// args are the command line arguments, kept so that Reload applies the
+// same flags; reloadMu serializes reloads
+var (
+	args     []string
+	reloadMu sync.Mutex
+)
+
+// defaults returns the configuration before any file, environment variable
+// or flag is applied
+func defaults() *Config {
+	return &Config{
+		Port:                  8080,
+		DBPath:                "./data/chat.db",
+		UploadDir:             "./data/uploads",
+		StorageBackend:        "local",
+		S3Region:              "us-east-1",
+		S3Presign:             true,
+		OrphanUploadRetention: 24 * time.Hour,
+		AuthLockoutThreshold:  10,
+		AuthLockoutDuration:   15 * time.Minute,
+		MessageRate:           5,
+		MessageBurst:          10,
+		ReadRate:              20,
+		ReadBurst:             50,
+		FrameRate:             10,
+		FrameBurst:            20,
+		TypingInterval:        2 * time.Second,
+		RateLimitStrikes:      5,
+		SendQueueSize:         256,
+		SlowClientAction:      "disconnect",
+		ShutdownTimeout:       15 * time.Second,
+		LogLevel:              "info",
+		LogFormat:             "text",
+		TraceExporter:         "none",
+		OTLPEndpoint:          "http://localhost:4318",
+		TraceSampleRatio:      1,
+	}
+}
+
+// Init initializes configuration from the config file, environment
+// variables and command line arguments. Each overrides the ones before it:
+// defaults < config file < environment < flags. The config file is named
+// by -config or CONFIG_FILE.
 func Init() *Config {
-	cfg = &Config{}
+	args = os.Args[1:]
+	cfg, err := load(flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError), args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	if err := validate(cfg); err != nil {
+		logging.Fatal("Invalid configuration", "err", err)
+	}
+	if cfg.Password == "" {
+		logging.Fatal("Password is required; set it with -password, PASSWORD or the config file")
+	}
+	if cfg.ConfigFile != "" {
+		slog.Info("Loaded config file", "path", cfg.ConfigFile)
+	}
+	if cfg.AllowAnyOrigin {
+		slog.Warn("Accepting requests from any origin; do not use this in production")
+	}
+
+	// Ensure directories exist
+	ensureDir(filepath.Dir(cfg.DBPath))
+	ensureDir(cfg.UploadDir)
+
+	current.Store(cfg)
+	return cfg
+}
 
-	// Set defaults
-	cfg.Port = 8080
-	cfg.DBPath = "./data/chat.db"
-	cfg.UploadDir = "./data/uploads"
+// Load reads the configuration for an admin command. The server settings
+// are added to fs next to the command's own flags, so that -config, -db and
+// the rest work as they do for the server, and args are parsed into it.
+// Unlike Init, no password is required and nothing is created on disk.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg, err := load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return nil, err
+	}
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+	current.Store(cfg)
+	return cfg, nil
+}
+
+// Get returns the current configuration
+func Get() *Config {
+	return current.Load()
+}
+
+// Reload rereads the config file and environment, with flags still taking
+// precedence, and applies the settings that can change at runtime. Other
+// changed settings are logged as needing a restart. On error the running
+// configuration is kept.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	next, err := load(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := validate(next); err != nil {
+		return err
+	}
 
-	// Read from environment variables first
-	if portStr := os.Getenv("PORT"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			cfg.Port = port
+	cur := Get()
+	merged := *cur
+	fs = flag.NewFlagSet("", flag.ContinueOnError)
+	settings := bind(fs, &merged)
+	before, after := values(cur), values(next)
+	var changed, pending []string
+	for _, s := range settings {
+		if before[s.flag] == after[s.flag] {
+			continue
+		}
+		if !reloadable[s.key] {
+			pending = append(pending, s.key)
+			continue
 		}
+		if err := fs.Set(s.flag, after[s.flag]); err != nil {
+			return fmt.Errorf("%s: %v", s.key, err)
+		}
+		changed = append(changed, s.key)
 	}
-	if password := os.Getenv("PASSWORD"); password != "" {
-		cfg.Password = password
+	if len(pending) > 0 {
+		slog.Warn("Restart to apply changed settings", "settings", strings.Join(pending, ","))
 	}
-	if dbPath := os.Getenv("DB_PATH"); dbPath != "" {
-		cfg.DBPath = dbPath
+	if len(changed) == 0 {
+		slog.Info("Configuration reloaded, no runtime settings changed")
+		return nil
 	}
-	if uploadDir := os.Getenv("UPLOAD_DIR"); uploadDir != "" {
-		cfg.UploadDir = uploadDir
+	if err := validate(&merged); err != nil {
+		return err
 	}
 
-	// Command line arguments override environment variables
-	flag.IntVar(&cfg.Port, "port", cfg.Port, "Server port")
-	flag.StringVar(&cfg.Password, "password", cfg.Password, "Chat room password (required)")
-	flag.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database file path")
-	flag.StringVar(&cfg.UploadDir, "uploads", cfg.UploadDir, "Upload directory")
-	flag.Parse()
+	if merged.LogLevel != cur.LogLevel {
+		if err := logging.SetLevel(merged.LogLevel); err != nil {
+			return err
+		}
+	}
+	if merged.AllowAnyOrigin && !cur.AllowAnyOrigin {
+		slog.Warn("Accepting requests from any origin; do not use this in production")
+	}
+	current.Store(&merged)
+	slog.Info("Configuration reloaded", "changed", strings.Join(changed, ","))
+	return nil
+}
 
-	if cfg.Password == "" {
-		log.Fatal("Password is required. Use -password flag or PASSWORD environment variable")
+// load builds a configuration from defaults, the config file, the
+// environment and args parsed into fs, without validating it
+func load(fs *flag.FlagSet, args []string) (*Config, error) {
+	path := configPath(args)
+	cfg := defaults()
+	cfg.ConfigFile = path
+	settings := bind(fs, cfg)
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile, "Config file (YAML) read before the environment and flags")
+
+	if path != "" {
+		if err := applyFile(fs, settings, path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		name := strings.ToUpper(s.key)
+		if v := os.Getenv(name); v != "" {
+			if err := fs.Set(s.flag, v); err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q: %v", name, v, err)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configPath finds the -config flag in args, or else CONFIG_FILE. The file
+// ranks below flags, so it is read before args are parsed.
+func configPath(args []string) string {
+	path := os.Getenv("CONFIG_FILE")
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if ok {
+			path = value
+		} else if i+1 < len(args) {
+			i++
+			path = args[i]
+		}
+	}
+	return path
+}
+
+// applyFile sets the settings found in the config file at path
+func applyFile(fs *flag.FlagSet, settings []setting, path string) error {
+	entries, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	flags := make(map[string]string, len(settings))
+	for _, s := range settings {
+		flags[s.key] = s.flag
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return entries[keys[i]].line < entries[keys[j]].line })
+	for _, key := range keys {
+		e := entries[key]
+		name, ok := flags[key]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, e.line, key)
+		}
+		if err := fs.Set(name, e.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: invalid value %q: %v", path, e.line, key, e.value, err)
+		}
+	}
+	return nil
+}
+
+// values returns each setting of cfg as its flag would print it
+func values(cfg *Config) map[string]string {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	bind(fs, cfg)
+	v := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v[f.Name] = f.Value.String()
+	})
+	return v
+}
+
+// validate checks cfg and fills in the fields derived from others. Every
+// problem found is reported, not only the first.
+func validate(cfg *Config) error {
+	var problems []string
+	fail := func(format string, a ...any) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if _, err := logging.NewHandler(io.Discard, cfg.LogLevel, cfg.LogFormat); err != nil {
+		fail("%v", err)
+	}
+	if cfg.StorageBackend != "local" && cfg.StorageBackend != "s3" {
+		fail("storage backend must be local or s3")
+	}
+	if cfg.StorageBackend == "s3" && (cfg.S3Endpoint == "" || cfg.S3Bucket == "") {
+		fail("S3 storage requires s3_endpoint and s3_bucket")
+	}
+	if cfg.AdminSecret != "" && len(cfg.AdminSecret) < 16 {
+		fail("admin secret must be at least 16 characters")
+	}
+	if cfg.OrphanUploadRetention <= 0 {
+		fail("orphan upload retention must be positive")
+	}
+	if cfg.AuditRetention < 0 {
+		fail("audit retention must not be negative")
+	}
+	if cfg.MessageRate <= 0 || cfg.ReadRate <= 0 || cfg.FrameRate <= 0 {
+		fail("frame rates must be positive")
+	}
+	if cfg.MessageBurst < 1 || cfg.ReadBurst < 1 || cfg.FrameBurst < 1 {
+		fail("frame bursts must be at least 1")
+	}
+	if cfg.SlowClientAction != "disconnect" && cfg.SlowClientAction != "drop" {
+		fail("slow client action must be disconnect or drop")
+	}
+	if cfg.SendQueueSize < 16 {
+		fail("send queue size must be at least 16")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fail("TLS requires both a certificate and a key")
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		fail("trace sample ratio must be between 0 and 1")
+	}
+	if cfg.HTTPRedirectPort != 0 && cfg.TLSCert == "" {
+		fail("HTTP redirect port requires TLS")
+	}
+	if cfg.HTTPRedirectPort != 0 && cfg.HTTPRedirectPort == cfg.Port {
+		fail("HTTP redirect port must differ from the server port")
+	}
+
+	nets, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		fail("invalid trusted proxies: %v", err)
+	}
+	cfg.TrustedProxyNets = nets
+
+	origins, err := parseOrigins(cfg.AllowedOrigins)
+	if err != nil {
+		fail("invalid allowed origins: %v", err)
+	}
+	cfg.AllowedOriginList = origins
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
 	}
 
 	// Generate password hash for verification
 	hash := sha256.Sum256([]byte(cfg.Password))
 	cfg.PasswordHash = hex.EncodeToString(hash[:])
 
-	// Ensure directories exist
-	ensureDir(filepath.Dir(cfg.DBPath))
-	ensureDir(cfg.UploadDir)
-
 	cfg.Version = AppVersion
 	if cfg.Version == "" {
 		cfg.Version = "dev"
 	}
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of IPs and CIDRs
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry += "/" + strconv.Itoa(bits)
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
 
-	return cfg
+// parseOrigins parses a comma-separated list of origins into their
+// normalized scheme://host[:port] form
+func parseOrigins(list string) ([]string, error) {
+	var origins []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		origin, ok := NormalizeOrigin(entry)
+		if !ok {
+			return nil, fmt.Errorf("%q is not an origin like https://chat.example.com", entry)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
 }
 
-// Get returns the current configuration
-func Get() *Config {
-	return cfg
+// NormalizeOrigin lowercases an http(s) origin and strips a trailing slash
+// and any default port, reporting false if s is not one
+func NormalizeOrigin(s string) (string, bool) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSuffix(s, "/")))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return "", false
+	}
+	host := u.Host
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		host = strings.TrimSuffix(host, ":"+u.Port())
+	}
+	return u.Scheme + "://" + host, true
 }
 
 // ensureDir creates directory if it doesn't exist
 func ensureDir(path string) {
 	if err := os.MkdirAll(path, 0755); err != nil {
-		log.Fatalf("Failed to create directory %s: %v", path, err)
+		logging.Fatal("Failed to create directory", "path", path, "err", err)
 	}
 }
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into a temporary directory
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "port: 1000\nmessage_rate: 2\nlog_level: warn\ndb_path: /from/file.db\n")
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("MESSAGE_RATE", "3")
+	t.Setenv("LOG_LEVEL", "error")
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, err := load(fs, []string{"-config", path, "-log-level", "debug"})
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default", cfg.SendQueueSize, 256},
+		{"file over default", cfg.Port, 1000},
+		{"file only", cfg.DBPath, "/from/file.db"},
+		{"env over file", cfg.MessageRate, 3.0},
+		{"flag over env", cfg.LogLevel, "debug"},
+		{"config path", cfg.ConfigFile, path},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	tests := []struct {
+		name    string
+		file    string
+		env     string
+		wantErr string
+	}{
+		{name: "unknown key", file: "port: 1\nprot: 2\n", wantErr: `:2: unknown setting "prot"`},
+		{name: "bad file value", file: "port: many\n", wantErr: `:1: port: invalid value "many"`},
+		{name: "bad env value", file: "port: 1\n", env: "many", wantErr: `PORT: invalid value "many"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", tt.env)
+			fs := flag.NewFlagSet("", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			_, err := load(fs, []string{"-config=" + writeConfig(t, tt.file)})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadAppliesOnlyReloadable(t *testing.T) {
+	path := writeConfig(t, "password: pw\nport: 1000\nmessage_rate: 2\n")
+	t.Setenv("CONFIG_FILE", "")
+	prevArgs, prev := args, Get()
+	t.Cleanup(func() {
+		args = prevArgs
+		current.Store(prev)
+	})
+
+	args = []string{"-config", path, "-message-burst", "7"}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	cfg, err := Load(fs, args)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// message_burst is reloadable but set by a flag, which still wins
+	if err := os.WriteFile(path, []byte("password: pw\nport: 2000\nmessage_rate: 4\nmessage_burst: 9\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	got := Get()
+	if got == cfg {
+		t.Fatal("Reload() modified the published config instead of replacing it")
+	}
+	if got.MessageRate != 4 {
+		t.Errorf("MessageRate = %v, want 4 from the reloaded file", got.MessageRate)
+	}
+	if got.Port != 1000 {
+		t.Errorf("Port = %d, want 1000 until a restart", got.Port)
+	}
+	if got.MessageBurst != 7 {
+		t.Errorf("MessageBurst = %d, want the flag's 7", got.MessageBurst)
+	}
+	if cfg.MessageRate != 2 {
+		t.Errorf("old snapshot MessageRate = %v, want 2", cfg.MessageRate)
+	}
+
+	// An invalid file keeps the running configuration
+	if err := os.WriteFile(path, []byte("password: pw\nmessage_rate: -1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err == nil {
+		t.Error("Reload() accepted an invalid message rate")
+	}
+	if Get() != got {
+		t.Error("a failed Reload() replaced the configuration")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{name: "defaults", modify: func(*Config) {}},
+		{name: "storage backend", modify: func(c *Config) { c.StorageBackend = "ftp" }, wantErr: "storage backend must be local or s3"},
+		{name: "s3 bucket", modify: func(c *Config) { c.StorageBackend = "s3" }, wantErr: "S3 storage requires s3_endpoint and s3_bucket"},
+		{name: "short admin secret", modify: func(c *Config) { c.AdminSecret = "short" }, wantErr: "admin secret must be at least 16 characters"},
+		{name: "orphan retention", modify: func(c *Config) { c.OrphanUploadRetention = 0 }, wantErr: "orphan upload retention must be positive"},
+		{name: "audit retention", modify: func(c *Config) { c.AuditRetention = -time.Hour }, wantErr: "audit retention must not be negative"},
+		{name: "frame rate", modify: func(c *Config) { c.ReadRate = 0 }, wantErr: "frame rates must be positive"},
+		{name: "frame burst", modify: func(c *Config) { c.FrameBurst = 0 }, wantErr: "frame bursts must be at least 1"},
+		{name: "slow client action", modify: func(c *Config) { c.SlowClientAction = "wait" }, wantErr: "slow client action must be disconnect or drop"},
+		{name: "send queue", modify: func(c *Config) { c.SendQueueSize = 8 }, wantErr: "send queue size must be at least 16"},
+		{name: "tls pair", modify: func(c *Config) { c.TLSCert = "cert.pem" }, wantErr: "TLS requires both a certificate and a key"},
+		{name: "sample ratio", modify: func(c *Config) { c.TraceSampleRatio = 2 }, wantErr: "trace sample ratio must be between 0 and 1"},
+		{name: "redirect without tls", modify: func(c *Config) { c.HTTPRedirectPort = 80 }, wantErr: "HTTP redirect port requires TLS"},
+		{name: "log level", modify: func(c *Config) { c.LogLevel = "loud" }, wantErr: "loud"},
+		{name: "trusted proxies", modify: func(c *Config) { c.TrustedProxies = "10.0.0.0/33" }, wantErr: "invalid trusted proxies"},
+		{name: "allowed origins", modify: func(c *Config) { c.AllowedOrigins = "chat.example.com" }, wantErr: `invalid allowed origins: "chat.example.com" is not an origin`},
+		{
+			name: "every problem",
+			modify: func(c *Config) {
+				c.SendQueueSize = 8
+				c.SlowClientAction = "wait"
+			},
+			wantErr: "slow client action must be disconnect or drop; send queue size must be at least 16",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaults()
+			cfg.Password = "pw"
+			tt.modify(cfg)
+			err := validate(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				if cfg.PasswordHash == "" || cfg.Version == "" {
+					t.Errorf("validate() did not fill in derived fields: %+v", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeOrigin(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"https://chat.example.com", "https://chat.example.com", true},
+		{"HTTPS://Chat.Example.COM/", "https://chat.example.com", true},
+		{"https://chat.example.com:443", "https://chat.example.com", true},
+		{"http://chat.example.com:80", "http://chat.example.com", true},
+		{"https://chat.example.com:8443", "https://chat.example.com:8443", true},
+		{"http://localhost:5173", "http://localhost:5173", true},
+		{"chat.example.com", "", false},
+		{"ftp://chat.example.com", "", false},
+		{"https://chat.example.com/app", "", false},
+		{"https://chat.example.com?x=1", "", false},
+		{"https://user@chat.example.com", "", false},
+		{"https://", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := NormalizeOrigin(tt.input)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("NormalizeOrigin(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{input: " 192.168.1.1 , 10.1.2.3/16 ,", want: []string{"192.168.1.1/32", "10.1.0.0/16"}},
+		{input: "::1", want: []string{"::1/128"}},
+		{input: "fd00::/8", want: []string{"fd00::/8"}},
+		{input: "10.0.0.0/33", wantErr: true},
+		{input: "proxy.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		nets, err := parseCIDRs(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCIDRs(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseCIDRs(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// entry is one setting read from the config file
+type entry struct {
+	value string
+	line  int
+}
+
+// readFile reads a config file written in a flat subset of YAML:
+//
+//	# comment
+//	port: 8443
+//	password: "correct horse"
+//	allowed_origins: [https://a.example.com, https://b.example.com]
+//	trusted_proxies:
+//	  - 10.0.0.0/8
+//	  - 192.168.1.1
+//
+// Lists are joined with commas, the form list settings take in the
+// environment and on the command line. Nested sections are not supported.
+func readFile(path string) (map[string]entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := parseFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return entries, nil
+}
+
+// parseFile parses config file contents; errors start with the line number
+func parseFile(r io.Reader) (map[string]entry, error) {
+	entries := make(map[string]entry)
+	var listKey string // key whose block list is being read
+	var list []string
+
+	endList := func() {
+		if listKey != "" {
+			e := entries[listKey]
+			e.value = strings.Join(list, ",")
+			entries[listKey] = e
+			listKey, list = "", nil
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimRight(scanner.Text(), " \t\r")
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" || line == "---" {
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if listKey == "" || !indented {
+				return nil, fmt.Errorf("%d: list item without a setting", n)
+			}
+			item, err := unquote(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", n, err)
+			}
+			list = append(list, item)
+			continue
+		}
+		if indented {
+			return nil, fmt.Errorf("%d: nested sections are not supported", n)
+		}
+		endList()
+
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("%d: expected \"key: value\"", n)
+		}
+		if _, dup := entries[key]; dup {
+			return nil, fmt.Errorf("%d: %s is set twice", n, key)
+		}
+
+		value = strings.TrimSpace(value)
+		var err error
+		switch {
+		case value == "":
+			// A block list may follow
+			listKey = key
+		case strings.HasPrefix(value, "["):
+			value, err = flowList(value)
+		default:
+			value, err = unquote(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %v", n, key, err)
+		}
+		entries[key] = entry{value: value, line: n}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	endList()
+	return entries, nil
+}
+
+// stripComment removes a # comment that is outside quotes and starts the
+// line or follows whitespace
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// unquote returns a plain, 'single' or "double" quoted scalar's value
+func unquote(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("bad quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '{', '&', '*', '!', '|', '>':
+		return "", fmt.Errorf("unsupported value %s", s)
+	}
+	return s, nil
+}
+
+// flowList joins the items of a [a, b] list with commas
+func flowList(s string) (string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return "", fmt.Errorf("unterminated list %s", s)
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return "", nil
+	}
+	var items []string
+	for _, item := range strings.Split(inner, ",") {
+		v, err := unquote(strings.TrimSpace(item))
+		if err != nil {
+			return "", err
+		}
+		items = append(items, v)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// WriteSetting sets key to value in the config file at path, replacing the
+// line that sets it, with the items of a block list below it, or appending
+// one; the rest of the file is kept. The file is replaced atomically.
+func WriteSetting(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	line := key + ": " + strconv.Quote(value)
+	// Blank and comment lines between list items are held back until the
+	// list is known to go on, so that a comment after the list is kept
+	var lines, held []string
+	replaced, inBlock := false, false
+	for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if inBlock {
+			item := strings.TrimSpace(stripComment(l))
+			switch {
+			case item == "":
+				held = append(held, l)
+				continue
+			case strings.HasPrefix(item, "-") || l[0] == ' ' || l[0] == '\t':
+				held = nil
+				continue
+			}
+			lines = append(lines, held...)
+			held, inBlock = nil, false
+		}
+		if k, _, ok := strings.Cut(l, ":"); ok && strings.TrimRight(k, " \t") == key {
+			// A block list's items follow its key and go with it
+			lines = append(lines, line)
+			replaced, inBlock = true, true
+			continue
+		}
+		lines = append(lines, l)
+	}
+	lines = append(lines, held...)
+	if !replaced {
+		lines = append(lines, line)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
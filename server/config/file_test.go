@@ -0,0 +1,144 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "scalars",
+			input: "port: 8443\nlog_level: debug\n",
+			want:  map[string]string{"port": "8443", "log_level": "debug"},
+		},
+		{
+			name:  "quotes and comments",
+			input: "# comment\n---\npassword: \"correct # horse\"  # trailing\nadmin_secret: 'it''s a secret'\n",
+			want:  map[string]string{"password": "correct # horse", "admin_secret": "it's a secret"},
+		},
+		{
+			name:  "hash inside a word",
+			input: "password: abc#def\n",
+			want:  map[string]string{"password": "abc#def"},
+		},
+		{
+			name:  "flow list",
+			input: "allowed_origins: [https://a.example.com, \"https://b.example.com\"]\n",
+			want:  map[string]string{"allowed_origins": "https://a.example.com,https://b.example.com"},
+		},
+		{
+			name:  "block list",
+			input: "trusted_proxies:\n  - 10.0.0.0/8\n\n  # the office\n  - 192.168.1.1\nport: 80\n",
+			want:  map[string]string{"trusted_proxies": "10.0.0.0/8,192.168.1.1", "port": "80"},
+		},
+		{
+			name:  "empty value",
+			input: "s3_prefix:\n",
+			want:  map[string]string{"s3_prefix": ""},
+		},
+		{name: "nested section", input: "s3:\n  bucket: chat\n", wantErr: "2: nested sections are not supported"},
+		{name: "list without key", input: "- 10.0.0.1\n", wantErr: "1: list item without a setting"},
+		{name: "duplicate key", input: "port: 1\nport: 2\n", wantErr: "2: port is set twice"},
+		{name: "missing colon", input: "port 8080\n", wantErr: "1: expected \"key: value\""},
+		{name: "bad quote", input: "password: \"open\n", wantErr: "1: password: bad quoted string"},
+		{name: "unterminated list", input: "allowed_origins: [a, b\n", wantErr: "1: allowed_origins: unterminated list"},
+		{name: "anchor", input: "password: &pw secret\n", wantErr: "1: password: unsupported value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseFile(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("parseFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFile() error = %v", err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("parseFile() = %d entries, want %d", len(entries), len(tt.want))
+			}
+			for key, want := range tt.want {
+				if got := entries[key].value; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSetting(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		key   string
+		want  string
+	}{
+		{
+			name:  "replace scalar",
+			input: "# room\npassword: old  # set by hand\nport: 8080\n",
+			key:   "password",
+			want:  "# room\npassword: \"new\"\nport: 8080\n",
+		},
+		{
+			name:  "append",
+			input: "port: 8080\n",
+			key:   "password",
+			want:  "port: 8080\npassword: \"new\"\n",
+		},
+		{
+			name:  "replace block list",
+			input: "trusted_proxies:\n  - 10.0.0.0/8\n  # the office\n  - 192.168.1.1\n\n# next\nport: 8080\n",
+			key:   "trusted_proxies",
+			want:  "trusted_proxies: \"new\"\n\n# next\nport: 8080\n",
+		},
+		{
+			name:  "replace block list at end",
+			input: "trusted_proxies:\n  - 10.0.0.0/8\n",
+			key:   "trusted_proxies",
+			want:  "trusted_proxies: \"new\"\n",
+		},
+		{
+			name:  "replace flow list",
+			input: "allowed_origins: [https://a.example.com]\nport: 8080\n",
+			key:   "allowed_origins",
+			want:  "allowed_origins: \"new\"\nport: 8080\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.input), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteSetting(path, tt.key, "new"); err != nil {
+				t.Fatalf("WriteSetting() error = %v", err)
+			}
+			data, _ := os.ReadFile(path)
+			if string(data) != tt.want {
+				t.Errorf("file = %q, want %q", data, tt.want)
+			}
+			entries, err := readFile(path)
+			if err != nil {
+				t.Fatalf("rewritten file does not parse: %v", err)
+			}
+			if entries[tt.key].value != "new" {
+				t.Errorf("%s = %q, want new", tt.key, entries[tt.key].value)
+			}
+			if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+				t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
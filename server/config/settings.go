@@ -0,0 +1,111 @@
+package config
+
+import (
+	"flag"
+	"time"
+)
+
+// setting ties a command line flag to its key in the config file. The
+// environment variable is the key in upper case.
+type setting struct {
+	flag string
+	key  string
+}
+
+// reloadable lists the keys of settings that take effect on SIGHUP; the
+// rest need a restart
+var reloadable = map[string]bool{
+	"message_rate":            true,
+	"message_burst":           true,
+	"read_rate":               true,
+	"read_burst":              true,
+	"frame_rate":              true,
+	"frame_burst":             true,
+	"typing_interval":         true,
+	"rate_limit_strikes":      true,
+	"orphan_upload_retention": true,
+	"audit_retention":         true,
+	"allowed_origins":         true,
+	"allow_any_origin":        true,
+	"log_level":               true,
+}
+
+// binder registers settings as flags writing into a Config
+type binder struct {
+	fs       *flag.FlagSet
+	settings []setting
+}
+
+func (b *binder) intVar(p *int, name, key, usage string) {
+	b.fs.IntVar(p, name, *p, usage)
+	b.settings = append(b.settings, setting{name, key})
+}
+
+func (b *binder) stringVar(p *string, name, key, usage string) {
+	b.fs.StringVar(p, name, *p, usage)
+	b.settings = append(b.settings, setting{name, key})
+}
+
+func (b *binder) boolVar(p *bool, name, key, usage string) {
+	b.fs.BoolVar(p, name, *p, usage)
+	b.settings = append(b.settings, setting{name, key})
+}
+
+func (b *binder) float64Var(p *float64, name, key, usage string) {
+	b.fs.Float64Var(p, name, *p, usage)
+	b.settings = append(b.settings, setting{name, key})
+}
+
+func (b *binder) durationVar(p *time.Duration, name, key, usage string) {
+	b.fs.DurationVar(p, name, *p, usage)
+	b.settings = append(b.settings, setting{name, key})
+}
+
+// bind registers every setting of c on fs, with c's current values as the
+// defaults, and returns the settings
+func bind(fs *flag.FlagSet, c *Config) []setting {
+	b := &binder{fs: fs}
+	b.intVar(&c.Port, "port", "port", "Server port")
+	b.stringVar(&c.Password, "password", "password", "Chat room password (required)")
+	b.stringVar(&c.DBPath, "db", "db_path", "Database file path")
+	b.stringVar(&c.UploadDir, "uploads", "upload_dir", "Upload directory")
+	b.stringVar(&c.StorageBackend, "storage", "storage_backend", "Upload storage backend (local or s3)")
+	b.stringVar(&c.S3Endpoint, "s3-endpoint", "s3_endpoint", "S3-compatible endpoint URL")
+	b.stringVar(&c.S3Region, "s3-region", "s3_region", "S3 region")
+	b.stringVar(&c.S3Bucket, "s3-bucket", "s3_bucket", "S3 bucket")
+	b.stringVar(&c.S3Prefix, "s3-prefix", "s3_prefix", "Key prefix inside the S3 bucket")
+	b.stringVar(&c.S3AccessKey, "s3-access-key", "s3_access_key", "S3 access key")
+	b.stringVar(&c.S3SecretKey, "s3-secret-key", "s3_secret_key", "S3 secret key")
+	b.boolVar(&c.S3PathStyle, "s3-path-style", "s3_path_style", "Use path-style S3 URLs (MinIO)")
+	b.boolVar(&c.S3Presign, "s3-presign", "s3_presign", "Redirect downloads to presigned S3 URLs")
+	b.durationVar(&c.OrphanUploadRetention, "orphan-upload-retention", "orphan_upload_retention", "How long an unreferenced upload is kept before it is deleted")
+	b.durationVar(&c.AuditRetention, "audit-retention", "audit_retention", "How long audit events are kept (0 keeps them forever)")
+	b.stringVar(&c.BootstrapAdmin, "admin", "bootstrap_admin", "User ID to grant the admin role")
+	b.stringVar(&c.AdminSecret, "admin-secret", "admin_secret", "Secret for the admin API's X-Admin-Secret header (at least 16 characters)")
+	b.stringVar(&c.TrustedProxies, "trusted-proxies", "trusted_proxies", "Comma-separated proxy IPs or CIDRs allowed to set X-Forwarded-For")
+	b.intVar(&c.AuthLockoutThreshold, "auth-lockout-threshold", "auth_lockout_threshold", "Failed auth attempts before a temporary lockout")
+	b.durationVar(&c.AuthLockoutDuration, "auth-lockout-duration", "auth_lockout_duration", "How long an auth lockout lasts")
+	b.float64Var(&c.MessageRate, "message-rate", "message_rate", "Chat messages per second allowed per connection")
+	b.intVar(&c.MessageBurst, "message-burst", "message_burst", "Chat message burst allowed per connection")
+	b.float64Var(&c.ReadRate, "read-rate", "read_rate", "Read receipts per second allowed per connection")
+	b.intVar(&c.ReadBurst, "read-burst", "read_burst", "Read receipt burst allowed per connection")
+	b.float64Var(&c.FrameRate, "frame-rate", "frame_rate", "Other frames per second allowed per connection")
+	b.intVar(&c.FrameBurst, "frame-burst", "frame_burst", "Other frame burst allowed per connection")
+	b.durationVar(&c.TypingInterval, "typing-interval", "typing_interval", "Minimum gap between relayed typing events")
+	b.intVar(&c.RateLimitStrikes, "rate-limit-strikes", "rate_limit_strikes", "Rate limit warnings before a client is disconnected")
+	b.intVar(&c.SendQueueSize, "send-queue", "send_queue_size", "Outgoing frames buffered per connection")
+	b.stringVar(&c.SlowClientAction, "slow-client-action", "slow_client_action", "What to do when a send queue is full (disconnect or drop)")
+	b.durationVar(&c.ShutdownTimeout, "shutdown-timeout", "shutdown_timeout", "Maximum time to wait for a graceful shutdown")
+	b.stringVar(&c.TLSCert, "tls-cert", "tls_cert", "TLS certificate file (PEM) to serve HTTPS")
+	b.stringVar(&c.TLSKey, "tls-key", "tls_key", "TLS private key file (PEM)")
+	b.intVar(&c.HTTPRedirectPort, "http-redirect-port", "http_redirect_port", "Port redirecting plain HTTP to HTTPS (0 disables)")
+	b.stringVar(&c.AllowedOrigins, "allowed-origins", "allowed_origins", "Comma-separated origins allowed besides the server's own")
+	b.boolVar(&c.AllowAnyOrigin, "allow-any-origin", "allow_any_origin", "Accept requests from any origin (development only)")
+	b.stringVar(&c.MetricsAddr, "metrics-addr", "metrics_addr", "Separate address for /metrics (default: the main port)")
+	b.stringVar(&c.LogLevel, "log-level", "log_level", "Log level (debug, info, warn or error)")
+	b.stringVar(&c.LogFormat, "log-format", "log_format", "Log format (text or json)")
+	b.stringVar(&c.TraceExporter, "trace-exporter", "trace_exporter", "Trace exporter (none, stdout or otlp)")
+	b.stringVar(&c.OTLPEndpoint, "otlp-endpoint", "otlp_endpoint", "OTLP/HTTP collector URL for the otlp trace exporter")
+	b.float64Var(&c.TraceSampleRatio, "trace-sample-ratio", "trace_sample_ratio", "Fraction of new traces to record (0 to 1)")
+	return b.settings
+}
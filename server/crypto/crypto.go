@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 )
@@ -15,3 +16,12 @@ func HashPassword(password string) string {
 func VerifyPassword(password, hash string) bool {
 	return HashPassword(password) == hash
 }
+
+// RandomToken returns n random bytes from crypto/rand, hex encoded
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand unavailable: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -99,3 +99,15 @@ func TestVerifyPassword(t *testing.T) {
 		})
 	}
 }
+
+func TestRandomToken(t *testing.T) {
+	token1 := RandomToken(32)
+	token2 := RandomToken(32)
+
+	if len(token1) != 64 {
+		t.Errorf("RandomToken(32) length = %d, want 64", len(token1))
+	}
+	if token1 == token2 {
+		t.Error("RandomToken() should return different tokens")
+	}
+}
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/glebarez/sqlite v1.11.0
 	github.com/gorilla/websocket v1.5.1
+	golang.org/x/image v0.18.0
 )
 
 require (
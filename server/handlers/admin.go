@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+// adminSecretHeader carries the configured admin secret
+const adminSecretHeader = "X-Admin-Secret"
+
+// adminSecretActor is recorded in the audit log for requests authorized by
+// the admin secret rather than a user's session
+const adminSecretActor = "admin-secret"
+
+// maxAnnouncementLength bounds system announcements
+const maxAnnouncementLength = 2000
+
+// ConnectionInfo describes a live WebSocket connection
+type ConnectionInfo struct {
+	ID          string `json:"id"`
+	UserID      string `json:"userId,omitempty"`
+	UserName    string `json:"userName,omitempty"`
+	RemoteAddr  string `json:"remoteAddr"`
+	ConnectedAt int64  `json:"connectedAt"` // Unix milliseconds
+	LastActive  int64  `json:"lastActive"`  // Unix milliseconds
+	Queued      int    `json:"queued"`
+	Peak        int64  `json:"peak"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+// AnnounceRequest is the body of POST /api/admin/announce
+type AnnounceRequest struct {
+	Message string `json:"message"`
+}
+
+// Connections returns the live connections, oldest first
+func (h *Hub) Connections() []ConnectionInfo {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	conns := make([]ConnectionInfo, 0, len(h.clients))
+	for client := range h.clients {
+		info := ConnectionInfo{
+			ID:          client.requestID,
+			RemoteAddr:  client.remoteAddr,
+			ConnectedAt: client.connectedAt.UnixMilli(),
+			LastActive:  client.lastActive.Load(),
+			Queued:      len(client.send),
+			Peak:        client.peakQueue.Load(),
+			Dropped:     client.dropped.Load(),
+		}
+		if client.verified && client.user != nil {
+			info.UserID = client.user.ID
+			info.UserName = client.user.Name
+		}
+		conns = append(conns, info)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectedAt < conns[j].ConnectedAt })
+	return conns
+}
+
+// disconnect closes the connection with the given ID, reporting whether it
+// was found, and the user it belonged to, if any
+func (h *Hub) disconnect(id string, code int, reason string) (string, bool) {
+	h.mutex.RLock()
+	var target *Client
+	for client := range h.clients {
+		if client.requestID == id {
+			target = client
+			break
+		}
+	}
+	var userID string
+	if target != nil && target.user != nil {
+		userID = target.user.ID
+	}
+	h.mutex.RUnlock()
+
+	if target == nil {
+		return "", false
+	}
+	closeConn(target.conn, code, reason)
+	return userID, true
+}
+
+// requireAdmin authorizes an admin API request, either by the admin secret
+// header when one is configured or by an admin's session. It returns the
+// actor to audit, or "" after writing an error response.
+func requireAdmin(w http.ResponseWriter, r *http.Request) string {
+	secret := r.Header.Get(adminSecretHeader)
+	if secret == "" {
+		if user := requireRole(w, r, models.RoleAdmin); user != nil {
+			return user.ID
+		}
+		return ""
+	}
+
+	// Secret guesses are throttled like password attempts
+	ip := clientIP(r)
+	if wait, ok := authAllowed(ip, ""); !ok {
+		sendTooManyAttempts(w, wait)
+		return ""
+	}
+	if !isAdminSecret(secret) {
+		authFailed(ip, "", remoteAddr(r))
+		auditAuthFailure(ip, adminSecretActor, remoteAddr(r), map[string]string{
+			"reason": "invalid admin secret",
+		})
+		sendJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "Invalid admin secret",
+		})
+		return ""
+	}
+	authSucceeded(ip, "")
+	return adminSecretActor
+}
+
+// isAdminSecret reports whether key is the configured admin secret
+func isAdminSecret(key string) bool {
+	want := config.Get().AdminSecret
+	return want != "" && subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+}
+
+// HandleAdminStatus reports the server version, uptime, connections and the
+// space used by the database and uploads
+func HandleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	cfg := config.Get()
+	uploads, uploadBytes, err := store.Get().WithContext(r.Context()).UploadUsage()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error reading upload usage", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to read upload usage",
+		})
+		return
+	}
+
+	queues := hub.QueueStats()
+	verified := 0
+	for _, c := range hub.Connections() {
+		if c.UserID != "" {
+			verified++
+		}
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"version":       cfg.Version,
+		"goVersion":     runtime.Version(),
+		"startedAt":     hub.startedAt.UnixMilli(),
+		"uptimeSeconds": int64(time.Since(hub.startedAt).Seconds()),
+		"shuttingDown":  hub.closing.Load(),
+		"connections": map[string]interface{}{
+			"total":           queues.Clients,
+			"authenticated":   verified,
+			"onlineUsers":     len(hub.GetOnlineUsers()),
+			"queued":          queues.Queued,
+			"queueCapacity":   queues.Capacity,
+			"droppedFrames":   queues.Dropped,
+			"slowDisconnects": queues.SlowDisconnects,
+		},
+		"database": map[string]interface{}{
+			"path":  cfg.DBPath,
+			"bytes": fileSizes(cfg.DBPath, cfg.DBPath+"-wal", cfg.DBPath+"-shm"),
+		},
+		"uploads": map[string]interface{}{
+			"backend": cfg.StorageBackend,
+			"count":   uploads,
+			"bytes":   uploadBytes,
+		},
+	})
+}
+
+// fileSizes sums the sizes of the files that exist among paths
+func fileSizes(paths ...string) int64 {
+	var total int64
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// HandleAdminConnections lists live WebSocket connections
+func HandleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": hub.Connections(),
+	})
+}
+
+// HandleAdminConnection disconnects one WebSocket connection:
+// DELETE /api/admin/connections/{id}?reason=...
+func HandleAdminConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/admin/connections/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Disconnected by an administrator"
+	}
+	userID, ok := hub.disconnect(id, closeKicked, reason)
+	if !ok {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Connection not found",
+		})
+		return
+	}
+
+	audit(models.AuditModeration, actor, userID, remoteAddr(r), map[string]string{
+		"action":     "disconnect",
+		"connection": id,
+		"reason":     reason,
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// HandleAdminAnnounce broadcasts a system message to everyone and keeps it
+// in the history
+func HandleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	var req AnnounceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" || len(req.Message) > maxAnnouncementLength {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Message must be 1 to 2000 characters",
+		})
+		return
+	}
+
+	msg := models.SystemMessage(req.Message)
+	if err := store.Get().WithContext(r.Context()).SaveMessage(msg); err != nil {
+		logging.FromContext(r.Context()).Error("Error saving announcement", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save announcement",
+		})
+		return
+	}
+	hub.broadcastMessage(r.Context(), msg)
+
+	audit(models.AuditModeration, actor, msg.ID, remoteAddr(r), map[string]string{
+		"action": "announce",
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": msg,
+	})
+}
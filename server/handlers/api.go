@@ -2,18 +2,21 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 
 	"sec-chat/server/config"
 	"sec-chat/server/crypto"
+	"sec-chat/server/imaging"
+	"sec-chat/server/logging"
 	"sec-chat/server/models"
 	"sec-chat/server/store"
+	"sec-chat/server/webhook"
 )
 
 // AuthRequest represents authentication request body
@@ -43,8 +46,23 @@ func HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if wait, ok := authAllowed(ip, ""); !ok {
+		auditAuthFailure(ip, "", remoteAddr(r), map[string]string{
+			"reason":   "rate limited",
+			"endpoint": "/api/auth",
+		})
+		sendTooManyAttempts(w, wait)
+		return
+	}
+
 	cfg := config.Get()
 	if !crypto.VerifyPassword(cfg.Password, req.PasswordHash) {
+		authFailed(ip, "", remoteAddr(r))
+		auditAuthFailure(ip, "", remoteAddr(r), map[string]string{
+			"reason":   "invalid password",
+			"endpoint": "/api/auth",
+		})
 		sendJSON(w, http.StatusUnauthorized, AuthResponse{
 			Success: false,
 			Message: "Invalid password",
@@ -52,6 +70,10 @@ func HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	authSucceeded(ip, "")
+	audit(models.AuditAuthSuccess, "", "", remoteAddr(r), map[string]string{
+		"endpoint": "/api/auth",
+	})
 	sendJSON(w, http.StatusOK, AuthResponse{
 		Success: true,
 		Message: "Authentication successful",
@@ -83,9 +105,9 @@ func HandleMessages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages, err := store.Get().GetMessages(before, limit)
+	messages, err := store.Get().WithContext(r.Context()).GetMessages(before, limit)
 	if err != nil {
-		log.Printf("Error getting messages: %v", err)
+		logging.FromContext(r.Context()).Error("Error getting messages", "err", err)
 		sendJSON(w, http.StatusInternalServerError, map[string]string{
 			"error": "Failed to retrieve messages",
 		})
@@ -105,8 +127,15 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Limit upload size to 10MB
-	r.ParseMultipartForm(10 << 20)
+	// Limit upload size to 10MB; larger parts would otherwise spill to disk
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+uploadFormOverhead)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendUploadTooLarge(w)
+			return
+		}
+	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
@@ -117,36 +146,59 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := time.Now().Format("20060102150405") + "_" + randomString(8) + ext
-
-	cfg := config.Get()
-	filepath := filepath.Join(cfg.UploadDir, filename)
-
-	// Create file
-	dst, err := os.Create(filepath)
-	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		sendJSON(w, http.StatusInternalServerError, map[string]string{
-			"error": "Failed to save file",
+	// Store under the content hash so identical files are kept once
+	upload, err := storeUpload(file, filepath.Ext(header.Filename))
+	if err == imaging.ErrNotImage {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "File looks like an image but could not be read",
 		})
 		return
 	}
-	defer dst.Close()
-
-	// Copy content
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Printf("Error saving file: %v", err)
+	if err == imaging.ErrTooLarge {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Image dimensions too large",
+		})
+		return
+	}
+	if err == errUploadTooLarge {
+		sendUploadTooLarge(w)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error saving file", "err", err)
 		sendJSON(w, http.StatusInternalServerError, map[string]string{
 			"error": "Failed to save file",
 		})
 		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{
-		"url":      "/uploads/" + filename,
-		"filename": filename,
+	audit(models.AuditUpload, sessionUser(r), upload.Name, remoteAddr(r), map[string]string{
+		"size": strconv.FormatInt(upload.Size, 10),
+	})
+	webhook.Emit(models.EventUploadCreated, map[string]interface{}{
+		"name":   upload.Name,
+		"url":    "/uploads/" + upload.Name,
+		"size":   upload.Size,
+		"userId": sessionUser(r),
+	})
+
+	resp := map[string]interface{}{
+		"url":      "/uploads/" + upload.Name,
+		"filename": upload.Name,
+		"size":     upload.Size,
+	}
+	if upload.Thumb != "" {
+		resp["thumbUrl"] = "/uploads/" + upload.Thumb
+		resp["width"] = upload.Width
+		resp["height"] = upload.Height
+	}
+	sendJSON(w, http.StatusOK, resp)
+}
+
+// sendUploadTooLarge rejects an upload above maxUploadSize
+func sendUploadTooLarge(w http.ResponseWriter) {
+	sendJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+		"error": "File too large; the limit is 10 MB",
 	})
 }
 
@@ -158,24 +210,25 @@ func HandleMembers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get all users from database
-	users, err := store.Get().GetUsers()
+	users, err := store.Get().WithContext(r.Context()).GetUsers()
 	if err != nil {
-		log.Printf("Error getting users: %v", err)
+		logging.FromContext(r.Context()).Error("Error getting users", "err", err)
 		sendJSON(w, http.StatusInternalServerError, map[string]string{
 			"error": "Failed to retrieve members",
 		})
 		return
 	}
 
-	// Mark online users
+	// Mark online users; invisible users are not in the online list and
+	// appear offline
 	onlineUsers := GetHub().GetOnlineUsers()
-	onlineMap := make(map[string]bool)
+	onlineMap := make(map[string]*models.User)
 	for _, u := range onlineUsers {
-		onlineMap[u.ID] = true
+		onlineMap[u.ID] = u
 	}
 
 	for _, u := range users {
-		u.Online = onlineMap[u.ID]
+		applyPresence(u, onlineMap[u.ID])
 	}
 
 	sendJSON(w, http.StatusOK, map[string]interface{}{
@@ -190,85 +243,97 @@ func sendJSON(w http.ResponseWriter, status int, v interface{}) {
 	json.NewEncoder(w).Encode(v)
 }
 
-// randomString generates a random string
-func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[time.Now().UnixNano()%int64(len(charset))]
-		time.Sleep(time.Nanosecond)
-	}
-	return string(b)
-}
-
-// HandleAvatarUpdate handles avatar updates
+// HandleAvatarUpdate handles avatar uploads for the authenticated user. The
+// image is cropped to a square and scaled to fixed sizes before it is stored.
 func HandleAvatarUpdate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		UserID string `json:"userId"`
-		Avatar string `json:"avatar"`
+	userID := requireSession(w, r)
+	if userID == "" {
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+
+	// Limit avatar size to 5MB
+	r.Body = http.MaxBytesReader(w, r.Body, 5<<20)
+	file, _, err := r.FormFile("file")
+	if err != nil {
 		sendJSON(w, http.StatusBadRequest, map[string]string{
-			"error": "Invalid request body",
+			"error": "Failed to read file",
 		})
 		return
 	}
+	defer file.Close()
 
-	if req.UserID == "" || req.Avatar == "" {
+	data, err := io.ReadAll(file)
+	if err != nil {
 		sendJSON(w, http.StatusBadRequest, map[string]string{
-			"error": "Missing userId or avatar",
+			"error": "Failed to read file",
 		})
 		return
 	}
 
-	// Update user in database
-	// We need to fetch the existing user first to preserve other fields
-	// But Store.SaveUser uses REPLACE INTO, so we need all fields.
-	// Actually, Store.SaveUser takes a *models.User.
-	// Let's get the user first.
-	users, err := store.Get().GetUsers()
+	variants, ext, err := imaging.Avatar(data, imaging.AvatarSize, imaging.AvatarSmallSize)
+	if err == imaging.ErrNotImage || err == imaging.ErrTooLarge {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Unsupported image",
+		})
+		return
+	}
 	if err != nil {
+		logging.FromContext(r.Context()).Error("Error processing avatar", "err", err)
 		sendJSON(w, http.StatusInternalServerError, map[string]string{
-			"error": "Failed to get users",
+			"error": "Failed to process image",
 		})
 		return
 	}
 
-	var targetUser *models.User
-	for _, u := range users {
-		if u.ID == req.UserID {
-			targetUser = u
-			break
-		}
-	}
-
-	if targetUser == nil {
-		sendJSON(w, http.StatusNotFound, map[string]string{
-			"error": "User not found",
+	avatar, err := saveAvatar(variants[0], variants[1], ext)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error saving avatar", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save file",
 		})
 		return
 	}
 
-	targetUser.Avatar = req.Avatar
-	if err := store.Get().SaveUser(targetUser); err != nil {
+	// Only the avatar is written, so a profile change made meanwhile is kept.
+	// The version query busts caches that still hold the previous avatar.
+	db := store.Get().WithContext(r.Context())
+	avatarURL := fmt.Sprintf("/uploads/%s?v=%d", avatar.Name, time.Now().UnixMilli())
+	found, err := db.SetUserAvatar(userID, avatarURL)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error updating avatar", "user_id", userID, "err", err)
 		sendJSON(w, http.StatusInternalServerError, map[string]string{
 			"error": "Failed to update user",
 		})
 		return
 	}
+	if !found {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+		return
+	}
+
+	replaceUploadRef(models.UploadRefAvatar, userID, avatarURL)
+	audit(models.AuditAvatarChange, userID, userID, remoteAddr(r), map[string]string{
+		"avatar": avatarURL,
+	})
 
 	// Broadcast user update via WebSocket
-	// We can reuse the "users" list broadcast since it contains all info
-	GetHub().UpdateUserAvatar(req.UserID, req.Avatar)
-	GetHub().BroadcastUsers()
+	GetHub().UpdateUserAvatar(userID, avatarURL)
+	if user, err := db.GetUser(userID); err != nil {
+		logging.FromContext(r.Context()).Error("Error getting user", "user_id", userID, "err", err)
+	} else if user != nil {
+		GetHub().BroadcastUserUpdated(user, "")
+	}
 
 	sendJSON(w, http.StatusOK, map[string]interface{}{
-		"success": true,
-		"avatar":  req.Avatar,
+		"success":     true,
+		"avatar":      avatarURL,
+		"avatarSmall": "/uploads/" + avatar.Thumb,
 	})
 }
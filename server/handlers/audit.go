@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+const (
+	// auditExportBatch is how many events the JSONL export reads per query
+	auditExportBatch = 500
+	// auditPruneInterval is how often events past the retention are removed
+	auditPruneInterval = time.Hour
+)
+
+// passwordFingerprintKey is the settings key holding a hash of the last
+// seen password hash, used to detect rotations across restarts
+const passwordFingerprintKey = "password_fingerprint"
+
+// audit appends an event to the audit log. Failures are logged rather than
+// returned so that auditing never blocks the action itself.
+func audit(eventType, actorID, targetID, remoteAddr string, details map[string]string) {
+	err := store.Get().AppendAudit(&models.AuditEvent{
+		Time:       time.Now().UnixMilli(),
+		Type:       eventType,
+		ActorID:    actorID,
+		TargetID:   targetID,
+		RemoteAddr: remoteAddr,
+		Details:    details,
+	})
+	if err != nil {
+		slog.Error("Error writing audit event", "event", eventType, "err", err)
+	}
+}
+
+// remoteAddr returns the client address of r for the audit log. A
+// forwarded address from an untrusted peer is appended rather than believed.
+func remoteAddr(r *http.Request) string {
+	addr := clientIP(r)
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && addr == peerIP(r) {
+		addr += " (forwarded for " + fwd + ")"
+	}
+	return addr
+}
+
+// RecordPasswordRotation writes an audit event when the room password hash
+// differs from the one seen on the previous call, including previous runs
+func RecordPasswordRotation(passwordHash string) {
+	s := store.Get()
+	fingerprint := crypto.HashPassword(passwordHash)
+	previous, err := s.GetSetting(passwordFingerprintKey)
+	if err != nil {
+		slog.Error("Error reading password fingerprint", "err", err)
+		return
+	}
+	if previous == fingerprint {
+		return
+	}
+	if previous != "" {
+		audit(models.AuditPasswordRotated, "", "", "", nil)
+	}
+	if err := s.SetSetting(passwordFingerprintKey, fingerprint); err != nil {
+		slog.Error("Error saving password fingerprint", "err", err)
+	}
+}
+
+// StartAuditPruner periodically removes audit events older than the
+// configured retention. A zero retention keeps every event.
+func StartAuditPruner() {
+	go func() {
+		ticker := time.NewTicker(auditPruneInterval)
+		defer ticker.Stop()
+		for {
+			pruneAudit()
+			<-ticker.C
+		}
+	}()
+}
+
+// pruneAudit deletes events past the retention and records that it did, so
+// a gap at the start of the log is never unexplained
+func pruneAudit() {
+	retention := config.Get().AuditRetention
+	if retention <= 0 {
+		return
+	}
+	before := time.Now().Add(-retention).UnixMilli()
+	n, err := store.Get().PruneAudit(before)
+	if err != nil {
+		slog.Error("Error pruning audit log", "err", err)
+		return
+	}
+	if n > 0 {
+		audit(models.AuditPruned, "", "", "", map[string]string{
+			"count":  strconv.FormatInt(n, 10),
+			"before": strconv.FormatInt(before, 10),
+		})
+	}
+}
+
+// HandleAuditLog returns audit events matching the query filters as JSON
+func HandleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	filter := auditFilter(r)
+	filter.Limit = 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
+			filter.Limit = parsed
+		}
+	}
+
+	events, err := store.Get().WithContext(r.Context()).QueryAudit(filter)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error querying audit log", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to retrieve audit log",
+		})
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"events":  events,
+		"hasMore": len(events) == filter.Limit,
+	})
+}
+
+// HandleAuditExport streams all audit events matching the query filters as
+// JSON Lines, newest first
+func HandleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	filter := auditFilter(r)
+	filter.Limit = auditExportBatch
+	db := store.Get().WithContext(r.Context())
+
+	// The first batch is read before the headers are written, so that a
+	// failing store is reported rather than sent as an empty export
+	events, err := db.QueryAudit(filter)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error exporting audit log", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to export audit log",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+	enc := json.NewEncoder(w)
+
+	// Read in batches so the store is not locked while the client downloads
+	for {
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if len(events) < filter.Limit {
+			break
+		}
+		filter.BeforeID = events[len(events)-1].ID
+		if events, err = db.QueryAudit(filter); err != nil {
+			// The status is already sent; the truncated body is all we can do
+			logging.FromContext(r.Context()).Error("Error exporting audit log", "err", err)
+			return
+		}
+	}
+
+	audit(models.AuditExport, actor, "", remoteAddr(r), nil)
+}
+
+// auditFilter reads type, actor, target, since, until and before from the query
+func auditFilter(r *http.Request) models.AuditFilter {
+	q := r.URL.Query()
+	f := models.AuditFilter{
+		Type:     q.Get("type"),
+		ActorID:  q.Get("actor"),
+		TargetID: q.Get("target"),
+	}
+	f.Since, _ = strconv.ParseInt(q.Get("since"), 10, 64)
+	f.Until, _ = strconv.ParseInt(q.Get("until"), 10, 64)
+	f.BeforeID, _ = strconv.ParseInt(q.Get("before"), 10, 64)
+	return f
+}
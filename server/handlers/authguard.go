@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/models"
+	"sec-chat/server/ratelimit"
+)
+
+// Backoff between failed auth attempts starts at authBaseDelay and doubles
+// up to authMaxDelay; failures are forgotten after authForget without one
+const (
+	authBaseDelay = time.Second
+	authMaxDelay  = time.Minute
+	authForget    = time.Hour
+)
+
+// authFailureAuditWindow bounds how often failures from one IP are written
+// to the audit log, which cannot be pruned of recent entries
+const authFailureAuditWindow = 10 * time.Minute
+
+// closeRateLimited is the WebSocket close code for refused auth attempts
+const closeRateLimited = 4029
+
+var ipGuard, userGuard *ratelimit.Guard
+
+// failureTally picks the failures that are audited, see auditAuthFailure
+var failureTally *ratelimit.Tally
+
+// InitAuthGuard sets up the per-IP and per-user-ID failed auth trackers
+func InitAuthGuard(cfg *config.Config) {
+	opts := ratelimit.GuardOptions{
+		BaseDelay:       authBaseDelay,
+		MaxDelay:        authMaxDelay,
+		LockoutAfter:    cfg.AuthLockoutThreshold,
+		LockoutDuration: cfg.AuthLockoutDuration,
+		Forget:          authForget,
+	}
+	ipGuard = ratelimit.NewGuard(opts)
+	userGuard = ratelimit.NewGuard(opts)
+	failureTally = ratelimit.NewTally(authFailureAuditWindow)
+}
+
+// AuthLockouts returns the number of auth lockouts since startup
+func AuthLockouts() uint64 {
+	return ipGuard.Lockouts() + userGuard.Lockouts()
+}
+
+// authAllowed reports whether an auth attempt from ip for userID may be
+// checked now, and if not, how long the caller must wait. userID may be empty.
+func authAllowed(ip, userID string) (time.Duration, bool) {
+	wait, ok := ipGuard.Allow(ip)
+	if userID != "" {
+		if w, userOK := userGuard.Allow(userID); !userOK {
+			ok = false
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait, ok
+}
+
+// authFailed records a failed attempt and logs any lockout it caused
+func authFailed(ip, userID, remoteAddr string) {
+	authFailures.Inc()
+	if ipGuard.Fail(ip) {
+		slog.Warn("Auth lockout", "ip", ip)
+		audit(models.AuditAuthLockout, userID, "", remoteAddr, map[string]string{"key": "ip"})
+	}
+	if userID != "" && userGuard.Fail(userID) {
+		slog.Warn("Auth lockout", "user_id", userID)
+		audit(models.AuditAuthLockout, userID, "", remoteAddr, map[string]string{"key": "user"})
+	}
+}
+
+// auditAuthFailure records a failed or refused auth attempt from ip. Only
+// the first failure from an IP in each authFailureAuditWindow is written,
+// with the number of failures left out of its previous window, so that
+// failing repeatedly cannot grow the audit log without bound. Lockouts are
+// always audited.
+func auditAuthFailure(ip, actorID, remoteAddr string, details map[string]string) {
+	first, suppressed := failureTally.Record(ip)
+	if !first {
+		return
+	}
+	if suppressed > 0 {
+		details["suppressed"] = strconv.Itoa(suppressed)
+	}
+	audit(models.AuditAuthFailure, actorID, "", remoteAddr, details)
+}
+
+// authSucceeded clears the failures of ip and userID
+func authSucceeded(ip, userID string) {
+	ipGuard.Succeed(ip)
+	if userID != "" {
+		userGuard.Succeed(userID)
+	}
+}
+
+// retryMessage describes a refused attempt for the client
+func retryMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed attempts, retry in %d seconds", retrySeconds(wait))
+}
+
+// retrySeconds rounds wait up to whole seconds for Retry-After
+func retrySeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// sendTooManyAttempts writes a 429 response with Retry-After
+func sendTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(wait)))
+	sendJSON(w, http.StatusTooManyRequests, AuthResponse{
+		Success: false,
+		Message: retryMessage(wait),
+	})
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+func TestAuditAuthFailureAggregates(t *testing.T) {
+	setupHub(t)
+	InitAuthGuard(&config.Config{AuthLockoutThreshold: 10, AuthLockoutDuration: time.Minute})
+
+	for i := 0; i < 50; i++ {
+		auditAuthFailure("10.0.0.1", "u1", "10.0.0.1", map[string]string{"reason": "invalid password"})
+	}
+	auditAuthFailure("10.0.0.2", "u1", "10.0.0.2", map[string]string{"reason": "invalid password"})
+
+	events, err := store.Get().QueryAudit(models.AuditFilter{Type: models.AuditAuthFailure})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("audited %d failures, want one per address and window", len(events))
+	}
+}
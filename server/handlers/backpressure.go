@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"sec-chat/server/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// outbound is a frame queued for broadcast. Transient frames, such as
+// typing indicators, are the first to go when a client falls behind.
+type outbound struct {
+	data      []byte
+	transient bool
+	// ctx carries the publisher's span, if any, and queued the time the
+	// frame was published, for tracing the fan-out
+	ctx    context.Context
+	queued time.Time
+}
+
+// QueueStats describes the send queues of connected clients
+type QueueStats struct {
+	Clients         int                `json:"clients"`
+	Capacity        int                `json:"capacity"` // Per client
+	Queued          int                `json:"queued"`   // Frames waiting across all clients
+	Dropped         uint64             `json:"dropped"`
+	SlowDisconnects uint64             `json:"slowDisconnects"`
+	PerClient       []ClientQueueStats `json:"perClient"`
+}
+
+// ClientQueueStats describes one connection's send queue
+type ClientQueueStats struct {
+	UserID  string `json:"userId,omitempty"`
+	Addr    string `json:"addr"`
+	Queued  int    `json:"queued"`
+	Peak    int64  `json:"peak"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// enqueue hands data to the client's write pump. Transient frames are
+// dropped once the queue is half full so that room is left for messages;
+// when the queue is full the configured slow client action applies.
+// The caller must hold the hub lock or be the client's own read pump, so
+// that the queue is not closed underneath it.
+func (c *Client) enqueue(data []byte, transient bool) {
+	if c.overflowed.Load() {
+		return
+	}
+
+	if transient && len(c.send) >= cap(c.send)/2 {
+		c.drop()
+		return
+	}
+
+	select {
+	case c.send <- data:
+		if n := int64(len(c.send)); n > c.peakQueue.Load() {
+			c.peakQueue.Store(n)
+		}
+		return
+	default:
+	}
+
+	c.drop()
+	if config.Get().SlowClientAction == "drop" {
+		return
+	}
+	if c.overflowed.CompareAndSwap(false, true) {
+		c.hub.slowDisconnects.Add(1)
+		c.log.Warn("Disconnecting slow client: send queue full")
+		// Closing makes the read pump fail and unregister the client, which
+		// keeps presence and the left notification on the usual path
+		go closeConn(c.conn, websocket.CloseTryAgainLater, "Try again later")
+	}
+}
+
+// drop counts a frame the client will not receive
+func (c *Client) drop() {
+	c.dropped.Add(1)
+	c.hub.droppedFrames.Add(1)
+}
+
+// QueueStats returns send queue statistics for all connections
+func (h *Hub) QueueStats() QueueStats {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	stats := QueueStats{
+		Clients:         len(h.clients),
+		Capacity:        config.Get().SendQueueSize,
+		Dropped:         h.droppedFrames.Load(),
+		SlowDisconnects: h.slowDisconnects.Load(),
+		PerClient:       make([]ClientQueueStats, 0, len(h.clients)),
+	}
+	for client := range h.clients {
+		cs := ClientQueueStats{
+			Addr:    client.ip,
+			Queued:  len(client.send),
+			Peak:    client.peakQueue.Load(),
+			Dropped: client.dropped.Load(),
+		}
+		if client.user != nil {
+			cs.UserID = client.user.ID
+		}
+		stats.Queued += cs.Queued
+		stats.PerClient = append(stats.PerClient, cs)
+	}
+	return stats
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestConn returns both ends of a WebSocket connection
+func dialTestConn(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server = <-conns
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestEnqueueFullQueue(t *testing.T) {
+	tests := []struct {
+		action         string
+		wantDisconnect bool
+		// A disconnecting client is sent nothing more after the first drop
+		wantDropped uint64
+	}{
+		{action: "disconnect", wantDisconnect: true, wantDropped: 1},
+		{action: "drop", wantDisconnect: false, wantDropped: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			setupConfig(t, "-slow-client-action", tt.action)
+			h := setupHub(t)
+			server, client := dialTestConn(t)
+			c := &Client{conn: server, send: make(chan []byte, 2), hub: h, log: slog.Default()}
+
+			// Nothing drains the queue, as with a stalled write pump
+			for i := 0; i < 4; i++ {
+				c.enqueue([]byte(`{"type":"text"}`), false)
+			}
+			if len(c.send) != 2 {
+				t.Errorf("queued %d frames, want the queue's 2", len(c.send))
+			}
+			if got := c.dropped.Load(); got != tt.wantDropped {
+				t.Errorf("dropped %d frames, want %d", got, tt.wantDropped)
+			}
+			if c.overflowed.Load() != tt.wantDisconnect {
+				t.Errorf("overflowed = %v, want %v", c.overflowed.Load(), tt.wantDisconnect)
+			}
+			if got := h.slowDisconnects.Load() == 1; got != tt.wantDisconnect {
+				t.Errorf("slow disconnects = %d, want a disconnect: %v", h.slowDisconnects.Load(), tt.wantDisconnect)
+			}
+
+			client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, _, err := client.ReadMessage()
+			var closeErr *websocket.CloseError
+			closed := errors.As(err, &closeErr)
+			if closed != tt.wantDisconnect {
+				t.Fatalf("ReadMessage() error = %v, want a close: %v", err, tt.wantDisconnect)
+			}
+			if closed && closeErr.Code != websocket.CloseTryAgainLater {
+				t.Errorf("close code = %d, want %d (try again later)", closeErr.Code, websocket.CloseTryAgainLater)
+			}
+		})
+	}
+}
+
+func TestEnqueueTransientHalfFull(t *testing.T) {
+	setupConfig(t)
+	h := setupHub(t)
+	c := &Client{send: make(chan []byte, 4), hub: h, log: slog.Default()}
+
+	for i := 0; i < 3; i++ {
+		c.enqueue([]byte(`{"type":"typing"}`), true)
+	}
+	if len(c.send) != 2 || c.dropped.Load() != 1 {
+		t.Errorf("queued %d and dropped %d typing frames, want 2 and 1", len(c.send), c.dropped.Load())
+	}
+
+	// Messages still fit in the half kept for them
+	c.enqueue([]byte(`{"type":"text"}`), false)
+	c.enqueue([]byte(`{"type":"text"}`), false)
+	if len(c.send) != 4 || c.overflowed.Load() {
+		t.Errorf("queued %d frames, overflowed %v; want messages to use the rest", len(c.send), c.overflowed.Load())
+	}
+}
@@ -0,0 +1,512 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/ratelimit"
+	"sec-chat/server/store"
+	"sec-chat/server/webhook"
+)
+
+const (
+	// maxBotMessageLength bounds the content a bot may post
+	maxBotMessageLength = 16 << 10
+	// maxBotNameLength bounds a bot's display name
+	maxBotNameLength = 64
+)
+
+// BotMessageRequest is the body a bot or incoming webhook posts. Text is
+// shorthand for a plaintext bot message, the form CI tools usually send.
+type BotMessageRequest struct {
+	Type     string   `json:"type"`    // "bot" for plaintext or "text" for ciphertext
+	Content  string   `json:"content"` // Encrypted unless Type is "bot"
+	Text     string   `json:"text"`
+	Room     string   `json:"room"` // Defaults to the bot's room
+	ReplyTo  string   `json:"replyTo"`
+	Mentions []string `json:"mentions"`
+}
+
+// BotRequest is the body of POST /api/admin/bots
+type BotRequest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"` // Defaults to an API bot
+	Room string `json:"room"`
+}
+
+// botLimits holds a message rate limiter per bot, shared by its requests
+var botLimits = struct {
+	sync.Mutex
+	buckets map[string]*ratelimit.Bucket
+}{buckets: make(map[string]*ratelimit.Bucket)}
+
+// botAllowed takes a message token from the bot's bucket, which refills at
+// the per-connection message rate
+func botAllowed(botID string) bool {
+	cfg := config.Get()
+	botLimits.Lock()
+	b, ok := botLimits.buckets[botID]
+	if !ok {
+		b = ratelimit.NewBucket(cfg.MessageRate, cfg.MessageBurst)
+		botLimits.buckets[botID] = b
+	}
+	botLimits.Unlock()
+	b.SetRate(cfg.MessageRate, cfg.MessageBurst)
+	return b.Allow()
+}
+
+// HandleBotMessage posts a message as the bot whose API key is the bearer
+// token: POST /api/bot/messages
+func HandleBotMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if bot := authenticateBot(w, r, key, models.BotKindAPI); bot != nil {
+		postBotMessage(w, r, bot)
+	}
+}
+
+// HandleIncomingWebhook posts a message as the incoming webhook whose key
+// ends the URL: POST /api/hooks/{key}
+func HandleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/api/hooks/")
+	if key == "" || strings.Contains(key, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if bot := authenticateBot(w, r, key, models.BotKindWebhook); bot != nil {
+		postBotMessage(w, r, bot)
+	}
+}
+
+// authenticateBot returns the bot of the given kind that key belongs to, or
+// nil after writing an error response. Bad keys are throttled like passwords.
+func authenticateBot(w http.ResponseWriter, r *http.Request, key, kind string) *models.Bot {
+	ip := clientIP(r)
+	if wait, ok := authAllowed(ip, ""); !ok {
+		sendTooManyAttempts(w, wait)
+		return nil
+	}
+
+	var bot *models.Bot
+	if key != "" {
+		var err error
+		bot, err = store.Get().WithContext(r.Context()).GetBotByKey(crypto.HashPassword(key))
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error looking up bot", "err", err)
+			sendJSON(w, http.StatusInternalServerError, map[string]string{
+				"error": "Failed to authenticate",
+			})
+			return nil
+		}
+	}
+	if bot == nil || bot.Kind != kind {
+		authFailed(ip, "", remoteAddr(r))
+		auditAuthFailure(ip, "", remoteAddr(r), map[string]string{
+			"reason": "invalid bot key",
+		})
+		sendJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "Invalid key",
+		})
+		return nil
+	}
+	authSucceeded(ip, "")
+	return bot
+}
+
+// postBotMessage saves and broadcasts a message from bot the same way chat
+// messages from WebSocket clients are
+func postBotMessage(w http.ResponseWriter, r *http.Request, bot *models.Bot) {
+	var req BotMessageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxBotMessageLength)).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	if req.Content == "" {
+		req.Content = req.Text
+	}
+	if req.Type == "" {
+		req.Type = string(models.TypeBot)
+	}
+	if req.Type != string(models.TypeBot) && req.Type != string(models.TypeText) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Type must be bot (plaintext) or text (ciphertext)",
+		})
+		return
+	}
+	if req.Content == "" || len(req.Content) > maxBotMessageLength {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Content must be 1 to 16384 bytes",
+		})
+		return
+	}
+	if req.Room != "" && !strings.EqualFold(req.Room, bot.Room) {
+		sendJSON(w, http.StatusForbidden, map[string]string{
+			"error": "This key may only post to room " + bot.Room,
+		})
+		return
+	}
+	if !botAllowed(bot.ID) {
+		w.Header().Set("Retry-After", "1")
+		sendJSON(w, http.StatusTooManyRequests, map[string]string{
+			"error": "Rate limit exceeded",
+		})
+		return
+	}
+
+	msg := models.NewMessage(models.MessageType(req.Type), bot.UserID(), bot.Name, req.Content)
+	msg.ReplyTo = req.ReplyTo
+	msg.Mentions = req.Mentions
+
+	db := store.Get().WithContext(r.Context())
+	if err := db.SaveMessage(msg); err != nil {
+		logging.FromContext(r.Context()).Error("Error saving bot message", "bot", bot.ID, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save message",
+		})
+		return
+	}
+	if err := db.TouchBot(bot.ID, msg.Timestamp); err != nil {
+		logging.FromContext(r.Context()).Warn("Error recording bot use", "bot", bot.ID, "err", err)
+	}
+
+	messagesSent.With(string(msg.Type)).Inc()
+	hub.broadcastMessage(r.Context(), msg)
+	webhook.Emit(models.EventMessageCreated, msg)
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": msg,
+	})
+}
+
+// HandleAdminBots lists bots and incoming webhooks (GET) or adds one (POST).
+// The key is only returned when the bot is created.
+func HandleAdminBots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if requireAdmin(w, r) == "" {
+			return
+		}
+		bots, err := store.Get().WithContext(r.Context()).GetBots()
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error getting bots", "err", err)
+			sendJSON(w, http.StatusInternalServerError, map[string]string{
+				"error": "Failed to retrieve bots",
+			})
+			return
+		}
+		if bots == nil {
+			bots = []*models.Bot{}
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{
+			"bots": bots,
+		})
+	case http.MethodPost:
+		createBot(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createBot validates and saves a new bot, generating its key
+func createBot(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	var req BotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxBotNameLength {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Name must be 1 to 64 characters",
+		})
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = models.BotKindAPI
+	}
+	if !models.ValidBotKind(req.Kind) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Kind must be bot or webhook",
+		})
+		return
+	}
+	if req.Room != "" && !strings.EqualFold(req.Room, models.MainRoom) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Unknown room; this server hosts a single room named " + models.MainRoom,
+		})
+		return
+	}
+
+	bot := &models.Bot{
+		ID:        crypto.RandomToken(8),
+		Name:      req.Name,
+		Kind:      req.Kind,
+		Room:      models.MainRoom,
+		Key:       crypto.RandomToken(32),
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := store.Get().WithContext(r.Context()).SaveBot(bot, crypto.HashPassword(bot.Key)); err != nil {
+		logging.FromContext(r.Context()).Error("Error saving bot", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save bot",
+		})
+		return
+	}
+
+	audit(models.AuditBotChange, actor, bot.UserID(), remoteAddr(r), map[string]string{
+		"action": "bot.create",
+		"kind":   bot.Kind,
+		"name":   bot.Name,
+	})
+	resp := map[string]interface{}{
+		"bot": bot,
+	}
+	if bot.Kind == models.BotKindWebhook {
+		resp["url"] = "/api/hooks/" + bot.Key
+	}
+	sendJSON(w, http.StatusCreated, resp)
+}
+
+// HandleAdminBot removes a bot and revokes its key: DELETE /api/admin/bots/{id}
+func HandleAdminBot(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/admin/bots/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	ok, err := store.Get().WithContext(r.Context()).DeleteBot(id)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting bot", "bot", id, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete bot",
+		})
+		return
+	}
+	if !ok {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Bot not found",
+		})
+		return
+	}
+	botLimits.Lock()
+	delete(botLimits.buckets, id)
+	botLimits.Unlock()
+
+	audit(models.AuditBotChange, actor, models.BotIDPrefix+id, remoteAddr(r), map[string]string{
+		"action": "bot.delete",
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// BotCommandRequest is the body of POST /api/bot/commands
+type BotCommandRequest struct {
+	Name    string `json:"name"`
+	Usage   string `json:"usage"`
+	Summary string `json:"summary"`
+	Role    string `json:"role"` // Least role allowed to run it; defaults to member
+	URL     string `json:"url"`  // Receives signed invocations
+}
+
+// HandleBotCommands lists the commands the bot registered (GET) or
+// registers one (POST). The signing secret is only returned on registration.
+func HandleBotCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	bot := authenticateBot(w, r, key, models.BotKindAPI)
+	if bot == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		registerBotCommand(w, r, bot)
+		return
+	}
+
+	cmds, err := store.Get().WithContext(r.Context()).GetBotCommands(bot.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error getting bot commands", "bot", bot.ID, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to retrieve commands",
+		})
+		return
+	}
+	for _, cmd := range cmds {
+		cmd.Secret = ""
+	}
+	if cmds == nil {
+		cmds = []*models.BotCommand{}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"commands": cmds,
+	})
+}
+
+// registerBotCommand validates and saves a command for bot, replacing its
+// earlier registration of the same name with a new secret
+func registerBotCommand(w http.ResponseWriter, r *http.Request, bot *models.Bot) {
+	var req BotCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	req.Name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Name), "/"))
+	if !commandNamePattern.MatchString(req.Name) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Name must be 1 to 32 characters of a-z, 0-9, _ and -, starting with a letter",
+		})
+		return
+	}
+	if isBuiltinCommand(req.Name) {
+		sendJSON(w, http.StatusConflict, map[string]string{
+			"error": "/" + req.Name + " is a server command",
+		})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.RoleMember
+	}
+	if !models.ValidRole(req.Role) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Role must be member, moderator or admin",
+		})
+		return
+	}
+	if len(req.Usage) > maxTopicLength || len(req.Summary) > maxTopicLength {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Usage and summary must be at most 200 characters",
+		})
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "URL must be an absolute http or https URL",
+		})
+		return
+	}
+
+	db := store.Get().WithContext(r.Context())
+	existing, err := db.GetBotCommand(req.Name)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error getting bot command", "command", req.Name, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to register command",
+		})
+		return
+	}
+	if existing != nil && existing.BotID != bot.ID {
+		sendJSON(w, http.StatusConflict, map[string]string{
+			"error": "/" + req.Name + " is registered by another bot",
+		})
+		return
+	}
+
+	cmd := &models.BotCommand{
+		Name:      req.Name,
+		BotID:     bot.ID,
+		Usage:     strings.TrimSpace(req.Usage),
+		Summary:   strings.TrimSpace(req.Summary),
+		Role:      req.Role,
+		URL:       req.URL,
+		Secret:    crypto.RandomToken(32),
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := db.SaveBotCommand(cmd); err != nil {
+		logging.FromContext(r.Context()).Error("Error saving bot command", "command", cmd.Name, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to register command",
+		})
+		return
+	}
+
+	audit(models.AuditBotChange, bot.UserID(), "", remoteAddr(r), map[string]string{
+		"action":  "command.register",
+		"command": cmd.Name,
+		"host":    u.Host, // The path or query may carry a token
+	})
+	sendJSON(w, http.StatusCreated, map[string]interface{}{
+		"command": cmd,
+	})
+}
+
+// HandleBotCommand removes a command the bot registered:
+// DELETE /api/bot/commands/{name}
+func HandleBotCommand(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/bot/commands/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	bot := authenticateBot(w, r, key, models.BotKindAPI)
+	if bot == nil {
+		return
+	}
+
+	ok, err := store.Get().WithContext(r.Context()).DeleteBotCommand(strings.ToLower(name), bot.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting bot command", "command", name, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete command",
+		})
+		return
+	}
+	if !ok {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Command not found",
+		})
+		return
+	}
+
+	audit(models.AuditBotChange, bot.UserID(), "", remoteAddr(r), map[string]string{
+		"action":  "command.delete",
+		"command": name,
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"sec-chat/server/config"
+)
+
+// clientIP returns the IP of the client that sent r. X-Forwarded-For is only
+// honored when the direct peer is a trusted proxy, and then the rightmost
+// address not belonging to a trusted proxy is used.
+func clientIP(r *http.Request) string {
+	peer := peerIP(r)
+	nets := config.Get().TrustedProxyNets
+	if !ipTrusted(peer, nets) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !ipTrusted(hop, nets) {
+			return hop
+		}
+		peer = hop
+	}
+	return peer
+}
+
+// peerIP returns the address of the direct peer without its port
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// ipTrusted reports whether ip is inside one of nets
+func ipTrusted(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,735 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"sec-chat/server/crypto"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+	"sec-chat/server/webhook"
+)
+
+const (
+	// maxCommandLength bounds a command line typed in the chat box
+	maxCommandLength = 2000
+	// maxCommandReply bounds the text a bot command may answer with
+	maxCommandReply = 4000
+	// maxBotCalls bounds the bot commands a connection may have waiting
+	// for an answer at once
+	maxBotCalls = 3
+	// maxTopicLength bounds the room topic
+	maxTopicLength = 200
+	// Poll limits
+	maxPollOptions        = 10
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	// Export limits
+	defaultExportCount = 100
+	maxExportCount     = 1000
+)
+
+// topicSetting is the settings key holding the room topic
+const topicSetting = "topic"
+
+var (
+	// errUsage makes the reply show the command's usage
+	errUsage = errors.New("usage")
+	// commandNamePattern is what command names, built in or registered by
+	// bots, must look like
+	commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+// commandError is a failure whose message is shown to the invoking user
+type commandError string
+
+func (e commandError) Error() string { return string(e) }
+
+// CommandPayload is the payload of a command frame: the line typed in the
+// chat box, e.g. "/kick bob spamming"
+type CommandPayload struct {
+	Text string `json:"text"`
+}
+
+// CommandResult is the private reply to a command
+type CommandResult struct {
+	Text string      `json:"text"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Invocation is a command being run
+type Invocation struct {
+	Ctx    context.Context
+	Client *Client
+	// User is a copy of the caller taken when the command arrived, safe to
+	// read while moderation changes the connected user
+	User *models.User
+	Name string
+	Args []string
+	// Rest is the raw text after the command name, for free-form arguments
+	Rest string
+}
+
+// ChatCommand is a server command run from the chat box as /name
+type ChatCommand struct {
+	Name    string
+	Usage   string // Arguments, shown after the name
+	Summary string
+	Role    string // Least role allowed to run it
+	MinArgs int
+	Run     func(inv *Invocation) (*CommandResult, error)
+}
+
+// chatCommands is the command registry, filled by RegisterCommand
+var chatCommands = struct {
+	sync.RWMutex
+	byName map[string]*ChatCommand
+}{byName: make(map[string]*ChatCommand)}
+
+func init() {
+	for _, cmd := range []*ChatCommand{
+		{"help", "[command]", "List commands, or show how to use one", models.RoleMember, 0, cmdHelp},
+		{"who", "", "List who is online", models.RoleMember, 0, cmdWho},
+		{"kick", "<user> [reason]", "Disconnect a user", models.RoleModerator, 1, cmdKick},
+		{"mute", "<user> <duration> [reason]", "Stop a user posting, e.g. /mute bob 10m", models.RoleModerator, 2, cmdMute},
+		{"topic", "[text]", "Show the room topic; moderators may set it", models.RoleMember, 0, cmdTopic},
+		{"export", "[count]", "Send yourself the latest messages as JSON", models.RoleMember, 0, cmdExport},
+		{"poll", `"question" "option" "option"... | vote <id> <option> | show <id> | close <id>`,
+			"Start, vote in or close a poll", models.RoleMember, 1, cmdPoll},
+	} {
+		if err := RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterCommand adds a command to the registry
+func RegisterCommand(cmd *ChatCommand) error {
+	if !commandNamePattern.MatchString(cmd.Name) {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("command %q has no Run function", cmd.Name)
+	}
+	if cmd.Role == "" {
+		cmd.Role = models.RoleMember
+	}
+
+	chatCommands.Lock()
+	defer chatCommands.Unlock()
+	if _, ok := chatCommands.byName[cmd.Name]; ok {
+		return fmt.Errorf("command %q is already registered", cmd.Name)
+	}
+	chatCommands.byName[cmd.Name] = cmd
+	return nil
+}
+
+// lookupCommand returns the registered command with the given name, or nil
+func lookupCommand(name string) *ChatCommand {
+	chatCommands.RLock()
+	defer chatCommands.RUnlock()
+	return chatCommands.byName[name]
+}
+
+// isBuiltinCommand reports whether name is taken by a server command, which
+// bots may not override
+func isBuiltinCommand(name string) bool {
+	return lookupCommand(name) != nil
+}
+
+// parseCommandLine splits "/name args..." into the lowercased name, the
+// arguments and the raw text after the name. Arguments are separated by
+// spaces; double quotes group words, and \" is a literal quote inside them.
+func parseCommandLine(line string) (name string, args []string, rest string, err error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") || len(line) < 2 {
+		return "", nil, "", commandError("Commands start with /, e.g. /help")
+	}
+	name, rest, _ = strings.Cut(line[1:], " ")
+	name = strings.ToLower(name)
+	rest = strings.TrimSpace(rest)
+
+	var cur strings.Builder
+	inQuotes, inArg := false, false
+	for i := 0; i < len(rest); i++ {
+		ch := rest[i]
+		switch {
+		case inQuotes && ch == '\\' && i+1 < len(rest) && rest[i+1] == '"':
+			cur.WriteByte('"')
+			i++
+		case ch == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case !inQuotes && (ch == ' ' || ch == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return name, nil, "", commandError("Unterminated quote")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return name, args, rest, nil
+}
+
+// handleCommand runs a command frame and replies to this client only
+func (c *Client) handleCommand(ctx context.Context, msg WSMessage) {
+	if !c.verified || c.user == nil {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	var payload CommandPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || len(payload.Text) > maxCommandLength {
+		c.sendError("Invalid command")
+		return
+	}
+	name, args, rest, err := parseCommandLine(payload.Text)
+	if err != nil {
+		c.replyCommand(msg.ID, name, nil, err)
+		return
+	}
+	inv := &Invocation{Ctx: ctx, Client: c, User: c.userSnapshot(), Name: name, Args: args, Rest: rest}
+
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		c.runBotCommand(msg.ID, inv)
+		return
+	}
+	if models.RoleRank(inv.User.Role) < models.RoleRank(cmd.Role) {
+		c.replyCommand(msg.ID, name, nil, errModForbidden)
+		return
+	}
+	if len(args) < cmd.MinArgs {
+		c.replyCommand(msg.ID, name, nil, errUsage)
+		return
+	}
+	res, err := cmd.Run(inv)
+	c.replyCommand(msg.ID, name, res, err)
+}
+
+// replyCommand sends the outcome of a command to the invoking client
+func (c *Client) replyCommand(id, name string, res *CommandResult, err error) {
+	c.sendJSON(c.commandReply(id, name, res, err))
+}
+
+// commandReply builds the command_result frame for the outcome of a command
+func (c *Client) commandReply(id, name string, res *CommandResult, err error) map[string]interface{} {
+	reply := map[string]interface{}{
+		"type":    "command_result",
+		"id":      id,
+		"command": name,
+		"ok":      err == nil,
+	}
+	var cmdErr commandError
+	switch {
+	case err == nil:
+		if res != nil {
+			reply["text"] = res.Text
+			if res.Data != nil {
+				reply["data"] = res.Data
+			}
+		}
+	case err == errUsage:
+		reply["text"] = "Usage: " + commandUsage(name)
+	case errors.As(err, &cmdErr):
+		reply["text"] = cmdErr.Error()
+	case err == errModForbidden || err == errModInvalid || err == errModNotFound:
+		reply["text"] = moderationErrorMessage(err)
+	default:
+		c.log.Error("Command failed", "command", name, "err", err)
+		reply["text"] = "Command failed"
+	}
+	return reply
+}
+
+// commandUsage returns "/name usage" for a built-in or bot command
+func commandUsage(name string) string {
+	usage := ""
+	if cmd := lookupCommand(name); cmd != nil {
+		usage = cmd.Usage
+	} else if cmd, _ := store.Get().GetBotCommand(name); cmd != nil {
+		usage = cmd.Usage
+	}
+	return strings.TrimSpace("/" + name + " " + usage)
+}
+
+// BotCommandInvocation is the body posted to a bot when its command is run.
+// It is signed like an outgoing webhook delivery, with the event type
+// "command", and the bot may answer with {"text": "..."}.
+type BotCommandInvocation struct {
+	ID      string           `json:"id"`
+	Command string           `json:"command"`
+	Args    []string         `json:"args"`
+	Text    string           `json:"text"` // Raw text after the command name
+	User    BotCommandCaller `json:"user"`
+	Room    string           `json:"room"`
+	Time    int64            `json:"time"`
+}
+
+// BotCommandCaller identifies who ran a bot command
+type BotCommandCaller struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// runBotCommand posts the invocation to the bot that registered the command
+// and relays its answer. The call runs in the background so a slow bot does
+// not hold up the connection's other frames; the user may have gone by the
+// time it answers, so the reply is sent with sendJSONDetached. At most
+// maxBotCalls run at once per connection.
+func (c *Client) runBotCommand(id string, inv *Invocation) {
+	cmd, err := store.Get().WithContext(inv.Ctx).GetBotCommand(inv.Name)
+	if err != nil {
+		c.replyCommand(id, inv.Name, nil, err)
+		return
+	}
+	if cmd == nil {
+		c.replyCommand(id, inv.Name, nil, commandError("Unknown command /"+inv.Name+"; try /help"))
+		return
+	}
+	if models.RoleRank(inv.User.Role) < models.RoleRank(cmd.Role) {
+		c.replyCommand(id, inv.Name, nil, errModForbidden)
+		return
+	}
+
+	args := inv.Args
+	if args == nil {
+		args = []string{}
+	}
+	callID := crypto.RandomToken(16)
+	body, err := json.Marshal(BotCommandInvocation{
+		ID:      callID,
+		Command: cmd.Name,
+		Args:    args,
+		Text:    inv.Rest,
+		User:    BotCommandCaller{ID: inv.User.ID, Name: inv.User.Name, Role: inv.User.Role},
+		Room:    models.MainRoom,
+		Time:    time.Now().UnixMilli(),
+	})
+	if err != nil {
+		c.replyCommand(id, inv.Name, nil, err)
+		return
+	}
+
+	if c.botCalls.Add(1) > maxBotCalls {
+		c.botCalls.Add(-1)
+		c.replyCommand(id, inv.Name, nil, commandError("Too many bot commands are running; wait for an answer"))
+		return
+	}
+	log := c.log
+	go func() {
+		defer c.botCalls.Add(-1)
+		resp, err := webhook.Call(inv.Ctx, cmd.URL, cmd.Secret, "command", callID, body)
+		if err != nil {
+			log.Warn("Bot command failed", "command", cmd.Name, "bot", cmd.BotID, "err", err)
+			c.sendJSONDetached(c.commandReply(id, cmd.Name, nil, commandError("/"+cmd.Name+" is not responding")))
+			return
+		}
+		var answer struct {
+			Text string `json:"text"`
+		}
+		if len(resp) > 0 {
+			if err := json.Unmarshal(resp, &answer); err != nil {
+				c.sendJSONDetached(c.commandReply(id, cmd.Name, nil, commandError("/"+cmd.Name+" sent an invalid reply")))
+				return
+			}
+		}
+		if len(answer.Text) > maxCommandReply {
+			answer.Text = truncateUTF8(answer.Text, maxCommandReply) + "…"
+		}
+		c.sendJSONDetached(c.commandReply(id, cmd.Name, &CommandResult{Text: answer.Text}, nil))
+	}()
+}
+
+// resolveUser finds a user by ID or, failing that, by display name
+func resolveUser(ctx context.Context, ref string) (*models.User, error) {
+	ref = strings.TrimPrefix(ref, "@")
+	db := store.Get().WithContext(ctx)
+	if u, err := db.GetUser(ref); err != nil || u != nil {
+		return u, err
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	var found *models.User
+	for _, u := range users {
+		if strings.EqualFold(u.Name, ref) {
+			if found != nil {
+				return nil, commandError("More than one user is named " + ref + "; use their ID")
+			}
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, errModNotFound
+	}
+	return found, nil
+}
+
+// postSystemMessage saves and broadcasts a system message
+func postSystemMessage(ctx context.Context, text string) {
+	msg := models.SystemMessage(text)
+	store.Get().WithContext(ctx).SaveMessage(msg)
+	GetHub().broadcastMessage(ctx, msg)
+}
+
+// cmdHelp lists the commands the user may run, or shows one's usage
+func cmdHelp(inv *Invocation) (*CommandResult, error) {
+	if len(inv.Args) > 0 {
+		name := strings.ToLower(strings.TrimPrefix(inv.Args[0], "/"))
+		if cmd := lookupCommand(name); cmd != nil {
+			return &CommandResult{Text: commandUsage(name) + " — " + cmd.Summary}, nil
+		}
+		cmd, err := store.Get().WithContext(inv.Ctx).GetBotCommand(name)
+		if err != nil {
+			return nil, err
+		}
+		if cmd == nil {
+			return nil, commandError("Unknown command /" + name)
+		}
+		return &CommandResult{Text: commandUsage(name) + " — " + cmd.Summary}, nil
+	}
+
+	rank := models.RoleRank(inv.User.Role)
+	var lines []string
+	chatCommands.RLock()
+	for _, cmd := range chatCommands.byName {
+		if rank >= models.RoleRank(cmd.Role) {
+			lines = append(lines, strings.TrimSpace("/"+cmd.Name+" "+cmd.Usage)+" — "+cmd.Summary)
+		}
+	}
+	chatCommands.RUnlock()
+
+	botCmds, err := store.Get().WithContext(inv.Ctx).GetBotCommands("")
+	if err != nil {
+		return nil, err
+	}
+	for _, cmd := range botCmds {
+		if rank >= models.RoleRank(cmd.Role) {
+			lines = append(lines, strings.TrimSpace("/"+cmd.Name+" "+cmd.Usage)+" — "+cmd.Summary)
+		}
+	}
+	sort.Strings(lines)
+	return &CommandResult{Text: strings.Join(lines, "\n")}, nil
+}
+
+// cmdWho lists the online users
+func cmdWho(inv *Invocation) (*CommandResult, error) {
+	users := GetHub().GetOnlineUsers()
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Name) < strings.ToLower(users[j].Name)
+	})
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
+		if u.Presence != "" && u.Presence != models.PresenceOnline {
+			names[i] += " (" + u.Presence + ")"
+		}
+	}
+	return &CommandResult{
+		Text: fmt.Sprintf("%d online: %s", len(users), strings.Join(names, ", ")),
+		Data: users,
+	}, nil
+}
+
+// cmdKick disconnects a user
+func cmdKick(inv *Invocation) (*CommandResult, error) {
+	target, err := resolveUser(inv.Ctx, inv.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	entry, err := moderate(inv.User, ModerationRequest{
+		Action: models.ModKick,
+		UserID: target.ID,
+		Reason: strings.Join(inv.Args[1:], " "),
+	}, inv.Client.remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandResult{Text: "Kicked " + target.Name, Data: entry}, nil
+}
+
+// cmdMute stops a user posting for a while
+func cmdMute(inv *Invocation) (*CommandResult, error) {
+	d, err := parseMuteDuration(inv.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	target, err := resolveUser(inv.Ctx, inv.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	entry, err := moderate(inv.User, ModerationRequest{
+		Action:   models.ModMute,
+		UserID:   target.ID,
+		Reason:   strings.Join(inv.Args[2:], " "),
+		Duration: int64(d / time.Second),
+	}, inv.Client.remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandResult{Text: "Muted " + target.Name + " for " + d.String(), Data: entry}, nil
+}
+
+// parseMuteDuration accepts Go durations such as 10m or 1h30m, a number of
+// days such as 2d, or a bare number of seconds
+func parseMuteDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if n, err := strconv.Atoi(s); err == nil {
+		d = time.Duration(n) * time.Second
+	} else if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, commandError("Invalid duration " + s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else if d, err = time.ParseDuration(s); err != nil {
+		return 0, commandError("Invalid duration " + s + "; use e.g. 90s, 10m, 2h or 1d")
+	}
+	if d < time.Second {
+		return 0, commandError("Duration must be at least 1s")
+	}
+	return d, nil
+}
+
+// cmdTopic shows the room topic, or sets it for moderators
+func cmdTopic(inv *Invocation) (*CommandResult, error) {
+	db := store.Get().WithContext(inv.Ctx)
+	if inv.Rest == "" {
+		topic, err := db.GetSetting(topicSetting)
+		if err != nil {
+			return nil, err
+		}
+		if topic == "" {
+			return &CommandResult{Text: "No topic is set"}, nil
+		}
+		return &CommandResult{Text: "Topic: " + topic, Data: map[string]string{"topic": topic}}, nil
+	}
+
+	if !inv.User.CanModerate() {
+		return nil, errModForbidden
+	}
+	topic := inv.Rest
+	if len(topic) > maxTopicLength {
+		return nil, commandError("The topic may be at most 200 characters")
+	}
+	if err := db.SetSetting(topicSetting, topic); err != nil {
+		return nil, err
+	}
+
+	audit(models.AuditTopicChange, inv.User.ID, "", inv.Client.remoteAddr, map[string]string{
+		"topic": topic,
+	})
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":     "topic",
+		"topic":    topic,
+		"userId":   inv.User.ID,
+		"userName": inv.User.Name,
+	})
+	GetHub().publish(data)
+	postSystemMessage(inv.Ctx, inv.User.Name+" set the topic: "+topic)
+	return &CommandResult{Text: "Topic set"}, nil
+}
+
+// cmdExport sends the user the latest messages
+func cmdExport(inv *Invocation) (*CommandResult, error) {
+	count := defaultExportCount
+	if len(inv.Args) > 0 {
+		n, err := strconv.Atoi(inv.Args[0])
+		if err != nil || n < 1 || n > maxExportCount {
+			return nil, commandError("Count must be 1 to 1000")
+		}
+		count = n
+	}
+	msgs, err := store.Get().WithContext(inv.Ctx).GetMessages(time.Now().UnixMilli()+1, count)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandResult{
+		Text: fmt.Sprintf("Exported %d messages", len(msgs)),
+		Data: map[string]interface{}{
+			"exportedAt": time.Now().UnixMilli(),
+			"messages":   msgs,
+		},
+	}, nil
+}
+
+// cmdPoll starts a poll or votes in, shows or closes one
+func cmdPoll(inv *Invocation) (*CommandResult, error) {
+	switch strings.ToLower(inv.Args[0]) {
+	case "vote":
+		return pollVote(inv)
+	case "show":
+		p, err := pollArg(inv, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &CommandResult{Text: pollSummary(p), Data: p}, nil
+	case "close":
+		return pollClose(inv)
+	}
+	return pollStart(inv)
+}
+
+// pollStart creates a poll from a question and its options
+func pollStart(inv *Invocation) (*CommandResult, error) {
+	if inv.User.IsMuted(time.Now().UnixMilli()) {
+		return nil, commandError("You are muted")
+	}
+	question, options := strings.TrimSpace(inv.Args[0]), inv.Args[1:]
+	if len(options) < 2 || len(options) > maxPollOptions {
+		return nil, commandError(`A poll needs 2 to 10 options, e.g. /poll "Lunch?" "Pizza" "Salad"`)
+	}
+	if question == "" || len(question) > maxPollQuestionLength {
+		return nil, commandError("The question must be 1 to 300 characters")
+	}
+	for i, o := range options {
+		options[i] = strings.TrimSpace(o)
+		if options[i] == "" || len(options[i]) > maxPollOptionLength {
+			return nil, commandError("Options must be 1 to 100 characters")
+		}
+	}
+
+	p := &models.Poll{
+		Question:  question,
+		Options:   options,
+		CreatedBy: inv.User.ID,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := store.Get().WithContext(inv.Ctx).CreatePoll(p); err != nil {
+		return nil, err
+	}
+
+	choices := make([]string, len(options))
+	for i, o := range options {
+		choices[i] = fmt.Sprintf("%d) %s", i+1, o)
+	}
+	postSystemMessage(inv.Ctx, fmt.Sprintf("%s started poll #%d: %s %s — vote with /poll vote %d <number>",
+		inv.User.Name, p.ID, question, strings.Join(choices, " "), p.ID))
+	broadcastPoll(p)
+	return &CommandResult{Text: fmt.Sprintf("Started poll #%d", p.ID), Data: p}, nil
+}
+
+// pollVote records the user's vote, given as an option number
+func pollVote(inv *Invocation) (*CommandResult, error) {
+	p, err := pollArg(inv, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Args) < 3 {
+		return nil, errUsage
+	}
+	if p.Closed {
+		return nil, commandError(fmt.Sprintf("Poll #%d is closed", p.ID))
+	}
+	n, err := strconv.Atoi(inv.Args[2])
+	if err != nil || n < 1 || n > len(p.Options) {
+		return nil, commandError(fmt.Sprintf("Choose an option from 1 to %d", len(p.Options)))
+	}
+
+	db := store.Get().WithContext(inv.Ctx)
+	if err := db.VotePoll(p.ID, inv.User.ID, n-1); err != nil {
+		return nil, err
+	}
+	if p, err = db.GetPoll(p.ID); err != nil {
+		return nil, err
+	}
+	broadcastPoll(p)
+	return &CommandResult{Text: fmt.Sprintf("Voted for %s in poll #%d", p.Options[n-1], p.ID), Data: p}, nil
+}
+
+// pollClose stops a poll taking votes and announces the results. Only its
+// creator or a moderator may close it.
+func pollClose(inv *Invocation) (*CommandResult, error) {
+	p, err := pollArg(inv, 1)
+	if err != nil {
+		return nil, err
+	}
+	if p.CreatedBy != inv.User.ID && !inv.User.CanModerate() {
+		return nil, errModForbidden
+	}
+	if p.Closed {
+		return nil, commandError(fmt.Sprintf("Poll #%d is already closed", p.ID))
+	}
+	if err := store.Get().WithContext(inv.Ctx).ClosePoll(p.ID); err != nil {
+		return nil, err
+	}
+	p.Closed = true
+
+	postSystemMessage(inv.Ctx, inv.User.Name+" closed "+pollSummary(p))
+	broadcastPoll(p)
+	return &CommandResult{Text: fmt.Sprintf("Closed poll #%d", p.ID), Data: p}, nil
+}
+
+// pollArg returns the poll whose ID is argument i
+func pollArg(inv *Invocation, i int) (*models.Poll, error) {
+	if len(inv.Args) <= i {
+		return nil, errUsage
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(inv.Args[i], "#"), 10, 64)
+	if err != nil {
+		return nil, errUsage
+	}
+	p, err := store.Get().WithContext(inv.Ctx).GetPoll(id)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, commandError(fmt.Sprintf("There is no poll #%d", id))
+	}
+	return p, nil
+}
+
+// pollSummary describes a poll and its tallies
+func pollSummary(p *models.Poll) string {
+	tallies := make([]string, len(p.Options))
+	for i, o := range p.Options {
+		tallies[i] = fmt.Sprintf("%d) %s: %d", i+1, o, p.Votes[i])
+	}
+	state := ""
+	if p.Closed {
+		state = ", closed"
+	}
+	return fmt.Sprintf("poll #%d: %s %s (%d votes%s)", p.ID, p.Question, strings.Join(tallies, ", "), p.Total(), state)
+}
+
+// broadcastPoll sends a poll's current state to every client
+func broadcastPoll(p *models.Poll) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type": "poll",
+		"poll": p,
+	})
+	GetHub().publish(data)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,488 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"sec-chat/server/config"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+// setupHub starts a hub backed by a fresh store, installed as the package
+// hub so commands that announce to the room reach it
+func setupHub(t *testing.T) *Hub {
+	tmpFile, err := os.CreateTemp("", "test_*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+	st, err := store.Init(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+
+	h := &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan outbound, 256),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		probe:      make(chan chan struct{}),
+		published:  make(map[string]*models.User),
+		startedAt:  time.Now(),
+	}
+	go h.run()
+	prev := hub
+	hub = h
+
+	t.Cleanup(func() {
+		hub = prev
+		st.Close()
+		os.Remove(tmpFile.Name())
+	})
+	return h
+}
+
+// setupConfig publishes the default configuration with args applied, as
+// the server would see it started with them
+func setupConfig(t *testing.T, args ...string) *config.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, err := config.Load(fs, append([]string{"-password", "pw"}, args...))
+	if err != nil {
+		t.Fatalf("config.Load() error = %v", err)
+	}
+	return cfg
+}
+
+// settle waits until the hub has handled everything sent to it so far,
+// including queued broadcasts, which run's select may order after a probe
+func (h *Hub) settle() {
+	for {
+		done := make(chan struct{})
+		h.probe <- done
+		<-done
+		if len(h.broadcast) == 0 {
+			break
+		}
+	}
+	// A broadcast taken just before the check finishes before this probe
+	done := make(chan struct{})
+	h.probe <- done
+	<-done
+}
+
+// connectTestClient registers an authenticated client without a socket;
+// frames for it collect in its send queue
+func connectTestClient(t *testing.T, h *Hub, user *models.User) *Client {
+	if err := store.Get().SaveUser(user); err != nil {
+		t.Fatalf("SaveUser() error = %v", err)
+	}
+	c := &Client{
+		user:     user,
+		send:     make(chan []byte, 64),
+		hub:      h,
+		verified: true,
+		log:      slog.Default(),
+	}
+	h.register <- c
+	h.settle()
+	return c
+}
+
+// commandFrame is the frame a client sends for a line typed in the chat box
+func commandFrame(id, text string) WSMessage {
+	payload, _ := json.Marshal(CommandPayload{Text: text})
+	return WSMessage{Type: "command", ID: id, Payload: payload}
+}
+
+// nextResult returns the next command_result queued for c, skipping
+// broadcasts
+func nextResult(t *testing.T, c *Client) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				t.Fatal("send queue closed before a command_result arrived")
+			}
+			var frame map[string]interface{}
+			json.Unmarshal(data, &frame)
+			if frame["type"] == "command_result" {
+				return frame
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a command_result")
+		}
+	}
+}
+
+// drainResults returns how many command_result frames are queued for c
+func drainResults(c *Client) int {
+	n := 0
+	for {
+		select {
+		case data := <-c.send:
+			var frame map[string]interface{}
+			json.Unmarshal(data, &frame)
+			if frame["type"] == "command_result" {
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantName string
+		wantArgs []string
+		wantRest string
+		wantErr  bool
+	}{
+		{
+			name:     "no arguments",
+			line:     "/who",
+			wantName: "who",
+		},
+		{
+			name:     "name is lowercased",
+			line:     "  /KICK bob  ",
+			wantName: "kick",
+			wantArgs: []string{"bob"},
+			wantRest: "bob",
+		},
+		{
+			name:     "quoted arguments",
+			line:     `/poll "Lunch today?" Pizza  "Green salad"`,
+			wantName: "poll",
+			wantArgs: []string{"Lunch today?", "Pizza", "Green salad"},
+			wantRest: `"Lunch today?" Pizza  "Green salad"`,
+		},
+		{
+			name:     "escaped quote",
+			line:     `/topic "say \"hi\""`,
+			wantName: "topic",
+			wantArgs: []string{`say "hi"`},
+			wantRest: `"say \"hi\""`,
+		},
+		{
+			name:     "empty quoted argument",
+			line:     "/poll \"\"\tx",
+			wantName: "poll",
+			wantArgs: []string{"", "x"},
+			wantRest: "\"\"\tx",
+		},
+		{
+			name:    "missing slash",
+			line:    "who",
+			wantErr: true,
+		},
+		{
+			name:    "slash only",
+			line:    "/",
+			wantErr: true,
+		},
+		{
+			name:     "unterminated quote",
+			line:     `/poll "Lunch`,
+			wantName: "poll",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, args, rest, err := parseCommandLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommandLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("parseCommandLine() name = %q, want %q", name, tt.wantName)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("parseCommandLine() args = %q, want %q", args, tt.wantArgs)
+			}
+			if rest != tt.wantRest {
+				t.Errorf("parseCommandLine() rest = %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestParseMuteDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "bare seconds", input: "90", want: 90 * time.Second},
+		{name: "minutes", input: "10m", want: 10 * time.Minute},
+		{name: "compound", input: "1h30m", want: 90 * time.Minute},
+		{name: "days", input: "2d", want: 48 * time.Hour},
+		{name: "bad days", input: "xd", wantErr: true},
+		{name: "garbage", input: "soon", wantErr: true},
+		{name: "zero", input: "0", wantErr: true},
+		{name: "below a second", input: "500ms", wantErr: true},
+		{name: "negative", input: "-5m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMuteDuration(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMuteDuration(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMuteDuration(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		n     int
+		want  string
+	}{
+		{name: "short", input: "héllo", n: 10, want: "héllo"},
+		{name: "ascii", input: "hello", n: 3, want: "hel"},
+		{name: "before a multibyte rune", input: "ab你好", n: 2, want: "ab"},
+		{name: "inside a multibyte rune", input: "ab你好", n: 4, want: "ab"},
+		{name: "after a multibyte rune", input: "ab你好", n: 5, want: "ab你"},
+		{name: "zero", input: "你好", n: 0, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateUTF8(tt.input, tt.n); got != tt.want {
+				t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.input, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandRoleGate(t *testing.T) {
+	h := setupHub(t)
+	// Bob is offline, so kicking him only touches the store
+	if err := store.Get().SaveUser(&models.User{ID: "u3", Name: "Bob", Role: models.RoleMember}); err != nil {
+		t.Fatalf("SaveUser() error = %v", err)
+	}
+	member := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	mod := connectTestClient(t, h, &models.User{ID: "u2", Name: "Carol", Role: models.RoleModerator})
+
+	member.handleCommand(context.Background(), commandFrame("c1", "/kick Bob"))
+	res := nextResult(t, member)
+	if res["ok"] != false || res["text"] != "Permission denied" {
+		t.Errorf("member /kick = %v, want Permission denied", res)
+	}
+
+	mod.handleCommand(context.Background(), commandFrame("c2", "/kick Bob"))
+	if res := nextResult(t, mod); res["ok"] != true {
+		t.Errorf("moderator /kick = %v, want ok", res)
+	}
+
+	// Commands anyone may run still pass the gate
+	member.handleCommand(context.Background(), commandFrame("c3", "/who"))
+	if res := nextResult(t, member); res["ok"] != true {
+		t.Errorf("member /who = %v, want ok", res)
+	}
+}
+
+func TestCommandReplyRouting(t *testing.T) {
+	h := setupHub(t)
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"pong"}`))
+	}))
+	defer bot.Close()
+	err := store.Get().SaveBotCommand(&models.BotCommand{
+		Name: "ping", BotID: "b1", Role: models.RoleMember, URL: bot.URL, Secret: "s", CreatedAt: 1,
+	})
+	if err != nil {
+		t.Fatalf("SaveBotCommand() error = %v", err)
+	}
+	alice := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+	drainResults(alice)
+	drainResults(bob)
+
+	alice.handleCommand(context.Background(), commandFrame("c1", "/who"))
+	res := nextResult(t, alice)
+	if res["id"] != "c1" || res["command"] != "who" || res["ok"] != true {
+		t.Errorf("/who reply = %v", res)
+	}
+
+	alice.handleCommand(context.Background(), commandFrame("c2", "/ping"))
+	res = nextResult(t, alice)
+	if res["id"] != "c2" || res["text"] != "pong" {
+		t.Errorf("/ping reply = %v, want pong", res)
+	}
+
+	alice.handleCommand(context.Background(), commandFrame("c3", "/nosuchcommand"))
+	if res := nextResult(t, alice); res["ok"] != false {
+		t.Errorf("unknown command reply = %v, want an error", res)
+	}
+
+	h.settle()
+	if n := drainResults(bob); n != 0 {
+		t.Errorf("another client received %d command results, want 0", n)
+	}
+}
+
+func TestBotCommandLongReply(t *testing.T) {
+	h := setupHub(t)
+	// The cut falls inside the second byte of a three-byte character
+	long := strings.Repeat("a", maxCommandReply-1) + strings.Repeat("你", 10)
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"text": long})
+	}))
+	defer bot.Close()
+	err := store.Get().SaveBotCommand(&models.BotCommand{
+		Name: "long", BotID: "b1", Role: models.RoleMember, URL: bot.URL, Secret: "s", CreatedAt: 1,
+	})
+	if err != nil {
+		t.Fatalf("SaveBotCommand() error = %v", err)
+	}
+	c := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	c.handleCommand(context.Background(), commandFrame("c1", "/long"))
+	text, _ := nextResult(t, c)["text"].(string)
+	if want := strings.Repeat("a", maxCommandReply-1) + "…"; text != want {
+		t.Errorf("reply is %d bytes ending %q, want the ASCII prefix and an ellipsis", len(text), text[len(text)-8:])
+	}
+	if !utf8.ValidString(text) {
+		t.Error("reply is not valid UTF-8")
+	}
+}
+
+func TestBotCommandReplyAfterDisconnect(t *testing.T) {
+	h := setupHub(t)
+	called := make(chan struct{})
+	release := make(chan struct{})
+	answered := make(chan struct{})
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+		w.Write([]byte(`{"text":"too late"}`))
+		close(answered)
+	}))
+	defer bot.Close()
+
+	err := store.Get().SaveBotCommand(&models.BotCommand{
+		Name: "slow", BotID: "b1", Role: models.RoleMember, URL: bot.URL, Secret: "s", CreatedAt: 1,
+	})
+	if err != nil {
+		t.Fatalf("SaveBotCommand() error = %v", err)
+	}
+	c := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	c.handleCommand(context.Background(), commandFrame("c1", "/slow"))
+	<-called
+
+	// The user leaves while the bot is thinking, which closes the send queue
+	h.unregister <- c
+	h.settle()
+	close(release)
+	<-answered
+
+	// Sending the late reply on the closed queue would panic this goroutine
+	// and the whole process with it
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := <-c.send; ok {
+		t.Error("a reply was queued for a disconnected client")
+	}
+}
+
+func TestBotCommandConcurrencyCap(t *testing.T) {
+	h := setupHub(t)
+	calls := make(chan struct{}, maxBotCalls+1)
+	release := make(chan struct{})
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		<-release
+		w.Write([]byte(`{"text":"done"}`))
+	}))
+	defer bot.Close()
+	defer close(release)
+
+	err := store.Get().SaveBotCommand(&models.BotCommand{
+		Name: "slow", BotID: "b1", Role: models.RoleMember, URL: bot.URL, Secret: "s", CreatedAt: 1,
+	})
+	if err != nil {
+		t.Fatalf("SaveBotCommand() error = %v", err)
+	}
+	c := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	for i := 0; i < maxBotCalls; i++ {
+		c.handleCommand(context.Background(), commandFrame(fmt.Sprintf("c%d", i), "/slow"))
+		<-calls
+	}
+	c.handleCommand(context.Background(), commandFrame("over", "/slow"))
+	res := nextResult(t, c)
+	if res["id"] != "over" || res["ok"] != false {
+		t.Errorf("call over the cap = %v, want an error", res)
+	}
+	select {
+	case <-calls:
+		t.Error("the bot was called over the per-connection cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// An answered call frees its slot
+	release <- struct{}{}
+	if res := nextResult(t, c); res["text"] != "done" {
+		t.Fatalf("bot reply = %v, want done", res)
+	}
+	c.handleCommand(context.Background(), commandFrame("again", "/slow"))
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Error("the bot was not called once a slot was free")
+	}
+}
+
+func TestMuteDuringCommand(t *testing.T) {
+	h := setupHub(t)
+	c := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	// Moderation updates the connected user while the read pump runs a
+	// command; go test -race flags any unsynchronized read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.forUser("u1", func(u *models.User) { u.MutedUntil = time.Now().Add(time.Minute).UnixMilli() })
+	}()
+	c.handleCommand(context.Background(), commandFrame("c1", `/poll "Lunch?" "Pizza" "Salad"`))
+	nextResult(t, c)
+	<-done
+
+	c.handleCommand(context.Background(), commandFrame("c2", `/poll "Lunch?" "Pizza" "Salad"`))
+	if res := nextResult(t, c); res["ok"] != false || res["text"] != "You are muted" {
+		t.Errorf("poll while muted = %v, want You are muted", res)
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/ratelimit"
+)
+
+// strikeDecay forgives a client's rate limit strikes after this long
+// without a violation
+const strikeDecay = time.Minute
+
+// frameLimiter holds the per-connection flood protection state. It is only
+// used from the client's read pump, except for the typing state, which the
+// timer relaying a held typing event shares.
+type frameLimiter struct {
+	// cfg is the configuration the limits were taken from
+	cfg *config.Config
+
+	messages *ratelimit.Bucket
+	reads    *ratelimit.Bucket
+	other    *ratelimit.Bucket
+
+	typingInterval time.Duration
+	typingMu       sync.Mutex
+	lastTyping     time.Time
+	pendingTyping  *WSMessage
+	typingTimer    *time.Timer
+
+	maxStrikes int
+	strikes    int
+	lastStrike time.Time
+}
+
+// newFrameLimiter creates a limiter from the configured rates
+func newFrameLimiter(cfg *config.Config) *frameLimiter {
+	return &frameLimiter{
+		cfg:            cfg,
+		messages:       ratelimit.NewBucket(cfg.MessageRate, cfg.MessageBurst),
+		reads:          ratelimit.NewBucket(cfg.ReadRate, cfg.ReadBurst),
+		other:          ratelimit.NewBucket(cfg.FrameRate, cfg.FrameBurst),
+		typingInterval: cfg.TypingInterval,
+		maxStrikes:     cfg.RateLimitStrikes,
+	}
+}
+
+// refresh applies rates changed by a configuration reload, keeping the
+// connection's tokens and strikes
+func (l *frameLimiter) refresh() {
+	cfg := config.Get()
+	if cfg == l.cfg {
+		return
+	}
+	l.cfg = cfg
+	l.messages.SetRate(cfg.MessageRate, cfg.MessageBurst)
+	l.reads.SetRate(cfg.ReadRate, cfg.ReadBurst)
+	l.other.SetRate(cfg.FrameRate, cfg.FrameBurst)
+	l.typingInterval = cfg.TypingInterval
+	l.maxStrikes = cfg.RateLimitStrikes
+}
+
+// allowFrame reports whether the frame should be handled now. Typing events
+// inside the coalescing interval are held, see allowTyping; other frames
+// over their limit earn a warning and, after too many, a disconnect.
+func (c *Client) allowFrame(msg WSMessage) bool {
+	l := c.limiter
+	l.refresh()
+	var bucket *ratelimit.Bucket
+	switch msg.Type {
+	case "ping":
+		return true
+	case "typing":
+		return c.allowTyping(msg)
+	case "text", "image", "command":
+		bucket = l.messages
+	case "read":
+		bucket = l.reads
+	default:
+		bucket = l.other
+	}
+	if bucket.Allow() {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastStrike) > strikeDecay {
+		l.strikes = 0
+	}
+	l.strikes++
+	l.lastStrike = now
+
+	if l.strikes > l.maxStrikes {
+		c.log.Warn("Disconnecting client for flooding")
+		closeConn(c.conn, closeRateLimited, "Rate limit exceeded")
+		return false
+	}
+
+	c.sendJSON(map[string]interface{}{
+		"type":      "rate_limited",
+		"frameType": msg.Type,
+		"id":        msg.ID,
+		"message":   "You are sending too fast",
+	})
+	return false
+}
+
+// allowTyping relays at most one typing event per interval. An event inside
+// the interval is kept, replacing any kept before it, and relayed when the
+// interval ends, so the last state a client sent always reaches the room.
+func (c *Client) allowTyping(msg WSMessage) bool {
+	l := c.limiter
+	l.typingMu.Lock()
+	defer l.typingMu.Unlock()
+
+	wait := l.typingInterval - time.Since(l.lastTyping)
+	if wait <= 0 && l.typingTimer == nil {
+		l.lastTyping = time.Now()
+		return true
+	}
+	l.pendingTyping = &msg
+	if l.typingTimer == nil {
+		l.typingTimer = time.AfterFunc(wait, c.flushTyping)
+	}
+	return false
+}
+
+// flushTyping relays the typing event held during the last interval
+func (c *Client) flushTyping() {
+	l := c.limiter
+	l.typingMu.Lock()
+	msg := l.pendingTyping
+	l.pendingTyping, l.typingTimer = nil, nil
+	if msg != nil {
+		l.lastTyping = time.Now()
+	}
+	l.typingMu.Unlock()
+
+	if msg != nil {
+		c.handleTyping(*msg)
+	}
+}
+
+// stopTyping discards a held typing event when the connection ends
+func (l *frameLimiter) stopTyping() {
+	l.typingMu.Lock()
+	defer l.typingMu.Unlock()
+	if l.typingTimer != nil {
+		l.typingTimer.Stop()
+		l.typingTimer = nil
+	}
+	l.pendingTyping = nil
+}
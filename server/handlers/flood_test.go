@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"sec-chat/server/config"
+	"sec-chat/server/models"
+)
+
+// connectLimitedClient connects a test client whose frames go through the
+// flood limits of the current configuration
+func connectLimitedClient(t *testing.T, h *Hub, user *models.User) *Client {
+	c := connectTestClient(t, h, user)
+	c.limiter = newFrameLimiter(config.Get())
+	t.Cleanup(c.limiter.stopTyping)
+	return c
+}
+
+// frame encodes a client frame as the read pump receives it
+func frame(t *testing.T, msg WSMessage) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFrameLimits(t *testing.T) {
+	setupConfig(t,
+		"-message-rate", "0.001", "-message-burst", "3",
+		"-read-rate", "0.001", "-read-burst", "4",
+		"-frame-rate", "0.001", "-frame-burst", "2",
+		"-rate-limit-strikes", "100",
+	)
+	h := setupHub(t)
+	alice := connectLimitedClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	// Each kind of frame has its own bucket, so exhausting one leaves the
+	// others untouched
+	tests := []struct {
+		frameType   string
+		replyType   string
+		sent        int
+		wantHandled int
+	}{
+		{frameType: "text", replyType: "text", sent: 5, wantHandled: 3},
+		{frameType: "read", replyType: "read", sent: 6, wantHandled: 4},
+		{frameType: "presence_sync", replyType: "presence_snapshot", sent: 4, wantHandled: 2},
+		{frameType: "ping", replyType: "pong", sent: 10, wantHandled: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frameType, func(t *testing.T) {
+			for i := 0; i < tt.sent; i++ {
+				msg := WSMessage{Type: tt.frameType, ID: fmt.Sprintf("%s-%d", tt.frameType, i), Content: "hi"}
+				alice.handleMessage(frame(t, msg))
+			}
+			h.settle()
+
+			handled, limited := 0, 0
+			for len(alice.send) > 0 {
+				var reply map[string]interface{}
+				json.Unmarshal(<-alice.send, &reply)
+				switch reply["type"] {
+				case tt.replyType:
+					handled++
+				case "rate_limited":
+					limited++
+					if reply["frameType"] != tt.frameType {
+						t.Errorf("rate_limited frameType = %v, want %s", reply["frameType"], tt.frameType)
+					}
+				}
+			}
+			if handled != tt.wantHandled || limited != tt.sent-tt.wantHandled {
+				t.Errorf("handled %d and limited %d of %d frames, want %d handled", handled, limited, tt.sent, tt.wantHandled)
+			}
+		})
+	}
+}
+
+func TestTypingCoalesced(t *testing.T) {
+	setupConfig(t, "-typing-interval", "100ms")
+	h := setupHub(t)
+	alice := connectLimitedClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+
+	for i := 0; i < 5; i++ {
+		alice.handleMessage(frame(t, WSMessage{Type: "typing"}))
+	}
+	h.settle()
+	if n := countFrames(bob, "typing"); n != 1 {
+		t.Fatalf("relayed %d typing events at once, want 1", n)
+	}
+	if n := countFrames(alice, "rate_limited"); n != 0 {
+		t.Errorf("typing events earned %d rate limit warnings", n)
+	}
+
+	// The events held back are relayed as one when the interval ends
+	nextFrame(t, bob, "typing")
+	time.Sleep(150 * time.Millisecond)
+	h.settle()
+	if n := countFrames(bob, "typing"); n != 0 {
+		t.Errorf("relayed %d more typing events after the interval, want 0", n)
+	}
+
+	// After a quiet interval the next event goes out at once
+	alice.handleMessage(frame(t, WSMessage{Type: "typing"}))
+	h.settle()
+	if n := countFrames(bob, "typing"); n != 1 {
+		t.Errorf("relayed %d typing events after a quiet interval, want 1", n)
+	}
+}
+
+func TestTypingDiscardedOnDisconnect(t *testing.T) {
+	setupConfig(t, "-typing-interval", "50ms")
+	h := setupHub(t)
+	alice := connectLimitedClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+
+	alice.handleMessage(frame(t, WSMessage{Type: "typing"}))
+	alice.handleMessage(frame(t, WSMessage{Type: "typing"}))
+	alice.limiter.stopTyping()
+	time.Sleep(100 * time.Millisecond)
+	h.settle()
+	if n := countFrames(bob, "typing"); n != 1 {
+		t.Errorf("relayed %d typing events, want only the first after the connection ended", n)
+	}
+}
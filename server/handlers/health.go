@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"sec-chat/server/blobstore"
+	"sec-chat/server/config"
+	"sec-chat/server/logging"
+	"sec-chat/server/store"
+)
+
+// readyTimeout bounds all readiness checks together
+const readyTimeout = 2 * time.Second
+
+// HandleHealthz reports that the process is alive and serving HTTP
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, map[string]string{
+		"status":  "ok",
+		"version": config.Get().Version,
+	})
+}
+
+// HandleReadyz reports whether the server can take traffic: the database and
+// upload storage accept writes, the hub loop responds, and no shutdown is in
+// progress. Each check is reported as ok or fail; why one failed is only
+// logged, since the endpoint is public.
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Readiness check failed", "check", name, "err", err)
+			checks[name] = "fail"
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	check("database", store.Get().Ping(ctx))
+	check("uploads", blobstore.Get().Check())
+	check("hub", GetHub().Probe(ctx))
+
+	status := "ready"
+	code := http.StatusOK
+	if GetHub().closing.Load() {
+		status = "shutting_down"
+		code = http.StatusServiceUnavailable
+	} else if !ready {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	sendJSON(w, code, map[string]interface{}{
+		"status":  status,
+		"version": config.Get().Version,
+		"checks":  checks,
+	})
+}
+
+// Probe waits for the run loop to answer, failing if it is blocked
+func (h *Hub) Probe(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case h.probe <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sec-chat/server/store"
+)
+
+func TestReadyzHidesErrors(t *testing.T) {
+	setupConfig(t)
+	setupUploads(t)
+
+	readyz := func() (int, map[string]interface{}, string) {
+		rec := httptest.NewRecorder()
+		HandleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		checks, _ := body["checks"].(map[string]interface{})
+		return rec.Code, checks, rec.Body.String()
+	}
+
+	code, checks, _ := readyz()
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 with every check passing: %v", code, checks)
+	}
+
+	store.Get().Close()
+	code, checks, raw := readyz()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", code)
+	}
+	want := map[string]string{"database": "fail", "uploads": "ok", "hub": "ok"}
+	for name, status := range want {
+		if checks[name] != status {
+			t.Errorf("check %s = %v, want %s", name, checks[name], status)
+		}
+	}
+	if strings.Contains(raw, "closed") {
+		t.Errorf("response carries the error detail: %s", raw)
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"sync"
+
+	"sec-chat/server/config"
+	"sec-chat/server/metrics"
+)
+
+// frameTypes are the WebSocket frame types counted by name; anything else is
+// counted as "unknown" so clients cannot create new series
+var frameTypes = map[string]bool{
+	"auth": true, "text": true, "image": true, "typing": true, "recall": true,
+	"read": true, "presence": true, "moderate": true, "presence_sync": true, "ping": true,
+	"command": true,
+}
+
+var (
+	framesReceived = metrics.NewCounterVec("secchat_ws_frames_received_total",
+		"WebSocket frames received, by type.", "type")
+	messagesSent = metrics.NewCounterVec("secchat_messages_total",
+		"Chat messages saved and broadcast, by message type.", "type")
+	authFailures = metrics.NewCounter("secchat_auth_failures_total",
+		"Failed authentication attempts.")
+	uploadBytes = metrics.NewCounter("secchat_upload_bytes_total",
+		"Bytes received in uploads before processing.")
+	uploadsTotal = metrics.NewCounter("secchat_uploads_total",
+		"Uploads received.")
+)
+
+// countFrame counts an incoming WebSocket frame
+func countFrame(frameType string) {
+	framesReceived.With(frameName(frameType)).Inc()
+}
+
+// frameName maps frame types a client made up to "unknown", so that they
+// cannot grow label or span name sets without bound
+func frameName(frameType string) string {
+	if !frameTypes[frameType] {
+		return "unknown"
+	}
+	return frameType
+}
+
+// hubMetricsOnce guards registerHubMetrics, since a metric name can only be
+// registered once
+var hubMetricsOnce sync.Once
+
+// registerHubMetrics exposes the live state of the current hub, read at
+// scrape time, so that a hub created again by InitHub is picked up.
+// Send queues are summed and maxed rather than exported per connection,
+// which would churn a series on every reconnect.
+func registerHubMetrics() {
+	hubMetricsOnce.Do(func() {
+		metrics.NewGaugeFunc("secchat_connected_clients", "Open WebSocket connections.", func() float64 {
+			h := GetHub()
+			h.mutex.RLock()
+			defer h.mutex.RUnlock()
+			return float64(len(h.clients))
+		})
+		metrics.NewGaugeFunc("secchat_verified_users", "Distinct authenticated users connected.", func() float64 {
+			h := GetHub()
+			h.mutex.RLock()
+			defer h.mutex.RUnlock()
+			users := make(map[string]bool)
+			for client := range h.clients {
+				if client.verified && client.user != nil {
+					users[client.user.ID] = true
+				}
+			}
+			return float64(len(users))
+		})
+		metrics.NewGaugeFunc("secchat_broadcast_queue_depth", "Frames waiting in the hub broadcast queue.", func() float64 {
+			return float64(len(GetHub().broadcast))
+		})
+		metrics.NewGaugeFunc("secchat_broadcast_queue_capacity", "Capacity of the hub broadcast queue.", func() float64 {
+			return float64(cap(GetHub().broadcast))
+		})
+		metrics.NewGaugeFunc("secchat_send_queue_depth", "Frames waiting across all client send queues.", func() float64 {
+			h := GetHub()
+			h.mutex.RLock()
+			defer h.mutex.RUnlock()
+			total := 0
+			for client := range h.clients {
+				total += len(client.send)
+			}
+			return float64(total)
+		})
+		metrics.NewGaugeFunc("secchat_send_queue_max_depth", "Frames waiting in the fullest client send queue.", func() float64 {
+			h := GetHub()
+			h.mutex.RLock()
+			defer h.mutex.RUnlock()
+			max := 0
+			for client := range h.clients {
+				if n := len(client.send); n > max {
+					max = n
+				}
+			}
+			return float64(max)
+		})
+		metrics.NewGaugeFunc("secchat_send_queue_capacity", "Capacity of each client send queue.", func() float64 {
+			return float64(config.Get().SendQueueSize)
+		})
+		metrics.NewCounterFunc("secchat_dropped_frames_total", "Frames not delivered to slow clients.", func() float64 {
+			return float64(GetHub().droppedFrames.Load())
+		})
+		metrics.NewCounterFunc("secchat_slow_client_disconnects_total", "Clients disconnected for a full send queue.", func() float64 {
+			return float64(GetHub().slowDisconnects.Load())
+		})
+		metrics.NewCounterFunc("secchat_auth_lockouts_total", "Auth lockouts of an IP or user ID.", func() float64 {
+			return float64(AuthLockouts())
+		})
+	})
+}
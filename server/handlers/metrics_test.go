@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sec-chat/server/metrics"
+	"sec-chat/server/models"
+)
+
+func TestInitHubTwice(t *testing.T) {
+	InitAuthGuard(setupConfig(t))
+	setupHub(t)
+	prev := hub
+	t.Cleanup(func() { hub = prev })
+
+	InitHub()
+	h := InitHub()
+	connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "\nsecchat_connected_clients 1\n") {
+		t.Errorf("metrics do not count the current hub's client:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket close codes sent when the server removes a user
+const (
+	closeKicked = 4000
+	// closeStaffKey asks the user to sign in again with their staff key
+	closeStaffKey = 4001
+	closeBanned   = 4003
+)
+
+var (
+	errModForbidden = errors.New("permission denied")
+	errModInvalid   = errors.New("invalid moderation request")
+	errModNotFound  = errors.New("user not found")
+)
+
+// ModerationRequest is the payload of a moderate frame and the body of
+// POST /api/moderation
+type ModerationRequest struct {
+	Action    string `json:"action"`
+	UserID    string `json:"userId,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Duration  int64  `json:"duration,omitempty"` // Seconds for mute and ban; a ban without one is permanent
+	Role      string `json:"role,omitempty"`
+}
+
+// moderate performs a moderation action on behalf of actor and records it
+// in the moderation and audit logs
+func moderate(actor *models.User, req ModerationRequest, remoteAddr string) (*models.ModAction, error) {
+	if !actor.CanModerate() {
+		return nil, errModForbidden
+	}
+
+	now := time.Now().UnixMilli()
+	entry := &models.ModAction{
+		Action:    req.Action,
+		ActorID:   actor.ID,
+		Reason:    req.Reason,
+		CreatedAt: now,
+	}
+	hub := GetHub()
+	s := store.Get()
+
+	if req.Action == models.ModDelete {
+		if req.MessageID == "" {
+			return nil, errModInvalid
+		}
+		if err := s.DeleteMessage(req.MessageID); err != nil {
+			return nil, err
+		}
+		releaseUploadRefs(models.UploadRefMessage, req.MessageID)
+		data, _ := json.Marshal(map[string]interface{}{
+			"type":   "delete",
+			"id":     req.MessageID,
+			"userId": actor.ID,
+		})
+		hub.publish(data)
+		entry.MessageID = req.MessageID
+		return entry, logModeration(entry, remoteAddr)
+	}
+
+	if req.UserID == "" || req.UserID == actor.ID {
+		return nil, errModInvalid
+	}
+	target, err := s.GetUser(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, errModNotFound
+	}
+	// Moderators act on members; only admins act on moderators and admins
+	if models.RoleRank(actor.Role) <= models.RoleRank(target.Role) && actor.Role != models.RoleAdmin {
+		return nil, errModForbidden
+	}
+	entry.TargetID = target.ID
+
+	switch req.Action {
+	case models.ModKick:
+		hub.disconnectUser(target.ID, closeKicked, req.Reason)
+
+	case models.ModMute:
+		if req.Duration <= 0 {
+			return nil, errModInvalid
+		}
+		entry.ExpiresAt = now + req.Duration*1000
+		if err := s.SetMute(target.ID, entry.ExpiresAt); err != nil {
+			return nil, err
+		}
+		hub.forUser(target.ID, func(u *models.User) { u.MutedUntil = entry.ExpiresAt })
+		hub.sendToUser(target.ID, map[string]interface{}{
+			"type":   "muted",
+			"until":  entry.ExpiresAt,
+			"reason": req.Reason,
+		})
+
+	case models.ModUnmute:
+		if err := s.SetMute(target.ID, 0); err != nil {
+			return nil, err
+		}
+		hub.forUser(target.ID, func(u *models.User) { u.MutedUntil = 0 })
+		hub.sendToUser(target.ID, map[string]interface{}{
+			"type":  "muted",
+			"until": 0,
+		})
+
+	case models.ModBan:
+		if req.Duration > 0 {
+			entry.ExpiresAt = now + req.Duration*1000
+		}
+		err := s.BanUser(&models.Ban{
+			UserID:    target.ID,
+			ActorID:   actor.ID,
+			Reason:    req.Reason,
+			CreatedAt: now,
+			ExpiresAt: entry.ExpiresAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.DeleteUserSessions(target.ID); err != nil {
+			return nil, err
+		}
+		hub.disconnectUser(target.ID, closeBanned, req.Reason)
+
+	case models.ModUnban:
+		if err := s.UnbanUser(target.ID); err != nil {
+			return nil, err
+		}
+
+	case models.ModRole:
+		if actor.Role != models.RoleAdmin || !models.ValidRole(req.Role) {
+			return nil, errModForbidden
+		}
+		// Anyone can claim the target's ID, so staff roles only apply to
+		// connections presenting the key issued here. The admin passes it on;
+		// current connections and sessions are signed out.
+		keyHash := ""
+		if models.RoleRank(req.Role) >= models.RoleRank(models.RoleModerator) {
+			entry.StaffKey = crypto.RandomToken(32)
+			keyHash = crypto.HashPassword(entry.StaffKey)
+		}
+		if err := s.SetStaffKey(target.ID, keyHash); err != nil {
+			return nil, err
+		}
+		if err := s.SetUserRole(target.ID, req.Role); err != nil {
+			return nil, err
+		}
+		entry.Role = req.Role
+		target.Role = req.Role
+		if keyHash != "" {
+			if err := s.DeleteUserSessions(target.ID); err != nil {
+				return nil, err
+			}
+			hub.disconnectUser(target.ID, closeStaffKey, "Your role changed; sign in again with your staff key")
+		} else {
+			hub.forUser(target.ID, func(u *models.User) { u.Role = req.Role })
+		}
+		hub.BroadcastUserUpdated(target, "")
+
+	default:
+		return nil, errModInvalid
+	}
+
+	return entry, logModeration(entry, remoteAddr)
+}
+
+// logModeration records a completed action in the moderation and audit logs
+func logModeration(entry *models.ModAction, remoteAddr string) error {
+	details := map[string]string{"action": entry.Action}
+	if entry.MessageID != "" {
+		details["messageId"] = entry.MessageID
+	}
+	if entry.Reason != "" {
+		details["reason"] = entry.Reason
+	}
+	if entry.Role != "" {
+		details["role"] = entry.Role
+	}
+	if entry.ExpiresAt != 0 {
+		details["expiresAt"] = strconv.FormatInt(entry.ExpiresAt, 10)
+	}
+	audit(models.AuditModeration, entry.ActorID, entry.TargetID, remoteAddr, details)
+	return store.Get().LogModAction(entry)
+}
+
+// handleModerate runs a moderation command sent over WebSocket
+func (c *Client) handleModerate(msg WSMessage) {
+	if !c.verified || c.user == nil {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	var req ModerationRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		c.sendError(moderationErrorMessage(errModInvalid))
+		return
+	}
+
+	entry, err := moderate(c.userSnapshot(), req, c.remoteAddr)
+	if err != nil {
+		c.sendError(moderationErrorMessage(err))
+		return
+	}
+	c.sendJSON(map[string]interface{}{
+		"type":   "moderated",
+		"action": entry,
+	})
+}
+
+// HandleModeration runs a moderation command for the authenticated user
+func HandleModeration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	actor := requireRole(w, r, models.RoleModerator)
+	if actor == nil {
+		return
+	}
+
+	var req ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	entry, err := moderate(actor, req, remoteAddr(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errModForbidden:
+			status = http.StatusForbidden
+		case errModInvalid:
+			status = http.StatusBadRequest
+		case errModNotFound:
+			status = http.StatusNotFound
+		}
+		sendJSON(w, status, map[string]string{
+			"error": moderationErrorMessage(err),
+		})
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"action":  entry,
+	})
+}
+
+// HandleModerationLog returns the moderation log, newest first
+func HandleModerationLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if requireRole(w, r, models.RoleModerator) == nil {
+		return
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+	var before int64
+	if b := r.URL.Query().Get("before"); b != "" {
+		before, _ = strconv.ParseInt(b, 10, 64)
+	}
+
+	entries, err := store.Get().WithContext(r.Context()).GetModLog(before, limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error getting moderation log", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to retrieve moderation log",
+		})
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+// requireRole writes an error response and returns nil unless the request
+// carries a session of a user with at least the given role
+func requireRole(w http.ResponseWriter, r *http.Request, role string) *models.User {
+	userID := requireSession(w, r)
+	if userID == "" {
+		return nil
+	}
+	user, err := store.Get().WithContext(r.Context()).GetUser(userID)
+	if err != nil || user == nil || models.RoleRank(user.Role) < models.RoleRank(role) {
+		sendJSON(w, http.StatusForbidden, map[string]string{
+			"error": moderationErrorMessage(errModForbidden),
+		})
+		return nil
+	}
+	return user
+}
+
+// validStaffKey reports whether key is the staff key issued to the user
+func validStaffKey(db *store.Store, userID, key string) bool {
+	if key == "" {
+		return false
+	}
+	keyHash, err := db.GetStaffKey(userID)
+	if err != nil {
+		slog.Error("Error getting staff key", "user_id", userID, "err", err)
+		return false
+	}
+	return keyHash != "" && subtle.ConstantTimeCompare([]byte(keyHash), []byte(crypto.HashPassword(key))) == 1
+}
+
+// moderationErrorMessage returns the client-facing message for err, hiding
+// store errors
+func moderationErrorMessage(err error) string {
+	switch err {
+	case errModForbidden:
+		return "Permission denied"
+	case errModInvalid:
+		return "Invalid moderation request"
+	case errModNotFound:
+		return "User not found"
+	}
+	slog.Error("Moderation error", "err", err)
+	return "Moderation failed"
+}
+
+// forUser applies fn to the user of every connection belonging to userID
+func (h *Hub) forUser(userID string, fn func(u *models.User)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for client := range h.clients {
+		if client.user != nil && client.user.ID == userID {
+			fn(client.user)
+		}
+	}
+}
+
+// userSnapshot returns a copy of c's user. forUser changes the role and mute
+// of connected users under the hub lock, so read those fields from a copy.
+func (c *Client) userSnapshot() *models.User {
+	c.hub.mutex.RLock()
+	defer c.hub.mutex.RUnlock()
+	u := *c.user
+	return &u
+}
+
+// sendToUser sends v to every connection belonging to userID
+func (h *Hub) sendToUser(userID string, v interface{}) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for client := range h.clients {
+		if client.user != nil && client.user.ID == userID {
+			client.sendJSON(v)
+		}
+	}
+}
+
+// disconnectUser closes every connection belonging to userID
+func (h *Hub) disconnectUser(userID string, code int, reason string) {
+	h.mutex.RLock()
+	var conns []*websocket.Conn
+	for client := range h.clients {
+		if client.user != nil && client.user.ID == userID {
+			conns = append(conns, client.conn)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, conn := range conns {
+		closeConn(conn, code, reason)
+	}
+}
+
+// closeConn sends a close frame with the given code and reason, then closes
+// the connection. The read pump notices and unregisters the client.
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	// Control frame payloads are limited to 125 bytes, two of which hold the
+	// code. Browsers fail the connection on a reason that is not valid UTF-8.
+	reason = truncateUTF8(reason, 123)
+	deadline := time.Now().Add(time.Second)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	conn.Close()
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+func TestModerateDuringRoleChange(t *testing.T) {
+	h := setupHub(t)
+	if err := store.Get().SaveUser(&models.User{ID: "u2", Name: "Bob", Role: models.RoleMember}); err != nil {
+		t.Fatalf("SaveUser() error = %v", err)
+	}
+	mod := connectTestClient(t, h, &models.User{ID: "u1", Name: "Carol", Role: models.RoleModerator})
+
+	// Role changes rewrite the connected user while the read pump moderates;
+	// go test -race flags any unsynchronized read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			h.forUser("u1", func(u *models.User) { u.Role = models.RoleModerator })
+		}
+	}()
+	payload, _ := json.Marshal(ModerationRequest{Action: models.ModMute, UserID: "u2", Duration: 60})
+	for i := 0; i < 20; i++ {
+		mod.handleModerate(WSMessage{Type: "moderate", Payload: payload})
+	}
+	<-done
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+const (
+	// idleTimeout is how long a user can go without sending a frame before
+	// they are shown as away
+	idleTimeout = 5 * time.Minute
+	// idleCheckInterval is how often the hub looks for users going idle
+	idleCheckInterval = 30 * time.Second
+)
+
+// PresencePayload is the payload of a presence frame
+type PresencePayload struct {
+	State string `json:"state"`
+}
+
+// effectivePresence combines the state a user chose with whether any of
+// their connections has been active recently
+func effectivePresence(chosen string, active bool) string {
+	switch chosen {
+	case models.PresenceAway, models.PresenceDND, models.PresenceInvisible:
+		return chosen
+	}
+	if !active {
+		return models.PresenceAway
+	}
+	return models.PresenceOnline
+}
+
+// applyPresence sets the public online state of a stored user from its
+// entry in the hub's online list, or marks it offline when there is none
+func applyPresence(user, online *models.User) {
+	if online == nil {
+		user.Online = false
+		user.Presence = ""
+		return
+	}
+	user.Online = true
+	user.Presence = online.Presence
+}
+
+// touch records activity on the connection and announces the user as back
+// when they were idle
+func (c *Client) touch() {
+	now := time.Now().UnixMilli()
+	prev := c.lastActive.Swap(now)
+	if c.verified && now-prev >= idleTimeout.Milliseconds() {
+		c.hub.syncPresence()
+	}
+}
+
+// handlePresence sets the presence state for all of the user's connections
+func (c *Client) handlePresence(ctx context.Context, msg WSMessage) {
+	if !c.verified || c.user == nil {
+		return
+	}
+
+	var p PresencePayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil || !models.ValidPresence(p.State) {
+		c.sendError("Invalid presence state")
+		return
+	}
+
+	c.hub.mutex.Lock()
+	for client := range c.hub.clients {
+		if client.user != nil && client.user.ID == c.user.ID {
+			client.user.Presence = p.State
+		}
+	}
+	userID := c.user.ID
+	c.hub.mutex.Unlock()
+
+	if err := store.Get().WithContext(ctx).SetUserPresence(userID, p.State); err != nil {
+		c.log.Error("Error saving presence", "err", err)
+	}
+
+	c.hub.syncPresence()
+}
+
+// watchIdle periodically announces users whose effective presence changed
+// because they went idle
+func (h *Hub) watchIdle() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.syncPresence()
+	}
+}
+
+// syncPresence compares the online list with what was last announced and
+// broadcasts presence_join, presence_leave and user_updated events for the
+// differences. It must not be called from the hub's run goroutine.
+func (h *Hub) syncPresence() {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	current := make(map[string]*models.User)
+	for _, u := range h.GetOnlineUsers() {
+		current[u.ID] = u
+	}
+
+	for id, u := range current {
+		prev, ok := h.published[id]
+		if !ok {
+			h.emitPresenceLocked(map[string]interface{}{
+				"type": "presence_join",
+				"user": u,
+			})
+		} else if !sameProfile(prev, u) {
+			h.emitPresenceLocked(map[string]interface{}{
+				"type": "user_updated",
+				"user": u,
+			})
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	for id := range h.published {
+		if _, ok := current[id]; !ok {
+			h.emitPresenceLocked(map[string]interface{}{
+				"type":     "presence_leave",
+				"userId":   id,
+				"lastSeen": now,
+			})
+		}
+	}
+
+	h.published = current
+}
+
+// BroadcastUserUpdated notifies all clients that a user's profile changed
+func (h *Hub) BroadcastUserUpdated(user *models.User, previousName string) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	// Presence comes from the announced list; the stored state may be invisible
+	u := *user
+	u.Online = false
+	u.Presence = ""
+	if p, ok := h.published[user.ID]; ok {
+		p.Name = user.Name
+		p.Avatar = user.Avatar
+		p.Status = user.Status
+		p.Timezone = user.Timezone
+		u = *p
+	}
+
+	event := map[string]interface{}{
+		"type": "user_updated",
+		"user": &u,
+	}
+	if previousName != "" {
+		event["previousName"] = previousName
+	}
+	h.emitPresenceLocked(event)
+}
+
+// sendPresenceSnapshot sends the announced online list and its version, so
+// the client can apply later events on top of it
+func (c *Client) sendPresenceSnapshot() {
+	h := c.hub
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	users := make([]*models.User, 0, len(h.published))
+	for _, u := range h.published {
+		users = append(users, u)
+	}
+	c.sendJSON(map[string]interface{}{
+		"type":    "presence_snapshot",
+		"version": h.presenceVersion,
+		"users":   users,
+	})
+}
+
+// emitPresenceLocked stamps event with the next version and broadcasts it
+// (caller must hold presenceMu)
+func (h *Hub) emitPresenceLocked(event map[string]interface{}) {
+	h.presenceVersion++
+	event["version"] = h.presenceVersion
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error marshaling presence event", "err", err)
+		return
+	}
+	h.publish(data)
+}
+
+// sameProfile reports whether two announced users look the same to clients
+func sameProfile(a, b *models.User) bool {
+	return a.Presence == b.Presence &&
+		a.Name == b.Name &&
+		a.Avatar == b.Avatar &&
+		a.Status == b.Status &&
+		a.Timezone == b.Timezone
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// presenceFrame is a presence event or snapshot as a client decodes it
+type presenceFrame struct {
+	Type    string         `json:"type"`
+	Version uint64         `json:"version"`
+	User    *models.User   `json:"user"`
+	Users   []*models.User `json:"users"`
+}
+
+// presenceFrames drains c's send queue and returns the presence frames in it
+func presenceFrames(c *Client) []presenceFrame {
+	var frames []presenceFrame
+	for len(c.send) > 0 {
+		var f presenceFrame
+		json.Unmarshal(<-c.send, &f)
+		if f.Version > 0 || f.Type == "presence_snapshot" {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// connectActiveClient connects a test client that has just sent a frame, so
+// it is not shown as idle
+func connectActiveClient(t *testing.T, h *Hub, user *models.User) *Client {
+	c := connectTestClient(t, h, user)
+	c.lastActive.Store(time.Now().UnixMilli())
+	return c
+}
+
+func TestPresenceEventVersions(t *testing.T) {
+	h := setupHub(t)
+	alice := connectActiveClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectActiveClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+	h.syncPresence()
+	h.settle()
+
+	events := presenceFrames(alice)
+	if len(events) != 2 {
+		t.Fatalf("got %d presence events, want a join for each user", len(events))
+	}
+	for i, e := range events {
+		if e.Type != "presence_join" || e.Version != uint64(i+1) {
+			t.Errorf("event %d = %s v%d, want presence_join v%d", i, e.Type, e.Version, i+1)
+		}
+	}
+
+	// Nothing changed, so nothing is announced and the version stays
+	h.syncPresence()
+	h.settle()
+	if extra := presenceFrames(alice); len(extra) != 0 {
+		t.Errorf("unchanged presence produced %d events", len(extra))
+	}
+
+	payload, _ := json.Marshal(PresencePayload{State: models.PresenceAway})
+	bob.handlePresence(context.Background(), WSMessage{Type: "presence", Payload: payload})
+	h.settle()
+	events = presenceFrames(alice)
+	if len(events) != 1 || events[0].Type != "user_updated" || events[0].Version != 3 {
+		t.Fatalf("presence change = %+v, want one user_updated v3", events)
+	}
+	if events[0].User.Presence != models.PresenceAway {
+		t.Errorf("user_updated presence = %q, want away", events[0].User.Presence)
+	}
+}
+
+func TestPresenceResyncAfterGap(t *testing.T) {
+	h := setupHub(t)
+	alice := connectActiveClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectActiveClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+	h.syncPresence()
+	h.settle()
+
+	alice.sendPresenceSnapshot()
+	frames := presenceFrames(alice)
+	snapshot := frames[len(frames)-1]
+	if snapshot.Type != "presence_snapshot" || snapshot.Version != 2 || len(snapshot.Users) != 2 {
+		t.Fatalf("snapshot = %s v%d with %d users, want v2 with 2", snapshot.Type, snapshot.Version, len(snapshot.Users))
+	}
+
+	// Alice misses the events for Bob going away and Carol joining, so the
+	// next one she sees skips versions
+	payload, _ := json.Marshal(PresencePayload{State: models.PresenceAway})
+	bob.handlePresence(context.Background(), WSMessage{Type: "presence", Payload: payload})
+	connectActiveClient(t, h, &models.User{ID: "u3", Name: "Carol", Role: models.RoleMember})
+	h.syncPresence()
+	h.settle()
+	missed := presenceFrames(alice)
+	if len(missed) != 2 || missed[0].Version != 3 || missed[1].Version != 4 {
+		t.Fatalf("missed events = %+v, want v3 and v4", missed)
+	}
+
+	// A presence_sync frame returns a snapshot covering everything missed
+	alice.sendPresenceSnapshot()
+	frames = presenceFrames(alice)
+	if len(frames) != 1 || frames[0].Type != "presence_snapshot" {
+		t.Fatalf("resync = %+v, want one presence_snapshot", frames)
+	}
+	snapshot = frames[0]
+	if snapshot.Version != 4 {
+		t.Errorf("snapshot version = %d, want the last event's 4", snapshot.Version)
+	}
+	presence := make(map[string]string)
+	for _, u := range snapshot.Users {
+		presence[u.ID] = u.Presence
+	}
+	want := map[string]string{"u1": models.PresenceOnline, "u2": models.PresenceAway, "u3": models.PresenceOnline}
+	for id, p := range want {
+		if presence[id] != p {
+			t.Errorf("snapshot presence of %s = %q, want %q", id, presence[id], p)
+		}
+	}
+
+	// Events after the snapshot continue from its version
+	h.forUser("u3", func(u *models.User) { u.Status = "lunch" })
+	h.syncPresence()
+	h.settle()
+	if next := presenceFrames(alice); len(next) != 1 || next[0].Version != 5 {
+		t.Errorf("event after resync = %+v, want v5", next)
+	}
+}
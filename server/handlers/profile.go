@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+
+	// Timezone validation must work on images without system zoneinfo
+	_ "time/tzdata"
+)
+
+const (
+	maxNameLength   = 32
+	maxStatusLength = 140
+)
+
+// ProfileUpdate is the PATCH body for /api/users/{id}; omitted fields are unchanged
+type ProfileUpdate struct {
+	Name     *string `json:"name"`
+	Status   *string `json:"status"`
+	Timezone *string `json:"timezone"`
+}
+
+// HandleUser serves GET and PATCH /api/users/{id}
+func HandleUser(w http.ResponseWriter, r *http.Request) {
+	userID := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if userID == "" || strings.Contains(userID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getProfile(w, r, userID)
+	case http.MethodPatch:
+		updateProfile(w, r, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getProfile returns a user's profile with online state and name history
+func getProfile(w http.ResponseWriter, r *http.Request, userID string) {
+	db := store.Get().WithContext(r.Context())
+	log := logging.FromContext(r.Context())
+	user, err := db.GetUser(userID)
+	if err != nil {
+		log.Error("Error getting user", "user_id", userID, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user",
+		})
+		return
+	}
+	if user == nil {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+		return
+	}
+
+	var online *models.User
+	for _, u := range GetHub().GetOnlineUsers() {
+		if u.ID == user.ID {
+			online = u
+			break
+		}
+	}
+	applyPresence(user, online)
+
+	history, err := db.GetNameHistory(user.ID)
+	if err != nil {
+		log.Error("Error getting name history", "user_id", userID, "err", err)
+		history = []*models.NameChange{}
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"user":        user,
+		"nameHistory": history,
+	})
+}
+
+// updateProfile applies a profile change for the authenticated user only
+func updateProfile(w http.ResponseWriter, r *http.Request, userID string) {
+	callerID := requireSession(w, r)
+	if callerID == "" {
+		return
+	}
+	if callerID != userID {
+		sendJSON(w, http.StatusForbidden, map[string]string{
+			"error": "Cannot edit another user's profile",
+		})
+		return
+	}
+
+	var req ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	user, err := store.Get().WithContext(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+		return
+	}
+
+	oldName := user.Name
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if msg := validateText(name, 1, maxNameLength); msg != "" {
+			sendJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Invalid name: " + msg,
+			})
+			return
+		}
+		user.Name = name
+	}
+	if req.Status != nil {
+		status := strings.TrimSpace(*req.Status)
+		if msg := validateText(status, 0, maxStatusLength); msg != "" {
+			sendJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Invalid status: " + msg,
+			})
+			return
+		}
+		user.Status = status
+	}
+	if req.Timezone != nil {
+		tz := strings.TrimSpace(*req.Timezone)
+		if tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				sendJSON(w, http.StatusBadRequest, map[string]string{
+					"error": "Invalid timezone",
+				})
+				return
+			}
+		}
+		user.Timezone = tz
+	}
+
+	renamed := user.Name != oldName
+	if renamed {
+		err = store.Get().WithContext(r.Context()).RenameUser(user, oldName, time.Now().UnixMilli())
+	} else {
+		err = store.Get().WithContext(r.Context()).SaveUser(user)
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error updating profile", "user_id", userID, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update user",
+		})
+		return
+	}
+
+	hub := GetHub()
+	hub.UpdateUserProfile(user)
+	if renamed {
+		// Announcing an invisible user's rename would show they are around
+		if user.Presence != models.PresenceInvisible {
+			sysMsg := models.SystemMessage(oldName + " is now known as " + user.Name)
+			store.Get().WithContext(r.Context()).SaveMessage(sysMsg)
+			hub.broadcastMessage(r.Context(), sysMsg)
+		}
+		hub.BroadcastUserUpdated(user, oldName)
+	} else {
+		hub.BroadcastUserUpdated(user, "")
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"user": user,
+	})
+}
+
+// validateText checks length in runes and rejects control characters,
+// returning a description of the problem or ""
+func validateText(s string, min, max int) string {
+	n := utf8.RuneCountInString(s)
+	if n < min {
+		return "too short"
+	}
+	if n > max {
+		return "too long"
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return "contains control characters"
+		}
+	}
+	return ""
+}
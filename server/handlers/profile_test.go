@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+func TestRenameAnnouncement(t *testing.T) {
+	tests := []struct {
+		name         string
+		presence     string
+		wantAnnounce bool
+	}{
+		{name: "visible", presence: models.PresenceOnline, wantAnnounce: true},
+		{name: "invisible", presence: models.PresenceInvisible, wantAnnounce: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := setupHub(t)
+			if err := store.Get().SaveUser(&models.User{ID: "u1", Name: "Alice", Presence: tt.presence}); err != nil {
+				t.Fatalf("SaveUser() error = %v", err)
+			}
+			bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+
+			r := httptest.NewRequest(http.MethodPatch, "/api/users/u1", strings.NewReader(`{"name":"Alicia"}`))
+			r.Header.Set("Authorization", "Bearer "+issueSession("u1"))
+			rec := httptest.NewRecorder()
+			HandleUser(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("HandleUser() status = %d: %s", rec.Code, rec.Body.String())
+			}
+			h.settle()
+
+			if got := countFrames(bob, string(models.TypeSystem)) == 1; got != tt.wantAnnounce {
+				t.Errorf("rename announced = %v, want %v", got, tt.wantAnnounce)
+			}
+			history, _ := store.Get().GetNameHistory("u1")
+			if len(history) != 1 {
+				t.Errorf("name history has %d entries, want the rename recorded", len(history))
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
+	"sec-chat/server/store"
+)
+
+// sessionTTL is how long a REST session token issued on WebSocket auth stays
+// valid; clients get a fresh one every time they re-authenticate
+const sessionTTL = 7 * 24 * time.Hour
+
+// issueSession creates a REST session token for a WebSocket-authenticated user
+func issueSession(userID string) string {
+	token := crypto.RandomToken(32)
+	now := time.Now()
+	s := store.Get()
+	if err := s.SaveSession(crypto.HashPassword(token), userID, now.Add(sessionTTL).UnixMilli()); err != nil {
+		slog.Error("Error saving session", "user_id", userID, "err", err)
+		return ""
+	}
+	s.DeleteExpiredSessions(now.UnixMilli())
+	return token
+}
+
+// sessionUser returns the user ID for the bearer token on r, or "" if the
+// request is not authenticated
+func sessionUser(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == "" {
+		return ""
+	}
+	userID, err := store.Get().WithContext(r.Context()).GetSessionUser(crypto.HashPassword(token), time.Now().UnixMilli())
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error looking up session", "err", err)
+		return ""
+	}
+	return userID
+}
+
+// requireSession writes an error response and returns "" when r carries no
+// valid session or its user is banned
+func requireSession(w http.ResponseWriter, r *http.Request) string {
+	userID := sessionUser(r)
+	if userID == "" {
+		sendJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "Authentication required",
+		})
+		return ""
+	}
+	// Bans delete the user's sessions; this also covers bans recorded while
+	// a session was being issued
+	ban, err := store.Get().WithContext(r.Context()).GetBan(userID, time.Now().UnixMilli())
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error checking ban", "user_id", userID, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to check session",
+		})
+		return ""
+	}
+	if ban != nil {
+		sendJSON(w, http.StatusForbidden, map[string]string{
+			"error": "You are banned",
+		})
+		return ""
+	}
+	return userID
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// restartReconnectHint tells clients how long to wait before reconnecting
+// after a restart, leaving time for a replacement process to come up
+const restartReconnectHint = 2 * time.Second
+
+const (
+	// shutdownDrainTimeout is how long clients get to receive their queued
+	// frames before their connections are closed regardless
+	shutdownDrainTimeout = 5 * time.Second
+	// drainPoll is how often Shutdown checks whether clients are gone
+	drainPoll = 50 * time.Millisecond
+)
+
+// Shutdown tells clients the server is restarting and waits for them to
+// disconnect. Each write pump flushes its queue and then closes with 1012
+// (service restart); connections still open after shutdownDrainTimeout are
+// closed directly. It also waits for their departures to be recorded, so the
+// store may be closed once it returns. New connections are refused from the
+// first call on. It returns ctx.Err() if the deadline passed first.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	if !h.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	h.sendRestarting()
+
+	// Unregistering counts the departure under the lock, so no client is
+	// missed between leaving the map and being counted
+	noClients := func() bool {
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+		return len(h.clients) == 0 && h.departing.Load() == 0
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, shutdownDrainTimeout)
+	err := h.waitUntil(drainCtx, noClients)
+	cancel()
+	if err == nil {
+		return nil
+	}
+
+	h.mutex.RLock()
+	var conns []*websocket.Conn
+	for client := range h.clients {
+		conns = append(conns, client.conn)
+	}
+	h.mutex.RUnlock()
+	for _, conn := range conns {
+		closeConn(conn, websocket.CloseServiceRestart, "Server restarting")
+	}
+
+	return h.waitUntil(ctx, noClients)
+}
+
+// sendRestarting queues a server_restarting frame for every client,
+// including ones that have not authenticated yet
+func (h *Hub) sendRestarting() {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for client := range h.clients {
+		client.sendJSON(map[string]interface{}{
+			"type":        "server_restarting",
+			"reconnectIn": restartReconnectHint.Milliseconds(),
+		})
+	}
+}
+
+// waitUntil polls done until it returns true or ctx ends
+func (h *Hub) waitUntil(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
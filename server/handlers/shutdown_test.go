@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+func TestShutdownRecordsDepartures(t *testing.T) {
+	h := setupHub(t)
+	alice := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember, LastSeen: 1})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember, LastSeen: 1})
+
+	done := make(chan error, 1)
+	go func() { done <- h.Shutdown(context.Background()) }()
+	for !h.closing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Read pumps unregister their clients as the connections close
+	h.unregister <- alice
+	h.settle()
+	for h.departing.Load() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h.settle()
+	for len(bob.send) > 0 {
+		var msg models.Message
+		json.Unmarshal(<-bob.send, &msg)
+		if strings.Contains(msg.Content, "left the chat") {
+			t.Errorf("departure announced during shutdown: %q", msg.Content)
+		}
+	}
+
+	h.unregister <- bob
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown() did not return after every client left")
+	}
+
+	// Shutdown returning means the store may close, so last seen is saved
+	for _, id := range []string{"u1", "u2"} {
+		u, err := store.Get().GetUser(id)
+		if err != nil {
+			t.Fatalf("GetUser(%q) error = %v", id, err)
+		}
+		if u.LastSeen <= 1 {
+			t.Errorf("GetUser(%q).LastSeen = %d, want it updated", id, u.LastSeen)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sec-chat/server/blobstore"
+	"sec-chat/server/config"
+	"sec-chat/server/imaging"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+const (
+	uploadGCInterval = time.Hour
+	// presignExpiry bounds how long a redirected download URL stays valid
+	presignExpiry = 15 * time.Minute
+	// maxUploadSize bounds an upload request body and the content stored
+	// from it
+	maxUploadSize = 10 << 20
+	// uploadFormOverhead is room in an upload request body for the
+	// multipart boundaries and part headers around a maxUploadSize file
+	uploadFormOverhead = 64 << 10
+)
+
+// errUploadTooLarge is returned for content above maxUploadSize
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadLocks serialize saving and collecting uploads that share a hash, so
+// a collection cannot delete a blob that is being stored again. The lock
+// for a hash is picked by its first byte.
+var uploadLocks [256]sync.Mutex
+
+// lockUpload locks the uploads stored under hash and returns the unlock
+// function
+func lockUpload(hash string) func() {
+	var b [1]byte
+	hex.Decode(b[:], []byte(hash[:min(len(hash), 2)]))
+	mu := &uploadLocks[b[0]]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// uploadThumb is a preview stored next to an upload, named by appending
+// suffix to the upload name so that each stored name owns its preview
+type uploadThumb struct {
+	suffix        string
+	data          []byte
+	width, height int
+}
+
+// storeUpload saves uploaded content. Unencrypted images are stripped of
+// EXIF/GPS metadata and get a thumbnail, which needs them in memory;
+// anything else is streamed to the blob store through a temporary file.
+// Content that starts like an image but does not decode is refused with
+// imaging.ErrNotImage, since its metadata could not be stripped.
+func storeUpload(src io.Reader, ext string) (*models.Upload, error) {
+	br := bufio.NewReader(io.LimitReader(src, maxUploadSize+1))
+	head, _ := br.Peek(12)
+	if imaging.Sniff(head) == "" {
+		return spoolUpload(br, ext)
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUploadSize {
+		return nil, errUploadTooLarge
+	}
+	uploadsTotal.Inc()
+	uploadBytes.Add(float64(len(data)))
+
+	img, err := imaging.Process(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return saveUploadBytes(img.Data, img.Ext, &uploadThumb{
+		suffix: "_thumb" + img.ThumbExt,
+		data:   img.Thumb,
+		width:  img.Width,
+		height: img.Height,
+	})
+}
+
+// spoolUpload hashes content while copying it to a temporary file and then
+// stores it, so that it is never held in memory whole
+func spoolUpload(src io.Reader, ext string) (*models.Upload, error) {
+	tmp, err := os.CreateTemp("", "secchat-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxUploadSize {
+		return nil, errUploadTooLarge
+	}
+	uploadsTotal.Inc()
+	uploadBytes.Add(float64(size))
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return saveUpload(tmp, hex.EncodeToString(h.Sum(nil)), size, ext, nil)
+}
+
+// saveAvatar stores a processed avatar with its small variant as thumbnail
+func saveAvatar(full, small []byte, ext string) (*models.Upload, error) {
+	return saveUploadBytes(full, ext, &uploadThumb{
+		suffix: "_small" + sanitizeExt(ext),
+		data:   small,
+		width:  imaging.AvatarSize,
+		height: imaging.AvatarSize,
+	})
+}
+
+// saveUploadBytes stores content held in memory, see saveUpload
+func saveUploadBytes(data []byte, ext string, thumb *uploadThumb) (*models.Upload, error) {
+	sum := sha256.Sum256(data)
+	return saveUpload(bytes.NewReader(data), hex.EncodeToString(sum[:]), int64(len(data)), ext, thumb)
+}
+
+// saveUpload stores size bytes of content read from r under hash, their
+// SHA-256, so identical uploads share one blob. thumb, if not nil, is
+// stored as the upload's preview.
+func saveUpload(r io.Reader, hash string, size int64, ext string, thumb *uploadThumb) (*models.Upload, error) {
+	upload := &models.Upload{
+		Name:      hash + sanitizeExt(ext),
+		Hash:      hash,
+		Size:      size,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+
+	unlock := lockUpload(hash)
+	defer unlock()
+
+	if err := store.Get().SaveUpload(upload); err != nil {
+		return nil, err
+	}
+	if err := putBlobIfMissing(upload.Name, r, upload.Size); err != nil {
+		return nil, err
+	}
+	if thumb == nil {
+		return upload, nil
+	}
+
+	name := upload.Name + thumb.suffix
+	if err := putBlobIfMissing(name, bytes.NewReader(thumb.data), int64(len(thumb.data))); err != nil {
+		return nil, err
+	}
+	if err := store.Get().SetUploadPreview(upload.Name, thumb.width, thumb.height, name); err != nil {
+		return nil, err
+	}
+	upload.Width = thumb.width
+	upload.Height = thumb.height
+	upload.Thumb = name
+	return upload, nil
+}
+
+// putBlobIfMissing stores a blob unless one already exists under name;
+// blobs are named by their content, so an existing one is identical
+func putBlobIfMissing(name string, r io.Reader, size int64) error {
+	blobs := blobstore.Get()
+	exists, err := blobs.Exists(name)
+	if err != nil || exists {
+		return err
+	}
+	return blobs.Put(name, r, size)
+}
+
+// HandleUploads serves stored uploads, redirecting to the blob store when it
+// can serve them directly
+func HandleUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := uploadNameFromURL(r.URL.Path)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	blobs := blobstore.Get()
+	if config.Get().S3Presign {
+		url, err := blobs.URL(name, presignExpiry)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error presigning upload", "upload", name, "err", err)
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+		if url != "" {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+	}
+
+	blob, err := blobs.Get(name)
+	if err == blobstore.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error reading upload", "upload", name, "err", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// Content is immutable: the name is the hash of the bytes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, time.Time{}, seeker)
+		return
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	io.Copy(w, blob)
+}
+
+// sanitizeExt keeps short alphanumeric extensions and drops anything else
+func sanitizeExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if len(ext) < 2 || len(ext) > 8 || ext[0] != '.' {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// uploadNameFromURL extracts the stored filename from an /uploads/ URL
+func uploadNameFromURL(url string) string {
+	idx := strings.Index(url, "/uploads/")
+	if idx < 0 {
+		return ""
+	}
+	name := url[idx+len("/uploads/"):]
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return name
+}
+
+// applyImagePreview fills in dimensions and thumbnail of an image message
+// from the upload it points at
+func applyImagePreview(msg *models.Message) {
+	name := uploadNameFromURL(msg.Content)
+	if name == "" {
+		return
+	}
+	upload, err := store.Get().GetUpload(name)
+	if err != nil || upload == nil || upload.Thumb == "" {
+		return
+	}
+	msg.Width = upload.Width
+	msg.Height = upload.Height
+	msg.ThumbURL = "/uploads/" + upload.Thumb
+}
+
+// trackUploadRef records that refType/refID points at the upload behind url, if any
+func trackUploadRef(refType, refID, url string) {
+	name := uploadNameFromURL(url)
+	if name == "" {
+		return
+	}
+	if err := store.Get().AddUploadRef(name, refType, refID); err != nil {
+		slog.Error("Error adding upload ref", "upload", name, "ref_type", refType, "ref_id", refID, "err", err)
+	}
+}
+
+// releaseUploadRefs drops the references held by refType/refID and removes
+// uploads that are no longer referenced by anything
+func releaseUploadRefs(refType, refID string) {
+	names, err := store.Get().ReleaseUploadRefs(refType, refID)
+	if err != nil {
+		slog.Error("Error releasing upload refs", "ref_type", refType, "ref_id", refID, "err", err)
+		return
+	}
+	for _, name := range names {
+		collectUpload(name, 0)
+	}
+}
+
+// replaceUploadRef points refType/refID at the upload behind url, releasing
+// whatever it referenced before
+func replaceUploadRef(refType, refID, url string) {
+	names, err := store.Get().ReleaseUploadRefs(refType, refID)
+	if err != nil {
+		slog.Error("Error releasing upload refs", "ref_type", refType, "ref_id", refID, "err", err)
+		return
+	}
+	trackUploadRef(refType, refID, url)
+	for _, name := range names {
+		collectUpload(name, 0)
+	}
+}
+
+// collectUpload deletes the upload file if its reference count dropped to
+// zero. A nonzero before spares uploads saved at or after that time, which
+// the sweep uses for uploads stored again since it listed them.
+func collectUpload(name string, before int64) {
+	hash, _, _ := strings.Cut(name, ".")
+	unlock := lockUpload(hash)
+	defer unlock()
+
+	upload, err := store.Get().GetUpload(name)
+	if err != nil || upload == nil {
+		return
+	}
+	if before != 0 && upload.CreatedAt >= before {
+		return
+	}
+
+	deleted, err := store.Get().DeleteUploadIfUnreferenced(name)
+	if err != nil {
+		slog.Error("Error collecting upload", "upload", name, "err", err)
+		return
+	}
+	if !deleted {
+		return
+	}
+	blobs := blobstore.Get()
+	if err := blobs.Delete(name); err != nil {
+		slog.Error("Error removing upload", "upload", name, "err", err)
+		return
+	}
+	if upload.Thumb != "" {
+		if err := blobs.Delete(upload.Thumb); err != nil {
+			slog.Error("Error removing thumbnail", "upload", upload.Thumb, "err", err)
+		}
+	}
+	slog.Info("Collected unreferenced upload", "upload", name)
+}
+
+// StartUploadGC periodically removes uploads that were never referenced
+func StartUploadGC() {
+	go func() {
+		ticker := time.NewTicker(uploadGCInterval)
+		defer ticker.Stop()
+		for {
+			sweepOrphanUploads()
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepOrphanUploads collects unreferenced uploads older than the configured
+// retention, which leaves time for the client to send the message that
+// points to a new upload
+func sweepOrphanUploads() {
+	before := time.Now().Add(-config.Get().OrphanUploadRetention).UnixMilli()
+	uploads, err := store.Get().GetOrphanUploads(before)
+	if err != nil {
+		slog.Error("Error listing orphan uploads", "err", err)
+		return
+	}
+	for _, upload := range uploads {
+		collectUpload(upload.Name, before)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sec-chat/server/blobstore"
+	"sec-chat/server/config"
+	"sec-chat/server/imaging"
+	"sec-chat/server/store"
+)
+
+// setupUploads starts a hub and stores blobs in a temporary directory
+func setupUploads(t *testing.T) blobstore.Store {
+	setupHub(t)
+	blobs, err := blobstore.Init(&config.Config{StorageBackend: "local", UploadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("blobstore.Init() error = %v", err)
+	}
+	return blobs
+}
+
+func blobExists(t *testing.T, blobs blobstore.Store, name string) bool {
+	t.Helper()
+	ok, err := blobs.Exists(name)
+	if err != nil {
+		t.Fatalf("Exists(%q) error = %v", name, err)
+	}
+	return ok
+}
+
+func TestCollectUploadKeepsSharedHashThumbs(t *testing.T) {
+	blobs := setupUploads(t)
+	data := []byte("same bytes, two names")
+	thumb := func() *uploadThumb {
+		return &uploadThumb{suffix: "_thumb.jpg", data: []byte("thumb"), width: 1, height: 1}
+	}
+
+	a, err := saveUploadBytes(data, ".png", thumb())
+	if err != nil {
+		t.Fatalf("saveUploadBytes() error = %v", err)
+	}
+	b, err := saveUploadBytes(data, ".gif", thumb())
+	if err != nil {
+		t.Fatalf("saveUploadBytes() error = %v", err)
+	}
+	if a.Thumb == b.Thumb {
+		t.Fatalf("uploads %s and %s share thumbnail %s", a.Name, b.Name, a.Thumb)
+	}
+
+	collectUpload(a.Name, 0)
+	if blobExists(t, blobs, a.Name) || blobExists(t, blobs, a.Thumb) {
+		t.Errorf("collected upload %s left its blobs behind", a.Name)
+	}
+	if !blobExists(t, blobs, b.Name) || !blobExists(t, blobs, b.Thumb) {
+		t.Errorf("collecting %s removed blobs of %s", a.Name, b.Name)
+	}
+}
+
+func TestCollectUploadSparesResaved(t *testing.T) {
+	blobs := setupUploads(t)
+	listed := time.Now().UnixMilli()
+
+	// Stored again after the sweep listed it as an orphan
+	time.Sleep(2 * time.Millisecond)
+	upload, err := saveUploadBytes([]byte("content"), ".txt", nil)
+	if err != nil {
+		t.Fatalf("saveUploadBytes() error = %v", err)
+	}
+
+	collectUpload(upload.Name, listed)
+	if !blobExists(t, blobs, upload.Name) {
+		t.Error("sweep deleted an upload saved after it was listed")
+	}
+	if u, _ := store.Get().GetUpload(upload.Name); u == nil {
+		t.Error("sweep deleted the record of an upload saved after it was listed")
+	}
+}
+
+func TestCollectUploadWaitsForSave(t *testing.T) {
+	blobs := setupUploads(t)
+	upload, err := saveUploadBytes([]byte("contended"), ".txt", nil)
+	if err != nil {
+		t.Fatalf("saveUploadBytes() error = %v", err)
+	}
+
+	// Hold the lock as a save of the same content would
+	unlock := lockUpload(upload.Hash)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		collectUpload(upload.Name, 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if !blobExists(t, blobs, upload.Name) {
+		t.Error("collectUpload deleted a blob while a save held its lock")
+	}
+	unlock()
+	<-done
+
+	if blobExists(t, blobs, upload.Name) {
+		t.Error("collectUpload did not delete the orphan once the save finished")
+	}
+}
+
+func TestStoreUploadRejectsBrokenImage(t *testing.T) {
+	setupUploads(t)
+	// A JPEG header followed by an EXIF segment and nothing decodable
+	data := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10}, []byte("Exif\x00\x00GPS 52.5N 13.4E")...)
+
+	upload, err := storeUpload(bytes.NewReader(data), ".jpg")
+	if err != imaging.ErrNotImage {
+		t.Fatalf("storeUpload() = %+v, %v, want ErrNotImage", upload, err)
+	}
+}
+
+func TestHandleUploadSizeLimit(t *testing.T) {
+	setupUploads(t)
+	setupConfig(t)
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{name: "at the limit", size: maxUploadSize, want: http.StatusOK},
+		{name: "over the limit", size: maxUploadSize + 1, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			part, _ := mw.CreateFormFile("file", "data.bin")
+			part.Write(make([]byte, tt.size))
+			mw.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			rec := httptest.NewRecorder()
+			HandleUpload(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("HandleUpload() status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+	"sec-chat/server/webhook"
+)
+
+// minWebhookSecretLength is the shortest signing secret an admin may choose
+const minWebhookSecretLength = 16
+
+// WebhookRequest is the body of POST /api/admin/webhooks
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // Empty subscribes to every event
+	Room   string   `json:"room"`   // Empty subscribes to every room
+	Secret string   `json:"secret"` // Generated when empty
+}
+
+// HandleAdminWebhooks lists webhook subscriptions (GET) or adds one (POST).
+// The secret is only returned when the subscription is created.
+func HandleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if requireAdmin(w, r) == "" {
+			return
+		}
+		hooks, err := store.Get().WithContext(r.Context()).GetWebhooks()
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error getting webhooks", "err", err)
+			sendJSON(w, http.StatusInternalServerError, map[string]string{
+				"error": "Failed to retrieve webhooks",
+			})
+			return
+		}
+		for _, h := range hooks {
+			h.Secret = ""
+		}
+		if hooks == nil {
+			hooks = []*models.Webhook{}
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{
+			"webhooks": hooks,
+		})
+	case http.MethodPost:
+		createWebhook(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createWebhook validates and saves a new subscription
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "URL must be an absolute http or https URL",
+		})
+		return
+	}
+	for _, e := range req.Events {
+		if !models.ValidWebhookEvent(e) {
+			sendJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Unknown event type " + e + "; expected one of " + strings.Join(models.WebhookEvents, ", "),
+			})
+			return
+		}
+	}
+	if req.Room != "" && !strings.EqualFold(req.Room, models.MainRoom) {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Unknown room; this server hosts a single room named " + models.MainRoom,
+		})
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = crypto.RandomToken(32)
+	} else if len(req.Secret) < minWebhookSecretLength {
+		sendJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Secret must be at least 16 characters",
+		})
+		return
+	}
+
+	hook := &models.Webhook{
+		ID:        crypto.RandomToken(8),
+		URL:       req.URL,
+		Secret:    req.Secret,
+		Events:    req.Events,
+		Room:      strings.ToLower(req.Room),
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := store.Get().WithContext(r.Context()).SaveWebhook(hook); err != nil {
+		logging.FromContext(r.Context()).Error("Error saving webhook", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save webhook",
+		})
+		return
+	}
+	refreshWebhooks(r)
+
+	audit(models.AuditWebhookChange, actor, hook.ID, remoteAddr(r), map[string]string{
+		"action": "webhook.create",
+		"host":   u.Host, // The path or query may carry a token
+	})
+	sendJSON(w, http.StatusCreated, map[string]interface{}{
+		"webhook": hook,
+	})
+}
+
+// HandleAdminWebhook removes a subscription: DELETE /api/admin/webhooks/{id}
+func HandleAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/admin/webhooks/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	ok, err := store.Get().WithContext(r.Context()).DeleteWebhook(id)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting webhook", "webhook", id, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete webhook",
+		})
+		return
+	}
+	if !ok {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Webhook not found",
+		})
+		return
+	}
+	refreshWebhooks(r)
+
+	audit(models.AuditWebhookChange, actor, id, remoteAddr(r), map[string]string{
+		"action": "webhook.delete",
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// refreshWebhooks makes the dispatcher pick up changed subscriptions
+func refreshWebhooks(r *http.Request) {
+	if d := webhook.Get(); d != nil {
+		if err := d.Refresh(); err != nil {
+			logging.FromContext(r.Context()).Error("Error reloading webhooks", "err", err)
+		}
+	}
+}
+
+// HandleAdminDeadLetters lists webhook deliveries that failed every attempt,
+// newest first: GET /api/admin/dead-letters?limit=
+func HandleAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == "" {
+		return
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+	letters, err := store.Get().WithContext(r.Context()).GetDeadLetters(limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error getting dead letters", "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to retrieve dead letters",
+		})
+		return
+	}
+	if letters == nil {
+		letters = []*models.DeadLetter{}
+	}
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"deadLetters": letters,
+	})
+}
+
+// HandleAdminDeadLetter discards a dead letter (DELETE
+// /api/admin/dead-letters/{id}) or queues it for delivery again (POST
+// /api/admin/dead-letters/{id}/redeliver)
+func HandleAdminDeadLetter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/admin/dead-letters/")
+	idStr, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || (action != "" && action != "redeliver") {
+		http.NotFound(w, r)
+		return
+	}
+	if (action == "" && r.Method != http.MethodDelete) || (action == "redeliver" && r.Method != http.MethodPost) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := requireAdmin(w, r)
+	if actor == "" {
+		return
+	}
+
+	db := store.Get().WithContext(r.Context())
+	dl, err := db.GetDeadLetter(id)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error getting dead letter", "id", id, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to retrieve dead letter",
+		})
+		return
+	}
+	if dl == nil {
+		sendJSON(w, http.StatusNotFound, map[string]string{
+			"error": "Dead letter not found",
+		})
+		return
+	}
+
+	auditAction := "dead_letter.delete"
+	if action == "redeliver" {
+		auditAction = "dead_letter.redeliver"
+		d := webhook.Get()
+		if d == nil {
+			sendJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"error": "Webhooks are not running",
+			})
+			return
+		}
+		if err := d.Redeliver(dl); err == webhook.ErrUnknownWebhook {
+			sendJSON(w, http.StatusConflict, map[string]string{
+				"error": "The webhook has been deleted",
+			})
+			return
+		} else if err != nil {
+			sendJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"error": "Failed to queue delivery: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	// A redelivery that fails again is saved as a new dead letter
+	if _, err := db.DeleteDeadLetter(id); err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting dead letter", "id", id, "err", err)
+		sendJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete dead letter",
+		})
+		return
+	}
+
+	audit(models.AuditWebhookChange, actor, dl.WebhookID, remoteAddr(r), map[string]string{
+		"action": auditAction,
+		"event":  dl.EventID,
+	})
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
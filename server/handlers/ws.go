@@ -1,14 +1,22 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"sec-chat/server/config"
+	"sec-chat/server/crypto"
+	"sec-chat/server/logging"
 	"sec-chat/server/models"
 	"sec-chat/server/store"
+	"sec-chat/server/tracing"
+	"sec-chat/server/webhook"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,15 +28,56 @@ type Client struct {
 	send     chan []byte
 	hub      *Hub
 	verified bool
+	// ip is the client address used for auth rate limiting, and remoteAddr
+	// its description recorded in the audit log
+	ip         string
+	remoteAddr string
+	limiter    *frameLimiter
+	// botCalls counts bot commands waiting for an answer, see runBotCommand
+	botCalls atomic.Int32
+	// requestID is the ID of the upgrade request, attached to frame spans
+	// and used to name the connection in the admin API
+	requestID   string
+	connectedAt time.Time
+	// log carries the connection's request ID and remote address, and the
+	// user ID once authenticated. It is replaced under the hub lock.
+	log *slog.Logger
+	// lastActive is the Unix millisecond time of the last frame other than
+	// a heartbeat, used for idle detection
+	lastActive atomic.Int64
+	// Send queue accounting, see enqueue
+	overflowed atomic.Bool
+	dropped    atomic.Uint64
+	peakQueue  atomic.Int64
 }
 
 // Hub manages all WebSocket clients
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan outbound
 	register   chan *Client
 	unregister chan *Client
 	mutex      sync.RWMutex
+	// probe is answered by the run loop to show it is not stuck
+	probe chan chan struct{}
+
+	// presenceMu orders presence events; published is the online list as
+	// last announced to clients and presenceVersion counts the events
+	presenceMu      sync.Mutex
+	published       map[string]*models.User
+	presenceVersion uint64
+
+	// Totals across all clients for slow consumer handling
+	droppedFrames   atomic.Uint64
+	slowDisconnects atomic.Uint64
+
+	// closing is set once Shutdown starts; new connections are refused
+	closing atomic.Bool
+	// departing counts userDisconnected calls still running, which Shutdown
+	// waits for so that last seen times are saved before the store closes
+	departing atomic.Int32
+	// startedAt is when the hub was created, reported as the server uptime
+	startedAt time.Time
 }
 
 var hub *Hub
@@ -37,11 +86,16 @@ var hub *Hub
 func InitHub() *Hub {
 	hub = &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte, 256),
+		broadcast:  make(chan outbound, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		probe:      make(chan chan struct{}),
+		published:  make(map[string]*models.User),
+		startedAt:  time.Now(),
 	}
+	registerHubMetrics()
 	go hub.run()
+	go hub.watchIdle()
 	return hub
 }
 
@@ -58,65 +112,120 @@ func (h *Hub) run() {
 			h.mutex.Lock()
 			h.clients[client] = true
 			h.mutex.Unlock()
+			// A connection that raced with Shutdown is closed like the rest
+			if h.closing.Load() {
+				go closeConn(client.conn, websocket.CloseServiceRestart, "Server restarting")
+			}
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
-			if _, ok := h.clients[client]; ok {
+			_, ok := h.clients[client]
+			var user *models.User
+			isOnline := false
+			if ok {
 				delete(h.clients, client)
 				close(client.send)
 
 				if client.user != nil {
+					user = client.user
+					h.departing.Add(1)
 					// Check if user still has other connections
-					isOnline := false
 					for c := range h.clients {
-						if c.user != nil && c.user.ID == client.user.ID {
+						if c.user != nil && c.user.ID == user.ID {
 							isOnline = true
 							break
 						}
 					}
-
-					// Only notify "left" if no other connections remain
-					if !isOnline {
-						msg := models.SystemMessage(client.user.Name + " left the chat")
-						h.broadcastMessage(msg)
-					}
-
-					// Always broadcast updated users list
-					usersMsg := map[string]interface{}{
-						"type":  "users",
-						"users": h.getOnlineUsersUnlocked(),
-					}
-					data, _ := json.Marshal(usersMsg)
-					h.broadcast <- data
 				}
 			}
 			h.mutex.Unlock()
 
-		case message := <-h.broadcast:
-			h.mutex.RLock()
-			for client := range h.clients {
-				if client.verified {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(h.clients, client)
-					}
-				}
+			// Broadcasts block on the channel this goroutine drains, so the
+			// notifications are sent from another one
+			if user != nil {
+				go func() {
+					defer h.departing.Add(-1)
+					h.userDisconnected(user, isOnline)
+				}()
 			}
-			h.mutex.RUnlock()
+
+		case done := <-h.probe:
+			close(done)
+
+		case frame := <-h.broadcast:
+			h.fanOut(frame)
 		}
 	}
 }
 
+// fanOut queues a broadcast frame for every authenticated client, tracing
+// it as a child of the span that published it, if any
+func (h *Hub) fanOut(frame outbound) {
+	ctx := frame.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := tracing.Start(ctx, "hub.broadcast",
+		tracing.Bool("transient", frame.transient),
+		tracing.Int("queue_wait_us", int(time.Since(frame.queued).Microseconds())),
+	)
+	defer span.End()
+
+	clients := 0
+	h.mutex.RLock()
+	for client := range h.clients {
+		if client.verified {
+			client.enqueue(frame.data, frame.transient)
+			clients++
+		}
+	}
+	h.mutex.RUnlock()
+	span.SetAttributes(tracing.Int("clients", clients))
+}
+
+// userDisconnected records the last seen time and announces the departure
+// once a user's last connection is gone, and updates presence
+func (h *Hub) userDisconnected(user *models.User, stillOnline bool) {
+	if !stillOnline {
+		if err := store.Get().UpdateLastSeen(user.ID, time.Now().UnixMilli()); err != nil {
+			slog.Error("Error saving last seen", "user_id", user.ID, "err", err)
+		}
+		// On shutdown everyone leaves at once and is told to reconnect
+		if user.Presence != models.PresenceInvisible && !h.closing.Load() {
+			h.broadcastMessage(context.Background(), models.SystemMessage(user.Name+" left the chat"))
+			webhook.Emit(models.EventUserLeft, map[string]interface{}{
+				"userId":   user.ID,
+				"userName": user.Name,
+			})
+		}
+	}
+	h.syncPresence()
+}
+
+// publish queues data for delivery to every authenticated client
+func (h *Hub) publish(data []byte) {
+	h.publishContext(context.Background(), data)
+}
+
+// publishContext is publish with the fan-out traced under ctx
+func (h *Hub) publishContext(ctx context.Context, data []byte) {
+	h.broadcast <- outbound{data: data, ctx: ctx, queued: time.Now()}
+}
+
+// publishTransient queues data that slow clients may miss, such as typing
+// indicators
+func (h *Hub) publishTransient(data []byte) {
+	h.broadcast <- outbound{data: data, transient: true, queued: time.Now()}
+}
+
 // broadcastMessage sends a message to all clients
-func (h *Hub) broadcastMessage(msg *models.Message) {
+func (h *Hub) broadcastMessage(ctx context.Context, msg *models.Message) {
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
+		slog.Error("Error marshaling message", "err", err)
 		return
 	}
-	h.broadcast <- data
+	h.publishContext(ctx, data)
 }
 
 // GetOnlineUsers returns list of online users
@@ -126,67 +235,57 @@ func (h *Hub) GetOnlineUsers() []*models.User {
 	return h.getOnlineUsersUnlocked()
 }
 
-// getOnlineUsersUnlocked returns list of online users without locking (caller must hold lock)
+// getOnlineUsersUnlocked returns list of online users without locking (caller must hold lock).
+// The users are copies carrying their effective presence; invisible users are left out.
 func (h *Hub) getOnlineUsersUnlocked() []*models.User {
+	idleSince := time.Now().Add(-idleTimeout).UnixMilli()
 	userMap := make(map[string]*models.User)
+	active := make(map[string]bool)
 	for client := range h.clients {
 		if client.verified && client.user != nil {
-			client.user.Online = true
 			userMap[client.user.ID] = client.user
+			if client.lastActive.Load() > idleSince {
+				active[client.user.ID] = true
+			}
 		}
 	}
 
 	users := make([]*models.User, 0, len(userMap))
-	for _, user := range userMap {
-		users = append(users, user)
+	for id, user := range userMap {
+		presence := effectivePresence(user.Presence, active[id])
+		if presence == models.PresenceInvisible {
+			continue
+		}
+		u := *user
+		u.Online = true
+		u.Presence = presence
+		users = append(users, &u)
 	}
 	return users
 }
 
-// BroadcastUsers broadcasts the current list of online users to all clients
-func (h *Hub) BroadcastUsers() {
-	h.mutex.RLock()
-	onlineUsers := h.getOnlineUsersUnlocked()
-	h.mutex.RUnlock()
+// UpdateUserAvatar updates the avatar for a connected user
+func (h *Hub) UpdateUserAvatar(userID, avatar string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	// Fetch latest avatar info from database
-	dbUsers, err := store.Get().GetUsers()
-	if err == nil {
-		dbAvatarMap := make(map[string]string)
-		for _, u := range dbUsers {
-			if u.Avatar != "" {
-				dbAvatarMap[u.ID] = u.Avatar
-			}
-		}
-		// Update online users with latest avatars from DB
-		for _, u := range onlineUsers {
-			if dbAvatar, ok := dbAvatarMap[u.ID]; ok && dbAvatar != "" {
-				u.Avatar = dbAvatar
-			}
+	for client := range h.clients {
+		if client.user != nil && client.user.ID == userID {
+			client.user.Avatar = avatar
 		}
 	}
-
-	usersMsg := map[string]interface{}{
-		"type":  "users",
-		"users": onlineUsers,
-	}
-	data, _ := json.Marshal(usersMsg)
-
-	// Non-blocking send to broadcast channel
-	select {
-	case h.broadcast <- data:
-	default:
-	}
 }
 
-// UpdateUserAvatar updates the avatar for a connected user
-func (h *Hub) UpdateUserAvatar(userID, avatar string) {
+// UpdateUserProfile copies profile fields onto every connection of the user
+func (h *Hub) UpdateUserProfile(user *models.User) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
 	for client := range h.clients {
-		if client.user != nil && client.user.ID == userID {
-			client.user.Avatar = avatar
+		if client.user != nil && client.user.ID == user.ID {
+			client.user.Name = user.Name
+			client.user.Status = user.Status
+			client.user.Timezone = user.Timezone
 		}
 	}
 }
@@ -202,6 +301,8 @@ type WSMessage struct {
 	Timestamp int64           `json:"timestamp,omitempty"`
 	ReplyTo   string          `json:"replyTo,omitempty"`
 	Mentions  []string        `json:"mentions,omitempty"`
+	Width     int             `json:"width,omitempty"`
+	Height    int             `json:"height,omitempty"`
 }
 
 // AuthPayload for authentication
@@ -209,18 +310,34 @@ type AuthPayload struct {
 	PasswordHash string `json:"passwordHash"`
 	UserID       string `json:"userId"`
 	UserName     string `json:"userName"`
-	Avatar       string `json:"avatar,omitempty"`
+	// StaffKey is the key issued to a moderator or admin when they were
+	// promoted, or the admin secret. Anyone with the room password can
+	// claim any user ID, so staff accounts cannot authenticate without it.
+	StaffKey string `json:"staffKey,omitempty"`
 }
 
-// HandleWebSocket handles WebSocket connections
-func HandleWebSocket(conn *websocket.Conn) {
-	client := &Client{
-		conn:     conn,
-		send:     make(chan []byte, 256),
-		hub:      hub,
-		verified: false,
+// HandleWebSocket handles WebSocket connections upgraded from r
+func HandleWebSocket(conn *websocket.Conn, r *http.Request) {
+	if hub.closing.Load() {
+		closeConn(conn, websocket.CloseServiceRestart, "Server restarting")
+		return
 	}
 
+	client := &Client{
+		conn:        conn,
+		send:        make(chan []byte, config.Get().SendQueueSize),
+		hub:         hub,
+		verified:    false,
+		ip:          clientIP(r),
+		remoteAddr:  remoteAddr(r),
+		limiter:     newFrameLimiter(config.Get()),
+		requestID:   logging.RequestID(r.Context()),
+		connectedAt: time.Now(),
+	}
+	client.log = logging.FromContext(r.Context()).With("remote", client.remoteAddr)
+	client.lastActive.Store(time.Now().UnixMilli())
+	client.log.Info("WebSocket connected")
+
 	hub.register <- client
 
 	go client.writePump()
@@ -229,9 +346,12 @@ func HandleWebSocket(conn *websocket.Conn) {
 
 // readPump reads messages from the WebSocket
 func (c *Client) readPump() {
+	connected := time.Now()
 	defer func() {
+		c.limiter.stopTyping()
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.log.Info("WebSocket disconnected", "duration", time.Since(connected).Round(time.Millisecond).String())
 	}()
 
 	c.conn.SetReadLimit(10 * 1024 * 1024) // 10MB max message size
@@ -245,7 +365,7 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.log.Warn("WebSocket error", "err", err)
 			}
 			break
 		}
@@ -281,6 +401,14 @@ func (c *Client) writePump() {
 				return
 			}
 
+			// During shutdown the connection is closed once the queue,
+			// which ends with server_restarting, has been flushed
+			if len(c.send) == 0 && c.hub.closing.Load() {
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server restarting"))
+				return
+			}
+
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -294,21 +422,51 @@ func (c *Client) writePump() {
 func (c *Client) handleMessage(data []byte) {
 	var msg WSMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("Error parsing message: %v", err)
+		c.log.Warn("Error parsing message", "err", err)
 		return
 	}
 
+	countFrame(msg.Type)
+	ctx, span := tracing.Start(context.Background(), "ws."+frameName(msg.Type),
+		tracing.String("request_id", c.requestID),
+		tracing.String("net.peer", c.remoteAddr),
+	)
+	defer span.End()
+	if c.verified {
+		span.SetAttributes(tracing.String("user_id", c.user.ID))
+	}
+
+	if !c.allowFrame(msg) {
+		span.SetAttributes(tracing.Bool("rate_limited", true))
+		return
+	}
+
+	// Heartbeats are sent automatically and do not count as activity
+	if msg.Type != "ping" {
+		c.touch()
+	}
+
 	switch msg.Type {
 	case "auth":
-		c.handleAuth(msg)
+		c.handleAuth(ctx, msg)
 	case "text", "image":
-		c.handleChatMessage(msg)
+		c.handleChatMessage(ctx, msg)
 	case "typing":
 		c.handleTyping(msg)
 	case "recall":
-		c.handleRecall(msg)
+		c.handleRecall(ctx, msg)
 	case "read":
 		c.handleRead(msg)
+	case "presence":
+		c.handlePresence(ctx, msg)
+	case "moderate":
+		c.handleModerate(msg)
+	case "command":
+		c.handleCommand(ctx, msg)
+	case "presence_sync":
+		if c.verified {
+			c.sendPresenceSnapshot()
+		}
 	case "ping":
 		// Respond to client heartbeat
 		c.sendJSON(map[string]interface{}{
@@ -319,53 +477,148 @@ func (c *Client) handleMessage(data []byte) {
 }
 
 // handleAuth handles authentication
-func (c *Client) handleAuth(msg WSMessage) {
+func (c *Client) handleAuth(ctx context.Context, msg WSMessage) {
+	db := store.Get().WithContext(ctx)
 	var auth AuthPayload
 	if err := json.Unmarshal(msg.Payload, &auth); err != nil {
 		c.sendError("Invalid auth payload")
 		return
 	}
 
+	// Closing the connection alone does not slow an attacker down, since
+	// they can reconnect at once; refused attempts are never checked
+	if wait, ok := authAllowed(c.ip, auth.UserID); !ok {
+		auditAuthFailure(c.ip, auth.UserID, c.remoteAddr, map[string]string{
+			"reason": "rate limited",
+		})
+		c.sendError(retryMessage(wait))
+		closeConn(c.conn, closeRateLimited, retryMessage(wait))
+		return
+	}
+
 	cfg := config.Get()
 	if auth.PasswordHash != cfg.PasswordHash {
+		authFailed(c.ip, auth.UserID, c.remoteAddr)
+		auditAuthFailure(c.ip, auth.UserID, c.remoteAddr, map[string]string{
+			"reason": "invalid password",
+		})
 		c.sendError("Invalid password")
 		c.conn.Close()
 		return
 	}
 
-	user := models.NewUser(auth.UserID, auth.UserName)
+	if models.IsBotID(auth.UserID) {
+		c.sendError("User IDs starting with " + models.BotIDPrefix + " are reserved for bots")
+		c.conn.Close()
+		return
+	}
 
-	// Try to load existing avatar from database if not provided in auth payload
-	if auth.Avatar != "" {
-		user.Avatar = auth.Avatar
-	} else {
-		// Check if user exists in database and has avatar
-		dbUsers, err := store.Get().GetUsers()
-		if err == nil {
-			for _, u := range dbUsers {
-				if u.ID == auth.UserID && u.Avatar != "" {
-					user.Avatar = u.Avatar
-					break
-				}
-			}
+	if ban, err := db.GetBan(auth.UserID, time.Now().UnixMilli()); err != nil {
+		c.log.Error("Error checking ban", "user_id", auth.UserID, "err", err)
+	} else if ban != nil {
+		auditAuthFailure(c.ip, auth.UserID, c.remoteAddr, map[string]string{
+			"reason": "banned",
+		})
+		reason := "You are banned"
+		if ban.Reason != "" {
+			reason += ": " + ban.Reason
 		}
+		c.sendError(reason)
+		closeConn(c.conn, closeBanned, reason)
+		return
+	}
+
+	user := models.NewUser(auth.UserID, auth.UserName)
+
+	// Profile fields are changed through the profile and avatar endpoints, so
+	// an existing user keeps what is stored rather than what the payload says
+	existing, err := db.GetUser(auth.UserID)
+	if err == nil && existing != nil {
+		existing.SetOnline(true)
+		user = existing
+	}
+	if user.Presence == "" {
+		user.Presence = models.PresenceOnline
+	}
+
+	adminSecret := isAdminSecret(auth.StaffKey)
+	staff := models.RoleRank(user.Role) >= models.RoleRank(models.RoleModerator)
+	if staff && !adminSecret && !validStaffKey(db, user.ID, auth.StaffKey) {
+		authFailed(c.ip, auth.UserID, c.remoteAddr)
+		auditAuthFailure(c.ip, auth.UserID, c.remoteAddr, map[string]string{
+			"reason": "invalid staff key",
+		})
+		c.sendError("This account needs its staff key")
+		closeConn(c.conn, closeStaffKey, "This account needs its staff key")
+		return
+	}
+
+	authSucceeded(c.ip, auth.UserID)
+
+	// The configured bootstrap admin, or else the first user, becomes admin.
+	// With an admin secret configured, they must present it as their key.
+	promote := false
+	switch {
+	case user.Role == models.RoleAdmin:
+	case cfg.BootstrapAdmin != "":
+		promote = user.ID == cfg.BootstrapAdmin
+	case existing == nil || adminSecret:
+		hasAdmin, err := db.HasAdmin()
+		promote = err == nil && !hasAdmin
+	}
+	if cfg.AdminSecret != "" && !adminSecret {
+		promote = false
+	}
+	if promote {
+		user.Role = models.RoleAdmin
+	}
+
+	// A new admin, or staff who signed in with the admin secret, get a key
+	// of their own for later sign-ins
+	staffKey := ""
+	if promote || (staff && adminSecret) {
+		staffKey = crypto.RandomToken(32)
 	}
 
 	// Update client state safely
 	c.hub.mutex.Lock()
 	c.user = user
 	c.verified = true
+	c.log = c.log.With("user_id", user.ID)
 	c.hub.mutex.Unlock()
+	c.log.Info("WebSocket authenticated")
 
 	// Save user to database (will update last_seen timestamp)
-	store.Get().SaveUser(c.user)
+	db.SaveUser(c.userSnapshot())
+	if promote {
+		if err := db.SetUserRole(c.user.ID, models.RoleAdmin); err != nil {
+			c.log.Error("Error promoting user to admin", "err", err)
+		}
+	}
+	if staffKey != "" {
+		if err := db.SetStaffKey(c.user.ID, crypto.HashPassword(staffKey)); err != nil {
+			c.log.Error("Error saving staff key", "err", err)
+			staffKey = ""
+		}
+	}
+
+	audit(models.AuditAuthSuccess, c.user.ID, "", c.remoteAddr, nil)
 
 	// Send auth success
-	c.sendJSON(map[string]interface{}{
+	success := map[string]interface{}{
 		"type":    "auth_success",
 		"userId":  c.user.ID,
+		"token":   issueSession(c.user.ID),
 		"message": "Authentication successful",
-	})
+	}
+	if topic, _ := db.GetSetting(topicSetting); topic != "" {
+		success["topic"] = topic
+	}
+	if staffKey != "" {
+		// Shown once; the client keeps it for reconnecting
+		success["staffKey"] = staffKey
+	}
+	c.sendJSON(success)
 
 	// Notify others
 	// Check if this is a new user (not just a new connection)
@@ -379,48 +632,76 @@ func (c *Client) handleAuth(msg WSMessage) {
 	}
 	c.hub.mutex.RUnlock()
 
-	if isNewUser {
-		sysMsg := models.SystemMessage(c.user.Name + " joined the chat")
-		store.Get().SaveMessage(sysMsg)
-		c.hub.broadcastMessage(sysMsg)
+	// Other connections of the user may change its profile meanwhile
+	self := c.userSnapshot()
+	if isNewUser && self.Presence != models.PresenceInvisible {
+		sysMsg := models.SystemMessage(self.Name + " joined the chat")
+		db.SaveMessage(sysMsg)
+		c.hub.broadcastMessage(ctx, sysMsg)
+		webhook.Emit(models.EventUserJoined, map[string]interface{}{
+			"userId":   self.ID,
+			"userName": self.Name,
+		})
 	}
 
-	// Broadcast online users to all clients
-	usersMsg := map[string]interface{}{
-		"type":  "users",
-		"users": c.hub.GetOnlineUsers(),
-	}
-	data, _ := json.Marshal(usersMsg)
-	c.hub.broadcast <- data
+	// Announce the user to everyone, then give this client the full list
+	c.hub.syncPresence()
+	c.sendPresenceSnapshot()
 }
 
 // handleChatMessage handles text and image messages
-func (c *Client) handleChatMessage(msg WSMessage) {
+func (c *Client) handleChatMessage(ctx context.Context, msg WSMessage) {
 	if !c.verified || c.user == nil {
 		c.sendError("Not authenticated")
 		return
 	}
+	self := c.userSnapshot()
+	if self.IsMuted(time.Now().UnixMilli()) {
+		c.sendError("You are muted")
+		return
+	}
 
 	chatMsg := &models.Message{
 		ID:        msg.ID,
 		Type:      models.MessageType(msg.Type),
-		From:      c.user.ID,
-		FromName:  c.user.Name,
+		From:      self.ID,
+		FromName:  self.Name,
 		Content:   msg.Content,
 		Timestamp: time.Now().UnixMilli(),
 		ReplyTo:   msg.ReplyTo,
 		Mentions:  msg.Mentions,
+		Width:     msg.Width,
+		Height:    msg.Height,
+	}
+	if chatMsg.Type == models.TypeImage {
+		applyImagePreview(chatMsg)
 	}
 
-	// Save to database
-	if err := store.Get().SaveMessage(chatMsg); err != nil {
-		log.Printf("Error saving message: %v", err)
+	// Message IDs come from the client, which matches the echo against its
+	// pending sends; a reused ID must not reach another user's message
+	if chatMsg.ID == "" {
+		c.sendError("Invalid message")
+		return
+	}
+	err := store.Get().WithContext(ctx).SaveMessage(chatMsg)
+	if errors.Is(err, store.ErrDuplicateMessage) {
+		c.sendError("Message ID already used")
+		return
+	}
+	if err != nil {
+		c.log.Error("Error saving message", "err", err)
 		c.sendError("Failed to save message")
 		return
 	}
+	if chatMsg.Type == models.TypeImage {
+		trackUploadRef(models.UploadRefMessage, chatMsg.ID, chatMsg.Content)
+	}
+
+	messagesSent.With(string(chatMsg.Type)).Inc()
 
 	// Broadcast to all clients
-	c.hub.broadcastMessage(chatMsg)
+	c.hub.broadcastMessage(ctx, chatMsg)
+	webhook.Emit(models.EventMessageCreated, chatMsg)
 }
 
 // handleTyping handles typing indicators
@@ -429,38 +710,67 @@ func (c *Client) handleTyping(msg WSMessage) {
 		return
 	}
 
+	self := c.userSnapshot()
 	typingMsg := map[string]interface{}{
 		"type":     "typing",
-		"userId":   c.user.ID,
-		"userName": c.user.Name,
+		"userId":   self.ID,
+		"userName": self.Name,
 	}
 	data, _ := json.Marshal(typingMsg)
-	c.hub.broadcast <- data
+	c.hub.publishTransient(data)
 }
 
 // handleRecall handles message recall
-func (c *Client) handleRecall(msg WSMessage) {
+func (c *Client) handleRecall(ctx context.Context, msg WSMessage) {
 	if !c.verified || c.user == nil {
 		return
 	}
 
+	// Only the sender or a moderator may recall a message
+	db := store.Get().WithContext(ctx)
+	target, err := db.GetMessage(msg.ID)
+	if err != nil {
+		c.log.Error("Error loading message", "message_id", msg.ID, "err", err)
+		c.sendError("Failed to recall message")
+		return
+	}
+	if target == nil {
+		c.sendError("Message not found")
+		return
+	}
+	self := c.userSnapshot()
+	if target.From != self.ID && !self.CanModerate() {
+		c.sendError("You can only recall your own messages")
+		return
+	}
+	if target.Recalled {
+		return
+	}
+
 	// Update database
-	if err := store.Get().RecallMessage(msg.ID); err != nil {
-		log.Printf("Error recalling message: %v", err)
+	if err := db.RecallMessage(msg.ID); err != nil {
+		c.log.Error("Error recalling message", "message_id", msg.ID, "err", err)
 		c.sendError("Failed to recall message")
 		return
 	}
+	releaseUploadRefs(models.UploadRefMessage, msg.ID)
+	audit(models.AuditRecall, c.user.ID, msg.ID, c.remoteAddr, nil)
 
 	// Broadcast recall
 	recallMsg := map[string]interface{}{
 		"type":      "recall",
 		"id":        msg.ID,
-		"userId":    c.user.ID,
-		"userName":  c.user.Name,
+		"userId":    self.ID,
+		"userName":  self.Name,
 		"timestamp": time.Now().UnixMilli(),
 	}
 	data, _ := json.Marshal(recallMsg)
-	c.hub.broadcast <- data
+	c.hub.publishContext(ctx, data)
+	webhook.Emit(models.EventMessageRecalled, map[string]interface{}{
+		"id":       msg.ID,
+		"userId":   self.ID,
+		"userName": self.Name,
+	})
 }
 
 // handleRead handles read receipts
@@ -476,7 +786,7 @@ func (c *Client) handleRead(msg WSMessage) {
 		"timestamp": time.Now().UnixMilli(),
 	}
 	data, _ := json.Marshal(readMsg)
-	c.hub.broadcast <- data
+	c.hub.publish(data)
 }
 
 // sendError sends an error message to client
@@ -493,8 +803,20 @@ func (c *Client) sendJSON(v interface{}) {
 	if err != nil {
 		return
 	}
-	select {
-	case c.send <- data:
-	default:
+	c.enqueue(data, false)
+}
+
+// sendJSONDetached sends a JSON message from a goroutine that is neither the
+// read pump nor holding the hub lock, dropping it if the client has
+// disconnected and its send queue been closed
+func (c *Client) sendJSONDetached(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.hub.mutex.RLock()
+	defer c.hub.mutex.RUnlock()
+	if c.hub.clients[c] {
+		c.enqueue(data, false)
 	}
 }
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+// nextFrame returns the next frame of the given type queued for c
+func nextFrame(t *testing.T, c *Client, frameType string) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				t.Fatalf("send queue closed before a %s frame arrived", frameType)
+			}
+			var frame map[string]interface{}
+			json.Unmarshal(data, &frame)
+			if frame["type"] == frameType {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s frame", frameType)
+		}
+	}
+}
+
+// countFrames drains c's send queue and returns how many frames had the
+// given type
+func countFrames(c *Client, frameType string) int {
+	n := 0
+	for {
+		select {
+		case data := <-c.send:
+			var frame map[string]interface{}
+			json.Unmarshal(data, &frame)
+			if frame["type"] == frameType {
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
+
+func TestRecallPermissions(t *testing.T) {
+	h := setupHub(t)
+	alice := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+	mod := connectTestClient(t, h, &models.User{ID: "u3", Name: "Carol", Role: models.RoleModerator})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		alice.handleChatMessage(context.Background(), WSMessage{Type: "text", ID: id, Content: "hi"})
+	}
+	h.settle()
+	countFrames(bob, "recall")
+
+	tests := []struct {
+		name       string
+		client     *Client
+		id         string
+		wantRecall bool
+	}{
+		{name: "another member", client: bob, id: "m1", wantRecall: false},
+		{name: "unknown message", client: alice, id: "nope", wantRecall: false},
+		{name: "sender", client: alice, id: "m2", wantRecall: true},
+		{name: "moderator", client: mod, id: "m3", wantRecall: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.handleRecall(context.Background(), WSMessage{Type: "recall", ID: tt.id})
+			h.settle()
+			if got := countFrames(bob, "recall") == 1; got != tt.wantRecall {
+				t.Errorf("recall broadcast = %v, want %v", got, tt.wantRecall)
+			}
+			msg, _ := store.Get().GetMessage(tt.id)
+			if msg != nil && msg.Recalled != tt.wantRecall {
+				t.Errorf("stored Recalled = %v, want %v", msg.Recalled, tt.wantRecall)
+			}
+		})
+	}
+}
+
+func TestChatMessageDuplicateID(t *testing.T) {
+	h := setupHub(t)
+	alice := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+	bob := connectTestClient(t, h, &models.User{ID: "u2", Name: "Bob", Role: models.RoleMember})
+
+	alice.handleChatMessage(context.Background(), WSMessage{Type: "text", ID: "m1", Content: "original"})
+	h.settle()
+	countFrames(alice, "text")
+
+	bob.handleChatMessage(context.Background(), WSMessage{Type: "text", ID: "m1", Content: "hijack"})
+	if frame := nextFrame(t, bob, "error"); frame["message"] != "Message ID already used" {
+		t.Errorf("duplicate ID error = %v", frame)
+	}
+	h.settle()
+	if n := countFrames(alice, "text"); n != 0 {
+		t.Errorf("a message with a reused ID was broadcast %d times", n)
+	}
+	msg, _ := store.Get().GetMessage("m1")
+	if msg == nil || msg.From != "u1" || msg.Content != "original" {
+		t.Errorf("GetMessage() = %+v, want the original message", msg)
+	}
+}
+
+func TestProfileChangeDuringChat(t *testing.T) {
+	h := setupHub(t)
+	alice := connectTestClient(t, h, &models.User{ID: "u1", Name: "Alice", Role: models.RoleMember})
+
+	// Profile and presence updates rewrite the connected user under the hub
+	// lock while its read pump sends; go test -race flags unlocked reads
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			h.UpdateUserProfile(&models.User{ID: "u1", Name: "Alice"})
+			h.forUser("u1", func(u *models.User) { u.Presence = models.PresenceOnline })
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("m%d", i)
+		alice.handleChatMessage(context.Background(), WSMessage{Type: "text", ID: id, Content: "hi"})
+		alice.handleTyping(WSMessage{Type: "typing"})
+		alice.handleRecall(context.Background(), WSMessage{Type: "recall", ID: id})
+	}
+	<-done
+}
@@ -0,0 +1,396 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// ThumbSize is the longest side of generated thumbnails
+	ThumbSize = 320
+	// AvatarSize and AvatarSmallSize are the square sizes avatars are scaled to
+	AvatarSize      = 256
+	AvatarSmallSize = 64
+	// MaxPixels rejects images whose decoded size would exhaust memory
+	MaxPixels = 40 * 1000 * 1000
+)
+
+var (
+	// ErrNotImage is returned for content that is not a supported image,
+	// such as client-side encrypted blobs
+	ErrNotImage = errors.New("not a supported image")
+	// ErrTooLarge is returned for images above MaxPixels
+	ErrTooLarge = errors.New("image dimensions too large")
+)
+
+// Result holds a sanitized image and its thumbnail
+type Result struct {
+	Data     []byte // original image with metadata removed
+	Ext      string // extension matching Data
+	Width    int
+	Height   int
+	Thumb    []byte
+	ThumbExt string
+}
+
+// Sniff returns the image format of data ("jpeg", "png", "webp") or ""
+func Sniff(data []byte) string {
+	switch {
+	case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return "jpeg"
+	case len(data) >= 8 && string(data[:8]) == "\x89PNG\r\n\x1a\n":
+		return "png"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+// Process strips metadata (EXIF, GPS, XMP, text chunks) from an image and
+// generates a thumbnail. It returns ErrNotImage for anything else.
+func Process(data []byte) (*Result, error) {
+	format := Sniff(data)
+	if format == "" {
+		return nil, ErrNotImage
+	}
+
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	switch format {
+	case "jpeg":
+		res.Ext = ".jpg"
+		if jpegOrientation(data) > 1 {
+			// The orientation lives in the EXIF block we are about to drop,
+			// so the re-encoded pixels from decode carry it instead
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+				return nil, err
+			}
+			res.Data = buf.Bytes()
+		} else if res.Data, err = stripJPEG(data); err != nil {
+			return nil, err
+		}
+	case "png":
+		res.Ext = ".png"
+		if res.Data, err = stripPNG(data); err != nil {
+			return nil, err
+		}
+	case "webp":
+		res.Ext = ".webp"
+		if res.Data, err = stripWebP(data); err != nil {
+			return nil, err
+		}
+	}
+
+	bounds := img.Bounds()
+	res.Width, res.Height = bounds.Dx(), bounds.Dy()
+
+	res.Thumb, res.ThumbExt, err = thumbnail(img, ThumbSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Avatar decodes an image, crops it to a centered square and scales it to
+// each of the given sizes. The encoded variants carry no metadata.
+func Avatar(data []byte, sizes ...int) ([][]byte, string, error) {
+	if Sniff(data) == "" {
+		return nil, "", ErrNotImage
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+
+	variants := make([][]byte, 0, len(sizes))
+	ext := ""
+	for _, size := range sizes {
+		dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+		data, e, err := encode(dst)
+		if err != nil {
+			return nil, "", err
+		}
+		variants = append(variants, data)
+		ext = e
+	}
+	return variants, ext, nil
+}
+
+// decode checks the image dimensions before decoding it and applies the
+// EXIF orientation of JPEGs
+func decode(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if format == "jpeg" {
+		if o := jpegOrientation(data); o > 1 {
+			img = applyOrientation(img, o)
+		}
+	}
+	return img, nil
+}
+
+// thumbnail scales img to fit within max×max
+func thumbnail(img image.Image, max int) ([]byte, string, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > max || h > max {
+		if w >= h {
+			h = h * max / w
+			w = max
+		} else {
+			w = w * max / h
+			h = max
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return encode(dst)
+}
+
+// encode writes opaque images as JPEG and images with transparency as PNG
+func encode(img *image.NRGBA) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if img.Opaque() {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ".jpg", nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ".png", nil
+}
+
+// stripJPEG drops APP1 (EXIF/XMP), APP13 (IPTC) and comment segments
+// without re-encoding the image data
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, ErrNotImage
+		}
+		// Skip fill bytes
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, ErrNotImage
+		}
+		marker := data[i]
+		i++
+
+		// Start of scan: the rest is entropy-coded data
+		if marker == 0xDA {
+			out = append(out, 0xFF, marker)
+			return append(out, data[i:]...), nil
+		}
+		// Markers without a length field
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
+			out = append(out, 0xFF, marker)
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, ErrNotImage
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return nil, ErrNotImage
+		}
+		segment := data[i : i+length]
+		i += length
+
+		if marker == 0xE1 || marker == 0xED || marker == 0xFE {
+			continue
+		}
+		out = append(out, 0xFF, marker)
+		out = append(out, segment...)
+	}
+	return out, nil
+}
+
+// jpegOrientation returns the EXIF orientation tag (1-8), or 0 if absent
+func jpegOrientation(data []byte) int {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA {
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 0
+		}
+		segment := data[i+4 : i+2+length]
+		i += 2 + length
+
+		if marker != 0xE1 || len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+			continue
+		}
+		tiff := segment[6:]
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 0
+		}
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd+2 > len(tiff) {
+			return 0
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for e := 0; e < count; e++ {
+			off := ifd + 2 + e*12
+			if off+12 > len(tiff) {
+				return 0
+			}
+			if order.Uint16(tiff[off:]) == 0x0112 {
+				o := int(order.Uint16(tiff[off+8:]))
+				if o < 1 || o > 8 {
+					return 0
+				}
+				return o
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
+// applyOrientation transforms img so it displays upright without EXIF
+func applyOrientation(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// stripPNG drops textual, timestamp and EXIF chunks
+func stripPNG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...)
+	i := 8
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrNotImage
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebP drops EXIF and XMP chunks from the RIFF container
+func stripWebP(data []byte) ([]byte, error) {
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	i := 12
+	for i+8 <= len(data) {
+		fourcc := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, ErrNotImage
+		}
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if size > 0 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present flags
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
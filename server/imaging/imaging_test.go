@@ -0,0 +1,190 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+// exifSegment builds an APP1 segment with a single orientation entry
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1) // one entry
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func jpegWithExif(t *testing.T, w, h int, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatalf("jpeg.Encode() error = %v", err)
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, exifSegment(orientation)...)
+	return append(out, data[2:]...)
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0}, "jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n...."), "png"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "webp"},
+		{"encrypted blob", []byte("U2FsdGVkX1+abcdef"), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sniff(tt.data); got != tt.want {
+				t.Errorf("Sniff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessNotImage(t *testing.T) {
+	if _, err := Process([]byte("encrypted payload")); err != ErrNotImage {
+		t.Errorf("Process() error = %v, want ErrNotImage", err)
+	}
+}
+
+func TestProcessJPEGStripsExif(t *testing.T) {
+	data := jpegWithExif(t, 40, 20, 1)
+	if jpegOrientation(data) != 1 {
+		t.Fatalf("jpegOrientation() = %d, want 1", jpegOrientation(data))
+	}
+
+	res, err := Process(data)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if bytes.Contains(res.Data, []byte("Exif")) {
+		t.Error("Process() should remove the EXIF segment")
+	}
+	if res.Width != 40 || res.Height != 20 {
+		t.Errorf("Process() size = %dx%d, want 40x20", res.Width, res.Height)
+	}
+	if res.Ext != ".jpg" || res.ThumbExt != ".jpg" {
+		t.Errorf("Process() ext = %q/%q, want .jpg/.jpg", res.Ext, res.ThumbExt)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(res.Data)); err != nil {
+		t.Errorf("stripped JPEG should still decode: %v", err)
+	}
+}
+
+func TestProcessJPEGAppliesOrientation(t *testing.T) {
+	// Orientation 6 means the camera was rotated; the upright image is 20x40
+	res, err := Process(jpegWithExif(t, 40, 20, 6))
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if res.Width != 20 || res.Height != 40 {
+		t.Errorf("Process() size = %dx%d, want 20x40", res.Width, res.Height)
+	}
+	if bytes.Contains(res.Data, []byte("Exif")) {
+		t.Error("Process() should remove the EXIF segment")
+	}
+}
+
+func TestProcessPNGStripsText(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, testImage(10, 10))
+	data := buf.Bytes()
+
+	// Insert a tEXt chunk after IHDR (8 byte signature + 25 byte IHDR)
+	text := []byte("tEXtComment\x00secret location")
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(text))
+	chunk = append(chunk, crc...)
+	withText := append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+
+	res, err := Process(withText)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if bytes.Contains(res.Data, []byte("secret location")) {
+		t.Error("Process() should remove tEXt chunks")
+	}
+	if _, err := png.Decode(bytes.NewReader(res.Data)); err != nil {
+		t.Errorf("stripped PNG should still decode: %v", err)
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	data, ext, err := thumbnail(testImage(1000, 500), ThumbSize)
+	if err != nil {
+		t.Fatalf("thumbnail() error = %v", err)
+	}
+	if ext != ".jpg" {
+		t.Errorf("thumbnail() ext = %q, want .jpg", ext)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("thumbnail should decode: %v", err)
+	}
+	if cfg.Width != ThumbSize || cfg.Height != ThumbSize/2 {
+		t.Errorf("thumbnail() size = %dx%d, want %dx%d", cfg.Width, cfg.Height, ThumbSize, ThumbSize/2)
+	}
+}
+
+func TestAvatarCropsSquare(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, testImage(300, 100))
+
+	variants, ext, err := Avatar(buf.Bytes(), AvatarSize, AvatarSmallSize)
+	if err != nil {
+		t.Fatalf("Avatar() error = %v", err)
+	}
+	if ext != ".jpg" {
+		t.Errorf("Avatar() ext = %q, want .jpg for an opaque image", ext)
+	}
+	if len(variants) != 2 {
+		t.Fatalf("Avatar() returned %d variants, want 2", len(variants))
+	}
+	for i, size := range []int{AvatarSize, AvatarSmallSize} {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(variants[i]))
+		if err != nil {
+			t.Fatalf("variant %d should decode: %v", i, err)
+		}
+		if cfg.Width != size || cfg.Height != size {
+			t.Errorf("variant %d size = %dx%d, want %dx%d", i, cfg.Width, cfg.Height, size, size)
+		}
+	}
+
+	if _, _, err := Avatar([]byte("not an image"), AvatarSize); err != ErrNotImage {
+		t.Errorf("Avatar() error = %v, want ErrNotImage", err)
+	}
+}
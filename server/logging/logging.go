@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Redacted replaces the value of attributes that may hold secrets
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys, compared case-insensitively, whose
+// values are never written: password hashes, session tokens and message
+// content, which is end-to-end encrypted and must not leak into logs
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"password_hash": true,
+	"passwordhash":  true,
+	"hash":          true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+	"content":       true,
+}
+
+// level is the default logger's level, which SetLevel changes at runtime
+var level slog.LevelVar
+
+// Setup installs the default logger, writing to stderr at lvl (debug,
+// info, warn or error) in format (text or json). The standard log package is
+// routed through it as well.
+func Setup(lvl, format string) error {
+	parsed, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	h, err := newHandler(os.Stderr, &level, format)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// SetLevel changes the level of the logger installed by Setup, including
+// loggers already derived from it
+func SetLevel(lvl string) error {
+	parsed, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+// NewHandler creates a redacting handler writing to w
+func NewHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	return newHandler(w, lvl, format)
+}
+
+func newHandler(w io.Writer, lvl slog.Leveler, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// ParseLevel parses a level name
+func ParseLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+	}
+	return lvl, nil
+}
+
+// redact hides the values of sensitive attributes
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random ID for correlating the log lines of a
+// request and any WebSocket session it starts
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a context carrying id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger with the request ID of ctx attached
+func FromContext(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
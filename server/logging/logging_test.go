@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("auth", "user_id", "u1", "passwordHash", "abc123", "Token", "t0k", "content", "hello")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	if entry["user_id"] != "u1" {
+		t.Errorf("user_id = %v, want u1", entry["user_id"])
+	}
+	for _, key := range []string{"passwordHash", "Token", "content"} {
+		if entry[key] != Redacted {
+			t.Errorf("%s = %v, want %s", key, entry[key], Redacted)
+		}
+	}
+	for _, secret := range []string{"abc123", "t0k", "hello"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("output contains %q: %s", secret, buf.String())
+		}
+	}
+}
+
+func TestLevelsAndFormats(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "WARN", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("hidden")
+	logger.Warn("shown", "k", "v")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "level=WARN msg=shown k=v") {
+		t.Errorf("unexpected text output: %q", out)
+	}
+
+	if _, err := NewHandler(&buf, "loud", "text"); err == nil {
+		t.Error("NewHandler() should reject an unknown level")
+	}
+	if _, err := NewHandler(&buf, "info", "xml"); err == nil {
+		t.Error("NewHandler() should reject an unknown format")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	if err := Setup("info", "text"); err != nil {
+		t.Fatal(err)
+	}
+	derived := slog.Default().With("request_id", "r1")
+	if derived.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug should be disabled at info level")
+	}
+	if err := SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if !derived.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("SetLevel() should apply to loggers derived before the change")
+	}
+	if err := SetLevel("loud"); err == nil {
+		t.Error("SetLevel() should reject an unknown level")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	a, b := NewRequestID(), NewRequestID()
+	if len(a) != 16 || a == b {
+		t.Errorf("NewRequestID() = %q, %q; want distinct 16 character IDs", a, b)
+	}
+
+	ctx := WithRequestID(context.Background(), a)
+	if got := RequestID(ctx); got != a {
+		t.Errorf("RequestID() = %q, want %q", got, a)
+	}
+	if got := RequestID(context.Background()); got != "" {
+		t.Errorf("RequestID() without one = %q, want empty", got)
+	}
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"sec-chat/server/blobstore"
 	"sec-chat/server/config"
 	"sec-chat/server/handlers"
+	"sec-chat/server/logging"
+	"sec-chat/server/metrics"
 	"sec-chat/server/store"
+	"sec-chat/server/tlscert"
+	"sec-chat/server/tracing"
+	"sec-chat/server/webhook"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,38 +24,97 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
+	CheckOrigin:     checkWSOrigin,
 }
 
 func main() {
+	// Admin commands run instead of the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Initialize configuration
 	cfg := config.Init()
-	log.Printf("Starting SecChat server on port %d", cfg.Port)
-	log.Printf("Password hash: %s", cfg.PasswordHash)
+	slog.Info("Starting SecChat server", "port", cfg.Port, "version", cfg.Version)
+
+	// Export trace spans if configured
+	if err := tracing.Init(tracing.Options{
+		Exporter:    cfg.TraceExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+		SampleRatio: cfg.TraceSampleRatio,
+		ServiceName: "secchat",
+		Version:     cfg.Version,
+	}); err != nil {
+		logging.Fatal("Failed to initialize tracing", "err", err)
+	}
 
 	// Initialize database
 	_, err := store.Init(cfg.DBPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		logging.Fatal("Failed to initialize database", "err", err)
+	}
+
+	// Initialize upload storage
+	if _, err := blobstore.Init(cfg); err != nil {
+		logging.Fatal("Failed to initialize upload storage", "err", err)
 	}
-	defer store.Get().Close()
+
+	// Deliver chat events to webhook subscriptions
+	if _, err := webhook.Init(store.Get()); err != nil {
+		logging.Fatal("Failed to initialize webhooks", "err", err)
+	}
+
+	// Audit password changes made between runs
+	handlers.RecordPasswordRotation(cfg.PasswordHash)
+
+	// Track failed auth attempts for backoff and lockout
+	handlers.InitAuthGuard(cfg)
 
 	// Initialize WebSocket hub
 	handlers.InitHub()
 
+	// Collect uploads that were never referenced by a message or avatar
+	handlers.StartUploadGC()
+
+	// Remove audit events past the configured retention
+	handlers.StartAuditPruner()
+
 	// Setup routes
+	http.HandleFunc("/healthz", handlers.HandleHealthz)
+	http.HandleFunc("/readyz", handlers.HandleReadyz)
 	http.HandleFunc("/ws", handleWS)
-	http.Handle("/api/auth", corsMiddleware(http.HandlerFunc(handlers.HandleAuth)))
-	http.Handle("/api/messages", corsMiddleware(http.HandlerFunc(handlers.HandleMessages)))
-	http.Handle("/api/upload", corsMiddleware(http.HandlerFunc(handlers.HandleUpload)))
-	http.Handle("/api/members", corsMiddleware(http.HandlerFunc(handlers.HandleMembers)))
-	http.Handle("/api/user/avatar", corsMiddleware(http.HandlerFunc(handlers.HandleAvatarUpdate)))
+	handleAPI("/api/auth", handlers.HandleAuth)
+	handleAPI("/api/messages", handlers.HandleMessages)
+	handleAPI("/api/upload", handlers.HandleUpload)
+	handleAPI("/api/members", handlers.HandleMembers)
+	handleAPI("/api/user/avatar", handlers.HandleAvatarUpdate)
+	handleAPI("/api/users/", handlers.HandleUser)
+	handleAPI("/api/bot/messages", handlers.HandleBotMessage)
+	handleAPI("/api/bot/commands", handlers.HandleBotCommands)
+	handleAPI("/api/bot/commands/", handlers.HandleBotCommand)
+	handleAPI("/api/hooks/", handlers.HandleIncomingWebhook)
+	handleAPI("/api/moderation", handlers.HandleModeration)
+	handleAPI("/api/moderation/log", handlers.HandleModerationLog)
+	handleAPI("/api/admin/status", handlers.HandleAdminStatus)
+	handleAPI("/api/admin/connections", handlers.HandleAdminConnections)
+	handleAPI("/api/admin/connections/", handlers.HandleAdminConnection)
+	handleAPI("/api/admin/announce", handlers.HandleAdminAnnounce)
+	handleAPI("/api/admin/bots", handlers.HandleAdminBots)
+	handleAPI("/api/admin/bots/", handlers.HandleAdminBot)
+	handleAPI("/api/admin/webhooks", handlers.HandleAdminWebhooks)
+	handleAPI("/api/admin/webhooks/", handlers.HandleAdminWebhook)
+	handleAPI("/api/admin/dead-letters", handlers.HandleAdminDeadLetters)
+	handleAPI("/api/admin/dead-letters/", handlers.HandleAdminDeadLetter)
+	handleAPI("/api/admin/audit", handlers.HandleAuditLog)
+	handleAPI("/api/admin/audit/export", handlers.HandleAuditExport)
 
 	// Serve uploaded files with CORS support
-	http.Handle("/uploads/", corsMiddleware(http.StripPrefix("/uploads/",
-		http.FileServer(http.Dir(cfg.UploadDir)))))
+	handleAPI("/uploads/", handlers.HandleUploads)
+
+	// Metrics for Prometheus, on the main port unless a separate address is set
+	if cfg.MetricsAddr == "" {
+		http.Handle("/metrics", metrics.Handler())
+	}
 
 	// Serve static files (frontend)
 	staticDir := os.Getenv("STATIC_DIR")
@@ -59,41 +124,124 @@ func main() {
 
 	// Check if static directory exists
 	if _, err := os.Stat(staticDir); err == nil {
-		log.Printf("Serving static files from %s", staticDir)
+		slog.Info("Serving static files", "dir", staticDir)
 		// Handle SPA routing - serve index.html for all non-API routes
-		http.HandleFunc("/", spaHandler(staticDir))
+		http.Handle("/", instrument("/", spaHandler(staticDir)))
 	} else {
-		log.Printf("Warning: Static directory %s not found, API only mode", staticDir)
+		slog.Warn("Static directory not found, API only mode", "dir", staticDir)
 	}
 
 	// Start server
 	addr := ":" + strconv.Itoa(cfg.Port)
-	log.Printf("Server listening on %s", addr)
+	ln, err := listen(addr, listenerFDEnv)
+	if err != nil {
+		logging.Fatal("Failed to listen", "addr", addr, "err", err)
+	}
+	listeners := []handoff{{listenerFDEnv, ln}}
 
 	// Add logging middleware
-	handler := loggingMiddleware(http.DefaultServeMux)
+	srv := &http.Server{Handler: loggingMiddleware(http.DefaultServeMux)}
+	serveErr := make(chan error, 3)
+
+	var certs *tlscert.Reloader
+	if cfg.TLSCert != "" {
+		certs, err = tlscert.NewReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			logging.Fatal("Failed to load TLS certificate", "err", err)
+		}
+		logCertificate(certs)
+		go watchCertificate(certs)
 
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("Server error: %v", err)
+		slog.Info("Server listening", "addr", ln.Addr().String(), "tls", true)
+		go func() { serveErr <- srv.Serve(tlsListener(ln, certs)) }()
+	} else {
+		slog.Info("Server listening", "addr", ln.Addr().String(), "tls", false)
+		go func() { serveErr <- srv.Serve(ln) }()
 	}
+
+	go watchHangup(certs)
+
+	// Redirect plain HTTP to HTTPS
+	var redirect *http.Server
+	if cfg.HTTPRedirectPort != 0 {
+		redirectAddr := ":" + strconv.Itoa(cfg.HTTPRedirectPort)
+		rln, err := listen(redirectAddr, redirectFDEnv)
+		if err != nil {
+			logging.Fatal("Failed to listen", "addr", redirectAddr, "err", err)
+		}
+		listeners = append(listeners, handoff{redirectFDEnv, rln})
+
+		slog.Info("Redirecting HTTP to HTTPS", "addr", rln.Addr().String())
+		redirect = &http.Server{Handler: redirectHandler(cfg.Port)}
+		go func() { serveErr <- redirect.Serve(rln) }()
+	}
+
+	// Serve metrics on their own listener
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		mln, err := listen(cfg.MetricsAddr, metricsFDEnv)
+		if err != nil {
+			logging.Fatal("Failed to listen", "addr", cfg.MetricsAddr, "err", err)
+		}
+		listeners = append(listeners, handoff{metricsFDEnv, mln})
+
+		slog.Info("Serving metrics", "addr", mln.Addr().String())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsSrv = &http.Server{Handler: mux}
+		go func() { serveErr <- metricsSrv.Serve(mln) }()
+	}
+
+	select {
+	case err := <-serveErr:
+		logging.Fatal("Server error", "err", err)
+	case <-waitForStop(listeners):
+	}
+
+	if redirect != nil {
+		redirect.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	shutdown(srv, cfg.ShutdownTimeout)
 }
 
 // handleWS upgrades HTTP to WebSocket
 func handleWS(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logging.FromContext(r.Context()).Warn("WebSocket upgrade failed", "err", err)
 		return
 	}
-	handlers.HandleWebSocket(conn)
+	handlers.HandleWebSocket(conn, r)
+}
+
+// handleAPI registers an API handler with CORS and latency metrics
+func handleAPI(route string, handler http.HandlerFunc) {
+	http.Handle(route, instrument(route, corsMiddleware(handler)))
 }
 
-// corsMiddleware adds CORS headers
+// corsMiddleware adds CORS headers for allowed origins and refuses requests
+// from other origins
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := r.Header.Get("Origin")
+		if !originAllowed(r) {
+			sendOriginForbidden(w, r)
+			return
+		}
+
+		if config.Get().AllowAnyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Secret")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -104,14 +252,28 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// loggingMiddleware logs all requests
+// loggingMiddleware gives each request an ID, returned in X-Request-ID and
+// carried in its context, and logs the request. The query string is left
+// out because it can carry tokens, as are incoming webhook keys.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[REQUEST] %s %s", r.Method, r.URL.RequestURI())
+		id := logging.NewRequestID()
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+
+		slog.Info("Request", "request_id", id, "method", r.Method, "path", logPath(r.URL.Path), "remote", r.RemoteAddr)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// logPath hides the key that ends incoming webhook URLs
+func logPath(path string) string {
+	if strings.HasPrefix(path, "/api/hooks/") {
+		return "/api/hooks/" + logging.Redacted
+	}
+	return path
+}
+
 // spaHandler serves static files and handles SPA routing
 func spaHandler(staticDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sec-chat/server/logging"
+	"sec-chat/server/metrics"
+	"sec-chat/server/tracing"
+)
+
+var httpDuration = metrics.NewHistogramVec("secchat_http_request_duration_seconds",
+	"HTTP request latency by route, method and status code.", metrics.DefBuckets, "route", "method", "code")
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses such as the audit export working
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrument records the latency of requests to route and traces them,
+// continuing a trace passed in a traceparent header. It is not used for /ws,
+// whose connections are hijacked and measured by the hub.
+func instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		method := metricMethod(r.Method)
+		ctx := tracing.ContextWithRemoteParent(r.Context(), tracing.Extract(r.Header))
+		ctx, span := tracing.Start(ctx, method+" "+route,
+			tracing.String("http.method", method),
+			tracing.String("http.route", route),
+			tracing.String("request_id", logging.RequestID(ctx)))
+		span.SetKind(tracing.KindServer)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpDuration.With(route, method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+		span.SetAttributes(tracing.Int("http.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetError(errors.New(http.StatusText(rec.status)))
+		}
+		span.End()
+	})
+}
+
+// metricMethod limits the method label to standard methods
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	cv := r.NewCounterVec("test_frames_total", "Frames received.", "type")
+	cv.With("text").Inc()
+	cv.With("text").Add(2)
+	cv.With("image").Inc()
+	cv.With(`we"ird`).Inc()
+
+	if got := cv.With("text").Value(); got != 3 {
+		t.Errorf("text = %v, want 3", got)
+	}
+
+	want := `# HELP test_frames_total Frames received.
+# TYPE test_frames_total counter
+test_frames_total{type="image"} 1
+test_frames_total{type="text"} 3
+test_frames_total{type="we\"ird"} 1
+`
+	if got := render(t, r); got != want {
+		t.Errorf("output =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	hv := r.NewHistogramVec("test_duration_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h := hv.With("/api")
+	h.Observe(0.05)
+	h.Observe(0.1) // bounds are inclusive
+	h.Observe(0.5)
+	h.Observe(3)
+
+	want := `# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/api",le="0.1"} 2
+test_duration_seconds_bucket{route="/api",le="1"} 3
+test_duration_seconds_bucket{route="/api",le="+Inf"} 4
+test_duration_seconds_sum{route="/api"} 3.65
+test_duration_seconds_count{route="/api"} 4
+`
+	if got := render(t, r); got != want {
+		t.Errorf("output =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFuncMetrics(t *testing.T) {
+	r := NewRegistry()
+	n := 0.0
+	r.NewGaugeFunc("test_clients", "Connected clients.", func() float64 { return n })
+	r.NewCounter("test_plain_total", "Line one\nline two.").Inc()
+
+	n = 7
+	out := render(t, r)
+	for _, line := range []string{
+		"# TYPE test_clients gauge\ntest_clients 7\n",
+		"# HELP test_plain_total Line one\\nline two.\n",
+		"test_plain_total 1\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output missing %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate name should panic")
+		}
+	}()
+	r.NewCounter("test_total", "Again.")
+}
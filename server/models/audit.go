@@ -0,0 +1,41 @@
+package models
+
+// Audit event types
+const (
+	AuditAuthSuccess     = "auth.success"
+	AuditAuthFailure     = "auth.failure"
+	AuditAuthLockout     = "auth.lockout"
+	AuditRecall          = "message.recall"
+	AuditAvatarChange    = "user.avatar"
+	AuditUpload          = "upload"
+	AuditModeration      = "admin.moderation"
+	AuditPasswordRotated = "config.password_rotated"
+	AuditWebhookChange   = "config.webhook"
+	AuditBotChange       = "config.bot"
+	AuditTopicChange     = "room.topic"
+	AuditExport          = "audit.export"
+	AuditPruned          = "audit.prune"
+	AuditAdminCommand    = "admin.command" // Run with the server binary's admin subcommands
+)
+
+// AuditEvent is an entry in the append-only audit log
+type AuditEvent struct {
+	ID         int64             `json:"id"`
+	Time       int64             `json:"time"` // Unix milliseconds
+	Type       string            `json:"type"`
+	ActorID    string            `json:"actorId,omitempty"`  // User who acted, or claimed to for failed auths
+	TargetID   string            `json:"targetId,omitempty"` // User, message or upload acted on
+	RemoteAddr string            `json:"remoteAddr,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditFilter selects audit events; zero fields match everything
+type AuditFilter struct {
+	Type     string
+	ActorID  string
+	TargetID string
+	Since    int64 // Inclusive, Unix milliseconds
+	Until    int64 // Exclusive, Unix milliseconds
+	BeforeID int64 // Only events with a smaller ID, for paging
+	Limit    int   // 0 means no limit
+}
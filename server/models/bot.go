@@ -0,0 +1,44 @@
+package models
+
+import "strings"
+
+// Bot kinds
+const (
+	BotKindAPI     = "bot"     // Posts to /api/bot/messages with its key as a bearer token
+	BotKindWebhook = "webhook" // Posts to /api/hooks/{key}, an incoming webhook URL
+)
+
+// TypeBot marks a message whose content is plaintext posted by a bot rather
+// than ciphertext
+const TypeBot MessageType = "bot"
+
+// BotIDPrefix starts the user IDs bots post under; WebSocket users cannot
+// sign in with such an ID
+const BotIDPrefix = "bot:"
+
+// Bot is an account that posts messages with a key instead of the room
+// password
+type Bot struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`          // One of the BotKind* constants
+	Room      string `json:"room"`          // The room it posts to
+	Key       string `json:"key,omitempty"` // Only returned when created; the store keeps a hash
+	CreatedAt int64  `json:"createdAt"`
+	LastUsed  int64  `json:"lastUsed,omitempty"`
+}
+
+// UserID returns the ID the bot's messages are sent from
+func (b *Bot) UserID() string {
+	return BotIDPrefix + b.ID
+}
+
+// ValidBotKind reports whether kind is a known bot kind
+func ValidBotKind(kind string) bool {
+	return kind == BotKindAPI || kind == BotKindWebhook
+}
+
+// IsBotID reports whether userID belongs to a bot
+func IsBotID(userID string) bool {
+	return strings.HasPrefix(userID, BotIDPrefix)
+}
@@ -0,0 +1,16 @@
+package models
+
+import "testing"
+
+func TestBotUserID(t *testing.T) {
+	b := &Bot{ID: "ci"}
+	if b.UserID() != "bot:ci" || !IsBotID(b.UserID()) {
+		t.Errorf("UserID() = %q, want a bot ID", b.UserID())
+	}
+	if IsBotID("alice") {
+		t.Error("IsBotID() should be false for user IDs")
+	}
+	if !ValidBotKind(BotKindWebhook) || ValidBotKind("human") {
+		t.Error("ValidBotKind() should accept only known kinds")
+	}
+}
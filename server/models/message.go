@@ -28,6 +28,9 @@ type Message struct {
 	ReplyTo   string      `json:"replyTo,omitempty"`
 	Mentions  []string    `json:"mentions,omitempty"`
 	Recalled  bool        `json:"recalled,omitempty"`
+	Width     int         `json:"width,omitempty"`    // Image dimensions, when known
+	Height    int         `json:"height,omitempty"`
+	ThumbURL  string      `json:"thumbUrl,omitempty"` // Server-generated preview
 }
 
 // NewMessage creates a new message with current timestamp
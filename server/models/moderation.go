@@ -0,0 +1,70 @@
+package models
+
+// User roles, from most to least privileged
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Moderation actions
+const (
+	ModKick   = "kick"
+	ModMute   = "mute"
+	ModUnmute = "unmute"
+	ModBan    = "ban"
+	ModUnban  = "unban"
+	ModDelete = "delete"
+	ModRole   = "role"
+)
+
+// ModAction is an entry in the moderation log
+type ModAction struct {
+	ID        int64  `json:"id"`
+	Action    string `json:"action"`
+	ActorID   string `json:"actorId"`
+	TargetID  string `json:"targetId,omitempty"`  // User acted on
+	MessageID string `json:"messageId,omitempty"` // Message deleted
+	Reason    string `json:"reason,omitempty"`
+	Role      string `json:"role,omitempty"`      // New role for role changes
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // End of a mute or ban, 0 if permanent
+	CreatedAt int64  `json:"createdAt"`
+	// StaffKey is the key issued by a promotion to moderator or admin. It is
+	// only returned to the admin who made the change and never stored.
+	StaffKey string `json:"staffKey,omitempty"`
+}
+
+// Ban records that a user may not authenticate
+type Ban struct {
+	UserID    string `json:"userId"`
+	ActorID   string `json:"actorId"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // 0 if permanent
+}
+
+// RoleRank orders roles so that higher ranks may moderate lower ones
+func RoleRank(role string) int {
+	switch role {
+	case RoleAdmin:
+		return 2
+	case RoleModerator:
+		return 1
+	}
+	return 0
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleModerator || role == RoleMember
+}
+
+// CanModerate reports whether the user may use moderator commands
+func (u *User) CanModerate() bool {
+	return RoleRank(u.Role) >= RoleRank(RoleModerator)
+}
+
+// IsMuted reports whether the user is muted at the given Unix millisecond time
+func (u *User) IsMuted(now int64) bool {
+	return u.MutedUntil > now
+}
@@ -0,0 +1,44 @@
+package models
+
+import "testing"
+
+func TestRoleRank(t *testing.T) {
+	if !(RoleRank(RoleAdmin) > RoleRank(RoleModerator) && RoleRank(RoleModerator) > RoleRank(RoleMember)) {
+		t.Error("RoleRank() should order admin > moderator > member")
+	}
+	if RoleRank("") != RoleRank(RoleMember) {
+		t.Error("RoleRank() of an unknown role should equal member")
+	}
+	if ValidRole("owner") || !ValidRole(RoleModerator) {
+		t.Error("ValidRole() should accept only known roles")
+	}
+}
+
+func TestUserCanModerate(t *testing.T) {
+	tests := []struct {
+		role string
+		want bool
+	}{
+		{RoleAdmin, true},
+		{RoleModerator, true},
+		{RoleMember, false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		u := &User{Role: tt.role}
+		if got := u.CanModerate(); got != tt.want {
+			t.Errorf("CanModerate() with role %q = %v, want %v", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestUserIsMuted(t *testing.T) {
+	u := &User{MutedUntil: 1000}
+	if !u.IsMuted(999) {
+		t.Error("IsMuted() should be true before MutedUntil")
+	}
+	if u.IsMuted(1000) {
+		t.Error("IsMuted() should be false once MutedUntil has passed")
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+// Poll is a question members vote on with /poll
+type Poll struct {
+	ID        int64    `json:"id"`
+	Question  string   `json:"question"`
+	Options   []string `json:"options"`
+	Votes     []int    `json:"votes"` // Vote count per option
+	CreatedBy string   `json:"createdBy"`
+	CreatedAt int64    `json:"createdAt"`
+	Closed    bool     `json:"closed,omitempty"`
+}
+
+// Total returns the number of votes cast
+func (p *Poll) Total() int {
+	total := 0
+	for _, n := range p.Votes {
+		total += n
+	}
+	return total
+}
+
+// BotCommand is a chat command a bot registered; running it posts the
+// invocation to the bot's URL
+type BotCommand struct {
+	Name      string `json:"name"`
+	BotID     string `json:"botId"`
+	Usage     string `json:"usage,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	Role      string `json:"role"` // Least role allowed to run it
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"` // Signs invocations; only returned when registered
+	CreatedAt int64  `json:"createdAt"`
+}
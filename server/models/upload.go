@@ -0,0 +1,19 @@
+package models
+
+// Upload reference owner types
+const (
+	UploadRefMessage = "message"
+	UploadRefAvatar  = "avatar"
+)
+
+// Upload represents a stored file, addressed by the SHA-256 of its content
+type Upload struct {
+	Name      string `json:"name"` // <sha256 hex><ext>
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"createdAt"`
+	RefCount  int    `json:"refCount"`
+	Width     int    `json:"width,omitempty"` // Set for unencrypted images only
+	Height    int    `json:"height,omitempty"`
+	Thumb     string `json:"thumb,omitempty"` // Thumbnail filename in the upload dir
+}
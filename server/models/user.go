@@ -2,6 +2,14 @@ package models
 
 import "time"
 
+// Presence states a user can choose
+const (
+	PresenceOnline    = "online"
+	PresenceAway      = "away"
+	PresenceDND       = "dnd"
+	PresenceInvisible = "invisible"
+)
+
 // User represents a chat user
 type User struct {
 	ID        string `json:"id"`
@@ -9,6 +17,21 @@ type User struct {
 	Avatar    string `json:"avatar"`
 	Online    bool   `json:"online"`
 	LastSeen  int64  `json:"lastSeen"`
+	Status    string `json:"status,omitempty"`   // Free-form status message
+	Timezone  string `json:"timezone,omitempty"` // IANA zone name, e.g. Asia/Shanghai
+	Presence  string `json:"presence,omitempty"` // One of the Presence* states
+	Role      string `json:"role,omitempty"`     // One of the Role* constants
+	// MutedUntil is a Unix millisecond time; it is changed only through
+	// moderation and never written by SaveUser
+	MutedUntil int64 `json:"mutedUntil,omitempty"`
+}
+
+// NameChange records a display name change
+type NameChange struct {
+	UserID    string `json:"userId"`
+	OldName   string `json:"oldName"`
+	NewName   string `json:"newName"`
+	ChangedAt int64  `json:"changedAt"`
 }
 
 // NewUser creates a new user
@@ -19,7 +42,18 @@ func NewUser(id, name string) *User {
 		Avatar:   "",
 		Online:   true,
 		LastSeen: time.Now().UnixMilli(),
+		Presence: PresenceOnline,
+		Role:     RoleMember,
+	}
+}
+
+// ValidPresence reports whether state is a presence a user may choose
+func ValidPresence(state string) bool {
+	switch state {
+	case PresenceOnline, PresenceAway, PresenceDND, PresenceInvisible:
+		return true
 	}
+	return false
 }
 
 // SetOnline updates user online status
@@ -60,3 +60,19 @@ func TestUserAvatar(t *testing.T) {
 		t.Errorf("Avatar not set correctly. Got %v, want %v", user.Avatar, avatarURL)
 	}
 }
+
+func TestValidPresence(t *testing.T) {
+	for _, state := range []string{PresenceOnline, PresenceAway, PresenceDND, PresenceInvisible} {
+		if !ValidPresence(state) {
+			t.Errorf("ValidPresence(%q) = false, want true", state)
+		}
+	}
+	for _, state := range []string{"", "offline", "ONLINE"} {
+		if ValidPresence(state) {
+			t.Errorf("ValidPresence(%q) = true, want false", state)
+		}
+	}
+	if u := NewUser("user1", "Test"); u.Presence != PresenceOnline {
+		t.Errorf("NewUser() Presence = %q, want %q", u.Presence, PresenceOnline)
+	}
+}
@@ -0,0 +1,72 @@
+package models
+
+import "strings"
+
+// Webhook event types
+const (
+	EventMessageCreated  = "message.created"
+	EventMessageRecalled = "message.recalled"
+	EventUserJoined      = "user.joined"
+	EventUserLeft        = "user.left"
+	EventUploadCreated   = "upload.created"
+)
+
+// WebhookEvents lists the event types webhooks can subscribe to
+var WebhookEvents = []string{
+	EventMessageCreated,
+	EventMessageRecalled,
+	EventUserJoined,
+	EventUserLeft,
+	EventUploadCreated,
+}
+
+// MainRoom names the server's single chat room in webhook events
+const MainRoom = "main"
+
+// ValidWebhookEvent reports whether t is a known event type
+func ValidWebhookEvent(t string) bool {
+	for _, e := range WebhookEvents {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is an outgoing webhook subscription
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"` // HMAC-SHA256 key; only returned when created
+	Events    []string `json:"events"`           // Empty means every event
+	Room      string   `json:"room,omitempty"`   // Empty means every room
+	CreatedAt int64    `json:"createdAt"`
+}
+
+// Matches reports whether the webhook subscribes to events of type t in room
+func (h *Webhook) Matches(t, room string) bool {
+	if h.Room != "" && !strings.EqualFold(h.Room, room) {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// DeadLetter is a webhook delivery that failed every attempt
+type DeadLetter struct {
+	ID        int64  `json:"id"`
+	WebhookID string `json:"webhookId"`
+	EventID   string `json:"eventId"`
+	EventType string `json:"eventType"`
+	Payload   string `json:"payload"` // The JSON body that was posted
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		hook Webhook
+		typ  string
+		want bool
+	}{
+		{Webhook{}, EventUserJoined, true},
+		{Webhook{Events: []string{EventMessageCreated}}, EventMessageCreated, true},
+		{Webhook{Events: []string{EventMessageCreated}}, EventMessageRecalled, false},
+		{Webhook{Room: MainRoom}, EventUploadCreated, true},
+		{Webhook{Room: "ops"}, EventUploadCreated, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.hook.Matches(tt.typ, MainRoom); got != tt.want {
+			t.Errorf("Matches(%s) with events %v, room %q = %v, want %v",
+				tt.typ, tt.hook.Events, tt.hook.Room, got, tt.want)
+		}
+	}
+	if ValidWebhookEvent("message.edited") || !ValidWebhookEvent(EventUserLeft) {
+		t.Error("ValidWebhookEvent() should accept only known event types")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sec-chat/server/config"
+)
+
+// setupConfig publishes the default configuration with args applied
+func setupConfig(t *testing.T, args ...string) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := config.Load(fs, append([]string{"-password", "pw"}, args...)); err != nil {
+		t.Fatalf("config.Load() error = %v", err)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		origin string
+		want   bool
+	}{
+		{name: "no origin", origin: "", want: true},
+		{name: "same origin", origin: "https://chat.example.com", want: true},
+		{name: "same host over another scheme", origin: "http://chat.example.com", want: true},
+		{name: "same host in mixed case", origin: "https://Chat.Example.COM", want: true},
+		{name: "same host on another port", origin: "https://chat.example.com:8443", want: false},
+		{name: "other origin", origin: "https://evil.example.com", want: false},
+		{name: "null origin", origin: "null", want: false},
+		{name: "suffix of own host", origin: "https://chat.example.com.evil.net", want: false},
+		{name: "listed", args: []string{"-allowed-origins", "https://app.example.com"}, origin: "https://app.example.com", want: true},
+		{name: "listed with trailing slash", args: []string{"-allowed-origins", "https://app.example.com"}, origin: "https://app.example.com/", want: true},
+		{name: "listed in mixed case", args: []string{"-allowed-origins", "HTTPS://App.Example.com/"}, origin: "https://APP.example.com", want: true},
+		{name: "listed with default port", args: []string{"-allowed-origins", "https://app.example.com"}, origin: "https://app.example.com:443", want: true},
+		{name: "listed on another scheme", args: []string{"-allowed-origins", "https://app.example.com"}, origin: "http://app.example.com", want: false},
+		{name: "listed with a path", args: []string{"-allowed-origins", "https://app.example.com"}, origin: "https://app.example.com/x", want: false},
+		{name: "any origin", args: []string{"-allow-any-origin"}, origin: "https://evil.example.com", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.args...)
+			r := httptest.NewRequest(http.MethodGet, "https://chat.example.com/api/members", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := originAllowed(r); got != tt.want {
+				t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		method     string
+		origin     string
+		wantStatus int
+		wantAllow  string
+		wantServed bool
+	}{
+		{name: "no origin", method: http.MethodGet, wantStatus: http.StatusOK, wantServed: true},
+		{name: "same origin", method: http.MethodGet, origin: "https://chat.example.com", wantStatus: http.StatusOK, wantAllow: "https://chat.example.com", wantServed: true},
+		{name: "forbidden", method: http.MethodPost, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "forbidden preflight", method: http.MethodOptions, origin: "https://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "listed preflight", args: []string{"-allowed-origins", "https://app.example.com"}, method: http.MethodOptions, origin: "https://app.example.com/", wantStatus: http.StatusOK, wantAllow: "https://app.example.com/"},
+		{name: "any origin", args: []string{"-allow-any-origin"}, method: http.MethodGet, origin: "https://evil.example.com", wantStatus: http.StatusOK, wantAllow: "*", wantServed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.args...)
+			served := false
+			h := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+			}))
+			r := httptest.NewRequest(tt.method, "https://chat.example.com/api/members", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if served != tt.wantServed {
+				t.Errorf("handler called = %v, want %v", served, tt.wantServed)
+			}
+			if tt.wantAllow != "" && tt.wantAllow != "*" && rec.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin for an echoed origin", rec.Header().Get("Vary"))
+			}
+		})
+	}
+}
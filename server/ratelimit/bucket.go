@@ -0,0 +1,56 @@
+package ratelimit
+
+import "time"
+
+// Bucket is a token bucket refilled at a steady rate. It is not safe for
+// concurrent use; each WebSocket client owns its buckets.
+type Bucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now func() time.Time
+}
+
+// NewBucket creates a full bucket holding up to burst tokens and refilled
+// with rate tokens per second
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+	b.last = b.now()
+	return b
+}
+
+// Allow takes a token if one is available
+func (b *Bucket) Allow() bool {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// SetRate changes the refill rate and burst. Tokens earned so far are kept,
+// up to the new burst.
+func (b *Bucket) SetRate(rate float64, burst int) {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
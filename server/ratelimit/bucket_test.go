@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := NewBucket(2, 3)
+	b.now = clock.now
+	b.last = clock.t
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() #%d should use the burst", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("Allow() should refuse once the burst is spent")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("Allow() should pass after refilling one token")
+	}
+	if b.Allow() {
+		t.Error("Allow() should refuse until the next token")
+	}
+
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() #%d should pass after a long idle", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Error("refill should be capped at the burst")
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := NewBucket(1, 10)
+	b.now = clock.now
+	b.last = clock.t
+
+	b.SetRate(4, 2)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() #%d should use the new burst", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("tokens should be capped at the new burst")
+	}
+
+	clock.advance(250 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("Allow() should refill at the new rate")
+	}
+}
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GuardOptions configures a Guard
+type GuardOptions struct {
+	// BaseDelay is the wait imposed after the first failure; it doubles with
+	// every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter failures lock the key out for LockoutDuration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Forget drops the failure count of a key that has not failed for this long
+	Forget time.Duration
+}
+
+// Guard tracks failed attempts per key (an IP address or user ID) and
+// enforces exponential backoff with a temporary lockout
+type Guard struct {
+	opts     GuardOptions
+	mu       sync.Mutex
+	entries  map[string]*attempts
+	lockouts atomic.Uint64
+	ops      int
+
+	now func() time.Time
+}
+
+type attempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// NewGuard creates a Guard
+func NewGuard(opts GuardOptions) *Guard {
+	return &Guard{
+		opts:    opts,
+		entries: make(map[string]*attempts),
+		now:     time.Now,
+	}
+}
+
+// Allow reports whether key may attempt now, and if not, how long to wait
+func (g *Guard) Allow(key string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	a, ok := g.entries[key]
+	if !ok {
+		return 0, true
+	}
+	if wait := a.blockedUntil.Sub(g.now()); wait > 0 {
+		return wait, false
+	}
+	return 0, true
+}
+
+// Fail records a failed attempt for key and reports whether it caused a lockout
+func (g *Guard) Fail(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.prune(now)
+
+	a, ok := g.entries[key]
+	if !ok || now.Sub(a.lastFailure) > g.opts.Forget {
+		a = &attempts{}
+		g.entries[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if g.opts.LockoutAfter > 0 && a.failures >= g.opts.LockoutAfter {
+		a.blockedUntil = now.Add(g.opts.LockoutDuration)
+		a.failures = 0
+		g.lockouts.Add(1)
+		return true
+	}
+
+	delay := g.opts.BaseDelay << (a.failures - 1)
+	if delay > g.opts.MaxDelay || delay <= 0 {
+		delay = g.opts.MaxDelay
+	}
+	a.blockedUntil = now.Add(delay)
+	return false
+}
+
+// Succeed clears the failures recorded for key
+func (g *Guard) Succeed(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, key)
+}
+
+// Lockouts returns the number of lockouts since the Guard was created
+func (g *Guard) Lockouts() uint64 {
+	return g.lockouts.Load()
+}
+
+// prune drops forgotten entries every so often so the map stays bounded by
+// recent attackers (caller must hold mu)
+func (g *Guard) prune(now time.Time) {
+	g.ops++
+	if g.ops < 1000 {
+		return
+	}
+	g.ops = 0
+	for key, a := range g.entries {
+		if now.After(a.blockedUntil) && now.Sub(a.lastFailure) > g.opts.Forget {
+			delete(g.entries, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+func newTestGuard(clock *fakeClock) *Guard {
+	g := NewGuard(GuardOptions{
+		BaseDelay:       time.Second,
+		MaxDelay:        8 * time.Second,
+		LockoutAfter:    6,
+		LockoutDuration: time.Minute,
+		Forget:          time.Hour,
+	})
+	g.now = clock.now
+	return g
+}
+
+func TestGuardBackoff(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	g := newTestGuard(clock)
+
+	if _, ok := g.Allow("ip"); !ok {
+		t.Fatal("Allow() should allow a key with no failures")
+	}
+
+	for i, want := range []time.Duration{1, 2, 4, 8, 8} {
+		if g.Fail("ip") {
+			t.Fatalf("Fail() #%d should not lock out yet", i+1)
+		}
+		wait, ok := g.Allow("ip")
+		if ok || wait != want*time.Second {
+			t.Errorf("after failure %d Allow() = %v, %v, want %v, false", i+1, wait, ok, want*time.Second)
+		}
+		clock.advance(wait)
+		if _, ok := g.Allow("ip"); !ok {
+			t.Errorf("after failure %d Allow() should pass once the delay elapsed", i+1)
+		}
+	}
+
+	if _, ok := g.Allow("other"); !ok {
+		t.Error("failures of one key should not affect another")
+	}
+}
+
+func TestGuardLockout(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	g := newTestGuard(clock)
+
+	locked := false
+	for i := 0; i < 6; i++ {
+		locked = g.Fail("user")
+	}
+	if !locked {
+		t.Fatal("Fail() should report a lockout on the sixth failure")
+	}
+	if g.Lockouts() != 1 {
+		t.Errorf("Lockouts() = %d, want 1", g.Lockouts())
+	}
+	if wait, ok := g.Allow("user"); ok || wait != time.Minute {
+		t.Errorf("Allow() = %v, %v, want 1m, false", wait, ok)
+	}
+
+	clock.advance(time.Minute)
+	if _, ok := g.Allow("user"); !ok {
+		t.Error("Allow() should pass after the lockout")
+	}
+}
+
+func TestGuardSucceedAndForget(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	g := newTestGuard(clock)
+
+	g.Fail("a")
+	g.Succeed("a")
+	if _, ok := g.Allow("a"); !ok {
+		t.Error("Succeed() should clear the backoff")
+	}
+
+	g.Fail("b")
+	g.Fail("b")
+	clock.advance(2 * time.Hour)
+	g.Fail("b")
+	if wait, _ := g.Allow("b"); wait != time.Second {
+		t.Errorf("failures older than Forget should reset the backoff, wait = %v", wait)
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Tally counts events per key in fixed windows so that a caller can act on
+// the first event of each window and summarize the rest
+type Tally struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]*tally
+	ops     int
+
+	now func() time.Time
+}
+
+type tally struct {
+	start time.Time
+	count int
+}
+
+// NewTally creates a Tally with the given window
+func NewTally(window time.Duration) *Tally {
+	return &Tally{
+		window:  window,
+		entries: make(map[string]*tally),
+		now:     time.Now,
+	}
+}
+
+// Record counts an event for key. It reports whether the event opened a new
+// window for key and, if so, how many events the previous window held after
+// its first. Counts of windows that end without a further event for their
+// key are dropped once pruned.
+func (t *Tally) Record(key string) (first bool, suppressed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	e, ok := t.entries[key]
+	if ok && now.Sub(e.start) < t.window {
+		e.count++
+		return false, 0
+	}
+	if ok {
+		suppressed = e.count - 1
+	}
+	t.entries[key] = &tally{start: now, count: 1}
+	return true, suppressed
+}
+
+// prune drops entries whose window ended long ago every so often, so the
+// map stays bounded by recent keys (caller must hold mu)
+func (t *Tally) prune(now time.Time) {
+	t.ops++
+	if t.ops < 1000 {
+		return
+	}
+	t.ops = 0
+	for key, e := range t.entries {
+		if now.Sub(e.start) > 2*t.window {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTallyWindows(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	tl := NewTally(time.Minute)
+	tl.now = clock.now
+
+	if first, _ := tl.Record("ip"); !first {
+		t.Fatal("Record() should open a window for a new key")
+	}
+	for i := 0; i < 4; i++ {
+		clock.advance(time.Second)
+		if first, _ := tl.Record("ip"); first {
+			t.Fatalf("Record() #%d inside the window should not open a new one", i+2)
+		}
+	}
+	if first, _ := tl.Record("other"); !first {
+		t.Error("keys should have windows of their own")
+	}
+
+	clock.advance(time.Minute)
+	first, suppressed := tl.Record("ip")
+	if !first || suppressed != 4 {
+		t.Errorf("Record() after the window = %v, %d, want true, 4", first, suppressed)
+	}
+
+	clock.advance(time.Minute)
+	if first, suppressed := tl.Record("ip"); !first || suppressed != 0 {
+		t.Errorf("Record() after a window with one event = %v, %d, want true, 0", first, suppressed)
+	}
+}
+
+func TestTallyPrune(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	tl := NewTally(time.Minute)
+	tl.now = clock.now
+
+	tl.Record("old")
+	clock.advance(time.Hour)
+	for i := 0; i < 1000; i++ {
+		tl.Record("new")
+	}
+	if _, ok := tl.entries["old"]; ok {
+		t.Error("prune should drop keys whose window ended long ago")
+	}
+}
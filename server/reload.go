@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"sec-chat/server/config"
+	"sec-chat/server/tlscert"
+)
+
+// watchHangup reloads the configuration on SIGHUP, and the TLS certificate
+// too when certs is not nil
+func watchHangup(certs *tlscert.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := config.Reload(); err != nil {
+			slog.Error("Failed to reload configuration, keeping the current one", "err", err)
+		}
+		if certs != nil {
+			reloadCertificate(certs)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"sec-chat/server/handlers"
+	"sec-chat/server/store"
+	"sec-chat/server/tracing"
+	"sec-chat/server/webhook"
+)
+
+// Environment variables naming the inherited file descriptors of the
+// listening sockets when a running server hands them over to its replacement
+const (
+	listenerFDEnv = "SECCHAT_LISTENER_FD"
+	redirectFDEnv = "SECCHAT_REDIRECT_FD"
+	metricsFDEnv  = "SECCHAT_METRICS_FD"
+)
+
+// handoff is a listening socket passed to a replacement process under env
+type handoff struct {
+	env string
+	ln  net.Listener
+}
+
+// listen returns the listening socket inherited from a previous process
+// under env, or a new one on addr
+func listen(addr, env string) (net.Listener, error) {
+	fdStr := os.Getenv(env)
+	if fdStr == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	slog.Info("Using listener inherited from the previous process", "addr", addr)
+	return net.FileListener(f)
+}
+
+// waitForStop returns a channel that is closed when the server should shut
+// down: on SIGINT or SIGTERM, or after the upgrade signal has started a
+// replacement process that inherited the listeners
+func waitForStop(listeners []handoff) <-chan struct{} {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, upgradeSignals...)...)
+
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				slog.Info("Shutting down", "signal", sig.String())
+				break
+			}
+			if err := startUpgrade(listeners); err != nil {
+				slog.Error("Upgrade failed, continuing to serve", "err", err)
+				continue
+			}
+			slog.Info("Replacement process started, shutting down")
+			break
+		}
+		signal.Stop(sigs)
+		close(stop)
+	}()
+	return stop
+}
+
+// shutdown stops accepting connections, lets WebSocket clients know to
+// reconnect, drains their queues and in-flight requests, then closes the store
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Closes the listener and waits for REST requests; hijacked WebSocket
+	// connections are not tracked by the server and are handled by the hub
+	httpDone := make(chan error, 1)
+	go func() { httpDone <- srv.Shutdown(ctx) }()
+
+	if err := handlers.GetHub().Shutdown(ctx); err != nil {
+		slog.Warn("WebSocket clients did not disconnect in time", "err", err)
+	}
+	if err := <-httpDone; err != nil {
+		slog.Warn("HTTP shutdown incomplete", "err", err)
+	}
+
+	if err := webhook.Shutdown(ctx); err != nil {
+		slog.Warn("Webhook deliveries did not finish in time", "err", err)
+	}
+	if err := tracing.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush trace spans", "err", err)
+	}
+	if err := store.Get().Close(); err != nil {
+		slog.Error("Failed to close database", "err", err)
+	}
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// AppendAudit adds an event to the audit log. The table has triggers that
+// reject updates and deletes, so entries cannot be changed once written;
+// only PruneAudit removes events, and only past the retention window.
+func (s *Store) AppendAudit(e *models.AuditEvent) error {
+	defer s.observe("AppendAudit", time.Now())
+
+	var details []byte
+	if len(e.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO audit_log (time, type, actor_id, target_id, remote_addr, details)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, e.Time, e.Type, e.ActorID, e.TargetID, e.RemoteAddr, string(details))
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// QueryAudit returns the audit events matching f, newest first
+func (s *Store) QueryAudit(f models.AuditFilter) ([]*models.AuditEvent, error) {
+	defer s.observe("QueryAudit", time.Now())
+
+	var where []string
+	var args []interface{}
+	if f.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, f.Type)
+	}
+	if f.ActorID != "" {
+		where = append(where, "actor_id = ?")
+		args = append(args, f.ActorID)
+	}
+	if f.TargetID != "" {
+		where = append(where, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if f.Since > 0 {
+		where = append(where, "time >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "time < ?")
+		args = append(args, f.Until)
+	}
+	if f.BeforeID > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.BeforeID)
+	}
+
+	query := "SELECT id, time, type, actor_id, target_id, remote_addr, details FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*models.AuditEvent, 0)
+	for rows.Next() {
+		e := &models.AuditEvent{}
+		var actorID, targetID, remoteAddr, details sql.NullString
+		if err := rows.Scan(&e.ID, &e.Time, &e.Type, &actorID, &targetID, &remoteAddr, &details); err != nil {
+			return nil, err
+		}
+		e.ActorID = actorID.String
+		e.TargetID = targetID.String
+		e.RemoteAddr = remoteAddr.String
+		if details.String != "" {
+			json.Unmarshal([]byte(details.String), &e.Details)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// PruneAudit deletes audit events older than before (Unix milliseconds) and
+// returns how many were removed. It first raises the retention floor that
+// the delete trigger checks; the floor never moves back.
+func (s *Store) PruneAudit(before int64) (int64, error) {
+	defer s.observe("PruneAudit", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO settings (key, value) VALUES ('audit_pruned_before', ?)
+		ON CONFLICT(key) DO UPDATE SET value = MAX(CAST(value AS INTEGER), CAST(excluded.value AS INTEGER))
+	`, before)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM audit_log WHERE time < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// SaveBot adds a bot with the hash of its key
+func (s *Store) SaveBot(b *models.Bot, keyHash string) error {
+	defer s.observe("SaveBot", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO bots (id, name, kind, room, key_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, b.ID, b.Name, b.Kind, b.Room, keyHash, b.CreatedAt)
+
+	return err
+}
+
+// GetBots returns every bot, oldest first
+func (s *Store) GetBots() ([]*models.Bot, error) {
+	defer s.observe("GetBots", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, name, kind, room, created_at, last_used
+		FROM bots
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []*models.Bot
+	for rows.Next() {
+		b, err := scanBot(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, b)
+	}
+	return bots, rows.Err()
+}
+
+// GetBotByKey returns the bot whose key hashes to keyHash, or nil if none
+func (s *Store) GetBotByKey(keyHash string) (*models.Bot, error) {
+	defer s.observe("GetBotByKey", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, name, kind, room, created_at, last_used
+		FROM bots
+		WHERE key_hash = ?
+	`, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanBot(rows)
+}
+
+// TouchBot records when a bot last posted
+func (s *Store) TouchBot(id string, now int64) error {
+	defer s.observe("TouchBot", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE bots SET last_used = ? WHERE id = ?", now, id)
+	return err
+}
+
+// DeleteBot removes a bot, revoking its key, along with the commands it
+// registered, and reports whether it existed. Its messages are kept.
+func (s *Store) DeleteBot(id string) (bool, error) {
+	defer s.observe("DeleteBot", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM bot_commands WHERE bot_id = ?", id); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("DELETE FROM bots WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// SaveBotCommand registers a bot command, replacing the bot's earlier
+// registration of the same name
+func (s *Store) SaveBotCommand(cmd *models.BotCommand) error {
+	defer s.observe("SaveBotCommand", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO bot_commands (name, bot_id, usage, summary, role, url, secret, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, cmd.Name, cmd.BotID, cmd.Usage, cmd.Summary, cmd.Role, cmd.URL, cmd.Secret, cmd.CreatedAt)
+
+	return err
+}
+
+// GetBotCommand returns the bot command with the given name, secret
+// included, or nil if there is none
+func (s *Store) GetBotCommand(name string) (*models.BotCommand, error) {
+	defer s.observe("GetBotCommand", time.Now())
+
+	cmds, err := s.queryBotCommands("WHERE name = ?", name)
+	if err != nil || len(cmds) == 0 {
+		return nil, err
+	}
+	return cmds[0], nil
+}
+
+// GetBotCommands returns the registered bot commands, secrets included, by
+// name; with a botID, only that bot's
+func (s *Store) GetBotCommands(botID string) ([]*models.BotCommand, error) {
+	defer s.observe("GetBotCommands", time.Now())
+
+	if botID != "" {
+		return s.queryBotCommands("WHERE bot_id = ? ORDER BY name", botID)
+	}
+	return s.queryBotCommands("ORDER BY name")
+}
+
+// DeleteBotCommand removes a command the bot registered, reporting whether
+// it existed
+func (s *Store) DeleteBotCommand(name, botID string) (bool, error) {
+	defer s.observe("DeleteBotCommand", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM bot_commands WHERE name = ? AND bot_id = ?", name, botID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// queryBotCommands returns the bot commands selected by the clause
+func (s *Store) queryBotCommands(clause string, args ...interface{}) ([]*models.BotCommand, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT name, bot_id, usage, summary, role, url, secret, created_at
+		FROM bot_commands `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cmds []*models.BotCommand
+	for rows.Next() {
+		cmd := &models.BotCommand{}
+		var usage, summary sql.NullString
+		if err := rows.Scan(&cmd.Name, &cmd.BotID, &usage, &summary, &cmd.Role, &cmd.URL,
+			&cmd.Secret, &cmd.CreatedAt); err != nil {
+			return nil, err
+		}
+		cmd.Usage, cmd.Summary = usage.String, summary.String
+		cmds = append(cmds, cmd)
+	}
+	return cmds, rows.Err()
+}
+
+// scanBot reads a bot from the current row
+func scanBot(rows *sql.Rows) (*models.Bot, error) {
+	b := &models.Bot{}
+	var lastUsed sql.NullInt64
+	if err := rows.Scan(&b.ID, &b.Name, &b.Kind, &b.Room, &b.CreatedAt, &lastUsed); err != nil {
+		return nil, err
+	}
+	b.LastUsed = lastUsed.Int64
+	return b, nil
+}
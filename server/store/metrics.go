@@ -0,0 +1,21 @@
+package store
+
+import (
+	"time"
+
+	"sec-chat/server/metrics"
+	"sec-chat/server/tracing"
+)
+
+// queryDuration measures exported Store methods, labelled by method name
+var queryDuration = metrics.NewHistogramVec("secchat_store_query_duration_seconds",
+	"Time spent in SQLite store operations.", metrics.DefBuckets, "method")
+
+// observe records how long the Store method started at start took, and
+// traces it when the store was obtained through WithContext
+func (s *Store) observe(method string, start time.Time) {
+	queryDuration.With(method).Observe(time.Since(start).Seconds())
+	if s.ctx != nil {
+		tracing.Record(s.ctx, "store."+method, start, tracing.String("db.system", "sqlite"))
+	}
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// roleOrDefault treats users stored before roles existed as members
+func roleOrDefault(role string) string {
+	if role == "" {
+		return models.RoleMember
+	}
+	return role
+}
+
+// SetUserRole changes a user's role
+func (s *Store) SetUserRole(id, role string) error {
+	defer s.observe("SetUserRole", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+	return err
+}
+
+// SetStaffKey stores the hash of the key a moderator or admin must present
+// to authenticate; an empty hash removes it
+func (s *Store) SetStaffKey(id, keyHash string) error {
+	defer s.observe("SetStaffKey", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE users SET staff_key_hash = ? WHERE id = ?", keyHash, id)
+	return err
+}
+
+// GetStaffKey returns the hash of the user's staff key, or "" if none is set
+func (s *Store) GetStaffKey(id string) (string, error) {
+	defer s.observe("GetStaffKey", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keyHash sql.NullString
+	err := s.db.QueryRow("SELECT staff_key_hash FROM users WHERE id = ?", id).Scan(&keyHash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return keyHash.String, err
+}
+
+// HasAdmin reports whether any user has the admin role
+func (s *Store) HasAdmin() (bool, error) {
+	defer s.observe("HasAdmin", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", models.RoleAdmin).Scan(&n)
+	return n > 0, err
+}
+
+// SetMute mutes a user until the given Unix millisecond time; 0 unmutes
+func (s *Store) SetMute(id string, until int64) error {
+	defer s.observe("SetMute", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE users SET muted_until = ? WHERE id = ?", until, id)
+	return err
+}
+
+// BanUser bans a user, replacing any existing ban
+func (s *Store) BanUser(ban *models.Ban) error {
+	defer s.observe("BanUser", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO bans (user_id, actor_id, reason, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, ban.UserID, ban.ActorID, ban.Reason, ban.CreatedAt, ban.ExpiresAt)
+	return err
+}
+
+// UnbanUser lifts a user's ban
+func (s *Store) UnbanUser(userID string) error {
+	defer s.observe("UnbanUser", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM bans WHERE user_id = ?", userID)
+	return err
+}
+
+// GetBan returns the ban in effect for a user at now, or nil
+func (s *Store) GetBan(userID string, now int64) (*models.Ban, error) {
+	defer s.observe("GetBan", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ban := &models.Ban{}
+	var reason sql.NullString
+	err := s.db.QueryRow(`
+		SELECT user_id, actor_id, reason, created_at, expires_at FROM bans
+		WHERE user_id = ? AND (expires_at = 0 OR expires_at > ?)
+	`, userID, now).Scan(&ban.UserID, &ban.ActorID, &reason, &ban.CreatedAt, &ban.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ban.Reason = reason.String
+	return ban, nil
+}
+
+// DeleteMessage removes a message permanently
+func (s *Store) DeleteMessage(id string) error {
+	defer s.observe("DeleteMessage", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM messages WHERE id = ?", id)
+	return err
+}
+
+// PurgeUserMessages permanently removes every message sent by a user,
+// with their upload references, and returns how many were removed
+func (s *Store) PurgeUserMessages(userID string) (int64, error) {
+	defer s.observe("PurgeUserMessages", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM upload_refs
+		WHERE ref_type = ? AND ref_id IN (SELECT id FROM messages WHERE from_id = ?)
+	`, models.UploadRefMessage, userID); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM messages WHERE from_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// LogModAction appends an entry to the moderation log
+func (s *Store) LogModAction(a *models.ModAction) error {
+	defer s.observe("LogModAction", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO mod_log (action, actor_id, target_id, message_id, reason, role, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.Action, a.ActorID, a.TargetID, a.MessageID, a.Reason, a.Role, a.ExpiresAt, a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	a.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// GetModLog returns moderation log entries newest first, before the given ID
+// when beforeID is positive
+func (s *Store) GetModLog(beforeID int64, limit int) ([]*models.ModAction, error) {
+	defer s.observe("GetModLog", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	query := `SELECT id, action, actor_id, target_id, message_id, reason, role, expires_at, created_at FROM mod_log`
+	args := []interface{}{}
+	if beforeID > 0 {
+		query += " WHERE id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*models.ModAction, 0)
+	for rows.Next() {
+		a := &models.ModAction{}
+		var targetID, messageID, reason, role sql.NullString
+		if err := rows.Scan(&a.ID, &a.Action, &a.ActorID, &targetID, &messageID, &reason, &role, &a.ExpiresAt, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.TargetID = targetID.String
+		a.MessageID = messageID.String
+		a.Reason = reason.String
+		a.Role = role.String
+		entries = append(entries, a)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// CreatePoll saves a new poll and sets its ID
+func (s *Store) CreatePoll(p *models.Poll) error {
+	defer s.observe("CreatePoll", time.Now())
+
+	options, err := json.Marshal(p.Options)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO polls (question, options, created_by, created_at)
+		VALUES (?, ?, ?, ?)
+	`, p.Question, string(options), p.CreatedBy, p.CreatedAt)
+	if err != nil {
+		return err
+	}
+	p.ID, _ = res.LastInsertId()
+	p.Votes = make([]int, len(p.Options))
+	return nil
+}
+
+// GetPoll returns a poll with its vote counts, or nil if there is none
+func (s *Store) GetPoll(id int64) (*models.Poll, error) {
+	defer s.observe("GetPoll", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	p := &models.Poll{ID: id}
+	var options string
+	err := s.db.QueryRow(`
+		SELECT question, options, created_by, created_at, closed
+		FROM polls WHERE id = ?
+	`, id).Scan(&p.Question, &options, &p.CreatedBy, &p.CreatedAt, &p.Closed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(options), &p.Options); err != nil {
+		return nil, err
+	}
+
+	p.Votes = make([]int, len(p.Options))
+	rows, err := s.db.Query("SELECT option, COUNT(*) FROM poll_votes WHERE poll_id = ? GROUP BY option", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var option, count int
+		if err := rows.Scan(&option, &count); err != nil {
+			return nil, err
+		}
+		if option >= 0 && option < len(p.Votes) {
+			p.Votes[option] = count
+		}
+	}
+	return p, rows.Err()
+}
+
+// VotePoll records a user's vote for an option, given by index, replacing
+// their earlier vote
+func (s *Store) VotePoll(pollID int64, userID string, option int) error {
+	defer s.observe("VotePoll", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO poll_votes (poll_id, user_id, option)
+		VALUES (?, ?, ?)
+	`, pollID, userID, option)
+
+	return err
+}
+
+// ClosePoll stops a poll from taking votes
+func (s *Store) ClosePoll(id int64) error {
+	defer s.observe("ClosePoll", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE polls SET closed = 1 WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,73 @@
+package store
+
+import "time"
+
+// SaveSession stores a REST session token hash for a user
+func (s *Store) SaveSession(tokenHash, userID string, expiresAt int64) error {
+	defer s.observe("SaveSession", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO sessions (token_hash, user_id, expires_at)
+		VALUES (?, ?, ?)
+	`, tokenHash, userID, expiresAt)
+
+	return err
+}
+
+// GetSessionUser returns the user ID of an unexpired session, or "" if none
+func (s *Store) GetSessionUser(tokenHash string, now int64) (string, error) {
+	defer s.observe("GetSessionUser", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query("SELECT user_id FROM sessions WHERE token_hash = ? AND expires_at > ?", tokenHash, now)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var userID string
+	if rows.Next() {
+		if err := rows.Scan(&userID); err != nil {
+			return "", err
+		}
+	}
+	return userID, rows.Err()
+}
+
+// DeleteExpiredSessions removes sessions that expired before now
+func (s *Store) DeleteExpiredSessions(now int64) error {
+	defer s.observe("DeleteExpiredSessions", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now)
+	return err
+}
+
+// DeleteUserSessions signs a user out of the REST API
+func (s *Store) DeleteUserSessions(userID string) error {
+	defer s.observe("DeleteUserSessions", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DeleteAllSessions signs every user out of the REST API
+func (s *Store) DeleteAllSessions() error {
+	defer s.observe("DeleteAllSessions", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM sessions")
+	return err
+}
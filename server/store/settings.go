@@ -0,0 +1,32 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetSetting returns a stored server setting, or "" if it is not set
+func (s *Store) GetSetting(key string) (string, error) {
+	defer s.observe("GetSetting", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var value string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetSetting stores a server setting
+func (s *Store) SetSetting(key, value string) error {
+	defer s.observe("SetSetting", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, value)
+	return err
+}
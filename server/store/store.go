@@ -1,10 +1,13 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"sync"
+	"time"
 
 	"sec-chat/server/models"
 
@@ -14,11 +17,28 @@ import (
 // Store handles data persistence
 type Store struct {
 	db    *sql.DB
-	mutex sync.RWMutex
+	mutex *sync.RWMutex
+	// ctx parents the trace spans of calls made through WithContext
+	ctx context.Context
 }
 
 var instance *Store
 
+// auditDeleteTrigger rejects deleting audit events unless they are older
+// than the retention floor that PruneAudit records in settings. The floor
+// only moves forward, so recent events stay append-only.
+const auditDeleteTrigger = `
+	DROP TRIGGER IF EXISTS audit_log_no_delete;
+	CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	WHEN old.time >= COALESCE((SELECT CAST(value AS INTEGER) FROM settings WHERE key = 'audit_pruned_before'), 0)
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log is append-only');
+	END;
+`
+
+// ErrDuplicateMessage is returned by SaveMessage when the message ID is taken
+var ErrDuplicateMessage = errors.New("message ID already exists")
+
 // Init initializes the database
 func Init(dbPath string) (*Store, error) {
 	db, err := sql.Open("sqlite", dbPath)
@@ -26,12 +46,15 @@ func Init(dbPath string) (*Store, error) {
 		return nil, err
 	}
 
-	instance = &Store{db: db}
+	instance = &Store{db: db, mutex: &sync.RWMutex{}}
 
 	// Create tables
 	if err := instance.createTables(); err != nil {
 		return nil, err
 	}
+	if err := instance.migrate(); err != nil {
+		return nil, err
+	}
 
 	return instance, nil
 }
@@ -41,6 +64,12 @@ func Get() *Store {
 	return instance
 }
 
+// WithContext returns a view of the store whose calls are traced as children
+// of the span in ctx. It shares the database and lock with s.
+func (s *Store) WithContext(ctx context.Context) *Store {
+	return &Store{db: s.db, mutex: s.mutex, ctx: ctx}
+}
+
 // createTables creates necessary database tables
 func (s *Store) createTables() error {
 	schema := `
@@ -63,33 +92,248 @@ func (s *Store) createTables() error {
 		avatar TEXT,
 		last_seen INTEGER
 	);
+
+	CREATE TABLE IF NOT EXISTS uploads (
+		name TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		width INTEGER DEFAULT 0,
+		height INTEGER DEFAULT 0,
+		thumb TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_refs (
+		name TEXT NOT NULL,
+		ref_type TEXT NOT NULL,
+		ref_id TEXT NOT NULL,
+		PRIMARY KEY (name, ref_type, ref_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_upload_refs_owner ON upload_refs(ref_type, ref_id);
+
+	CREATE TABLE IF NOT EXISTS name_history (
+		user_id TEXT NOT NULL,
+		old_name TEXT NOT NULL,
+		new_name TEXT NOT NULL,
+		changed_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_name_history_user ON name_history(user_id, changed_at);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS bans (
+		user_id TEXT PRIMARY KEY,
+		actor_id TEXT NOT NULL,
+		reason TEXT,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		actor_id TEXT,
+		target_id TEXT,
+		remote_addr TEXT,
+		details TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log(time);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_type ON audit_log(type, time);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log is append-only');
+	END;
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS mod_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action TEXT NOT NULL,
+		actor_id TEXT NOT NULL,
+		target_id TEXT,
+		message_id TEXT,
+		reason TEXT,
+		role TEXT,
+		expires_at INTEGER DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT,
+		room TEXT,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS bots (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		room TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		last_used INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS bot_commands (
+		name TEXT PRIMARY KEY,
+		bot_id TEXT NOT NULL,
+		usage TEXT,
+		summary TEXT,
+		role TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS polls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		question TEXT NOT NULL,
+		options TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		closed INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS poll_votes (
+		poll_id INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		option INTEGER NOT NULL,
+		PRIMARY KEY (poll_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT,
+		created_at INTEGER NOT NULL
+	);
 	`
 	_, err := s.db.Exec(schema)
 	return err
 }
 
-// SaveMessage saves a message to database
+// migrate adds columns introduced after a table was first created
+func (s *Store) migrate() error {
+	columns := []struct{ table, column, def string }{
+		{"messages", "width", "INTEGER DEFAULT 0"},
+		{"messages", "height", "INTEGER DEFAULT 0"},
+		{"messages", "thumb_url", "TEXT"},
+		{"uploads", "width", "INTEGER DEFAULT 0"},
+		{"uploads", "height", "INTEGER DEFAULT 0"},
+		{"uploads", "thumb", "TEXT"},
+		{"users", "status", "TEXT"},
+		{"users", "timezone", "TEXT"},
+		{"users", "presence", "TEXT"},
+		{"users", "role", "TEXT DEFAULT 'member'"},
+		{"users", "muted_until", "INTEGER DEFAULT 0"},
+		{"users", "staff_key_hash", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := s.addColumnIfMissing(c.table, c.column, c.def); err != nil {
+			return err
+		}
+	}
+
+	// Older databases have a delete trigger without the retention floor
+	_, err := s.db.Exec(auditDeleteTrigger)
+	return err
+}
+
+// addColumnIfMissing runs ALTER TABLE ADD COLUMN unless the column exists
+func (s *Store) addColumnIfMissing(table, column, def string) error {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = s.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	return err
+}
+
+// SaveMessage saves a message to database. It returns ErrDuplicateMessage,
+// leaving the stored message untouched, if the ID is already in use.
 func (s *Store) SaveMessage(msg *models.Message) error {
+	defer s.observe("SaveMessage", time.Now())
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	mentions, _ := json.Marshal(msg.Mentions)
 
-	_, err := s.db.Exec(`
-		INSERT OR IGNORE INTO messages (id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, msg.ID, msg.Type, msg.From, msg.FromName, msg.Content, msg.Timestamp, msg.ReplyTo, string(mentions), msg.Recalled)
+	res, err := s.db.Exec(`
+		INSERT OR IGNORE INTO messages (id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled, width, height, thumb_url)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.ID, msg.Type, msg.From, msg.FromName, msg.Content, msg.Timestamp, msg.ReplyTo, string(mentions), msg.Recalled,
+		msg.Width, msg.Height, msg.ThumbURL)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
+}
 
-	return err
+// GetMessage retrieves a single message, or nil if it does not exist
+func (s *Store) GetMessage(id string) (*models.Message, error) {
+	defer s.observe("GetMessage", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled, width, height, thumb_url
+		FROM messages
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanMessage(rows)
 }
 
 // GetMessages retrieves messages with pagination
 func (s *Store) GetMessages(beforeTimestamp int64, limit int) ([]*models.Message, error) {
+	defer s.observe("GetMessages", time.Now())
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	query := `
-		SELECT id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled
+		SELECT id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled, width, height, thumb_url
 		FROM messages
 		WHERE timestamp < ?
 		ORDER BY timestamp DESC
@@ -104,21 +348,11 @@ func (s *Store) GetMessages(beforeTimestamp int64, limit int) ([]*models.Message
 
 	messages := make([]*models.Message, 0)
 	for rows.Next() {
-		msg := &models.Message{}
-		var mentions string
-		var replyTo sql.NullString
-
-		err := rows.Scan(&msg.ID, &msg.Type, &msg.From, &msg.FromName, &msg.Content,
-			&msg.Timestamp, &replyTo, &mentions, &msg.Recalled)
+		msg, err := scanMessage(rows)
 		if err != nil {
-			log.Printf("Error scanning message: %v", err)
+			slog.Error("Error scanning message", "err", err)
 			continue
 		}
-
-		if replyTo.Valid {
-			msg.ReplyTo = replyTo.String
-		}
-		json.Unmarshal([]byte(mentions), &msg.Mentions)
 		messages = append(messages, msg)
 	}
 
@@ -130,8 +364,63 @@ func (s *Store) GetMessages(beforeTimestamp int64, limit int) ([]*models.Message
 	return messages, nil
 }
 
+// EachMessage calls fn for every message in chronological order, stopping
+// at the first error
+func (s *Store) EachMessage(fn func(*models.Message) error) error {
+	defer s.observe("EachMessage", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, type, from_id, from_name, content, timestamp, reply_to, mentions, recalled, width, height, thumb_url
+		FROM messages
+		ORDER BY timestamp, id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanMessage reads a message row selected with the columns GetMessages uses
+func scanMessage(rows *sql.Rows) (*models.Message, error) {
+	msg := &models.Message{}
+	var mentions string
+	var replyTo, thumbURL sql.NullString
+	var width, height sql.NullInt64
+
+	err := rows.Scan(&msg.ID, &msg.Type, &msg.From, &msg.FromName, &msg.Content,
+		&msg.Timestamp, &replyTo, &mentions, &msg.Recalled, &width, &height, &thumbURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if replyTo.Valid {
+		msg.ReplyTo = replyTo.String
+	}
+	msg.Width = int(width.Int64)
+	msg.Height = int(height.Int64)
+	msg.ThumbURL = thumbURL.String
+	json.Unmarshal([]byte(mentions), &msg.Mentions)
+	return msg, nil
+}
+
 // RecallMessage marks a message as recalled
 func (s *Store) RecallMessage(id string) error {
+	defer s.observe("RecallMessage", time.Now())
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -139,25 +428,86 @@ func (s *Store) RecallMessage(id string) error {
 	return err
 }
 
-// SaveUser saves or updates a user
+// SaveUser saves or updates a user. The role is only written when the user
+// is first inserted; use SetUserRole to change it.
 func (s *Store) SaveUser(user *models.User) error {
+	defer s.observe("SaveUser", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO users (id, name, avatar, last_seen, status, timezone, presence, role)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			name = excluded.name,
+			avatar = excluded.avatar,
+			last_seen = excluded.last_seen,
+			status = excluded.status,
+			timezone = excluded.timezone,
+			presence = excluded.presence
+	`, user.ID, user.Name, user.Avatar, user.LastSeen, user.Status, user.Timezone, user.Presence, user.Role)
+
+	return err
+}
+
+// RenameUser updates a user's profile and records the name change
+func (s *Store) RenameUser(user *models.User, oldName string, changedAt int64) error {
+	defer s.observe("RenameUser", time.Now())
+
+	if err := s.SaveUser(user); err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	_, err := s.db.Exec(`
-		INSERT OR REPLACE INTO users (id, name, avatar, last_seen)
+		INSERT INTO name_history (user_id, old_name, new_name, changed_at)
 		VALUES (?, ?, ?, ?)
-	`, user.ID, user.Name, user.Avatar, user.LastSeen)
+	`, user.ID, oldName, user.Name, changedAt)
 
 	return err
 }
 
+// GetNameHistory returns a user's name changes, newest first
+func (s *Store) GetNameHistory(userID string) ([]*models.NameChange, error) {
+	defer s.observe("GetNameHistory", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT user_id, old_name, new_name, changed_at
+		FROM name_history
+		WHERE user_id = ?
+		ORDER BY changed_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]*models.NameChange, 0)
+	for rows.Next() {
+		c := &models.NameChange{}
+		if err := rows.Scan(&c.UserID, &c.OldName, &c.NewName, &c.ChangedAt); err != nil {
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
 // GetUsers retrieves all users
 func (s *Store) GetUsers() ([]*models.User, error) {
+	defer s.observe("GetUsers", time.Now())
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	rows, err := s.db.Query("SELECT id, name, avatar, last_seen FROM users")
+	rows, err := s.db.Query("SELECT id, name, avatar, last_seen, status, timezone, presence, role, muted_until FROM users")
 	if err != nil {
 		return nil, err
 	}
@@ -166,21 +516,152 @@ func (s *Store) GetUsers() ([]*models.User, error) {
 	users := make([]*models.User, 0)
 	for rows.Next() {
 		user := &models.User{}
-		var avatar sql.NullString
+		var avatar, status, timezone, presence, role sql.NullString
+		var mutedUntil sql.NullInt64
 
-		err := rows.Scan(&user.ID, &user.Name, &avatar, &user.LastSeen)
+		err := rows.Scan(&user.ID, &user.Name, &avatar, &user.LastSeen, &status, &timezone, &presence, &role, &mutedUntil)
 		if err != nil {
 			continue
 		}
 		if avatar.Valid {
 			user.Avatar = avatar.String
 		}
+		user.Status = status.String
+		user.Timezone = timezone.String
+		user.Presence = presence.String
+		user.Role = roleOrDefault(role.String)
+		user.MutedUntil = mutedUntil.Int64
 		users = append(users, user)
 	}
 
 	return users, nil
 }
 
+// GetUser retrieves a single user, or nil if the user does not exist
+func (s *Store) GetUser(id string) (*models.User, error) {
+	defer s.observe("GetUser", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query("SELECT id, name, avatar, last_seen, status, timezone, presence, role, muted_until FROM users WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	user := &models.User{}
+	var avatar, status, timezone, presence, role sql.NullString
+	var mutedUntil sql.NullInt64
+	if err := rows.Scan(&user.ID, &user.Name, &avatar, &user.LastSeen, &status, &timezone, &presence, &role, &mutedUntil); err != nil {
+		return nil, err
+	}
+	user.Avatar = avatar.String
+	user.Status = status.String
+	user.Timezone = timezone.String
+	user.Presence = presence.String
+	user.Role = roleOrDefault(role.String)
+	user.MutedUntil = mutedUntil.Int64
+	return user, nil
+}
+
+// SetUserPresence stores the presence state a user chose
+func (s *Store) SetUserPresence(id, presence string) error {
+	defer s.observe("SetUserPresence", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE users SET presence = ? WHERE id = ?", presence, id)
+	return err
+}
+
+// SetUserAvatar stores a user's avatar URL, leaving the rest of the profile
+// as it is, and reports whether the user exists
+func (s *Store) SetUserAvatar(id, avatar string) (bool, error) {
+	defer s.observe("SetUserAvatar", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec("UPDATE users SET avatar = ? WHERE id = ?", avatar, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateLastSeen records when a user was last connected
+func (s *Store) UpdateLastSeen(id string, lastSeen int64) error {
+	defer s.observe("UpdateLastSeen", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE users SET last_seen = ? WHERE id = ?", lastSeen, id)
+	return err
+}
+
+// Ping checks that the database answers and can take the write lock,
+// without changing anything. It gives up when ctx ends, including while
+// another write holds the store lock.
+func (s *Store) Ping(ctx context.Context) error {
+	defer s.observe("Ping", time.Now())
+
+	if err := s.lockContext(ctx); err != nil {
+		return err
+	}
+	defer s.mutex.Unlock()
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "ROLLBACK")
+	return err
+}
+
+// lockContext takes the store's write lock like Lock, but returns ctx's
+// error if ctx ends first
+func (s *Store) lockContext(ctx context.Context) error {
+	if s.mutex.TryLock() {
+		return nil
+	}
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if s.mutex.TryLock() {
+				return nil
+			}
+		}
+	}
+}
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist. It is safe to run while the server is using the database.
+func (s *Store) Backup(path string) error {
+	defer s.observe("Backup", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, err := s.db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
 // Close closes the database connection
 func (s *Store) Close() error {
 	return s.db.Close()
@@ -1,7 +1,10 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -152,6 +155,65 @@ func TestRecallMessage(t *testing.T) {
 	}
 }
 
+func TestGetMessage(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := &models.Message{
+		ID:        "msg_get",
+		Type:      models.TypeText,
+		From:      "user1",
+		FromName:  "Test",
+		Content:   "Hello",
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err := store.SaveMessage(msg); err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+
+	got, err := store.GetMessage("msg_get")
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if got == nil || got.From != "user1" || got.Content != "Hello" {
+		t.Errorf("GetMessage() = %+v, want the saved message", got)
+	}
+
+	missing, err := store.GetMessage("nope")
+	if err != nil || missing != nil {
+		t.Errorf("GetMessage(missing) = %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestSaveMessageDuplicateID(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := &models.Message{
+		ID:        "msg_dup",
+		Type:      models.TypeText,
+		From:      "user1",
+		FromName:  "Alice",
+		Content:   "original",
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err := store.SaveMessage(msg); err != nil {
+		t.Fatalf("SaveMessage() error = %v", err)
+	}
+
+	other := *msg
+	other.From = "user2"
+	other.Content = "hijack"
+	if err := store.SaveMessage(&other); !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("SaveMessage(duplicate) error = %v, want ErrDuplicateMessage", err)
+	}
+
+	got, _ := store.GetMessage("msg_dup")
+	if got == nil || got.From != "user1" || got.Content != "original" {
+		t.Errorf("GetMessage() = %+v, want the original message untouched", got)
+	}
+}
+
 func TestSaveAndGetUsers(t *testing.T) {
 	store, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -278,3 +340,759 @@ func TestMessageWithReply(t *testing.T) {
 		t.Errorf("SaveMessage() should preserve ReplyTo, got %v", replyMsg.ReplyTo)
 	}
 }
+
+func TestUploadRefCounting(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	upload := &models.Upload{
+		Name:      "abc123.png",
+		Hash:      "abc123",
+		Size:      42,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := store.SaveUpload(upload); err != nil {
+		t.Fatalf("SaveUpload() error = %v", err)
+	}
+
+	store.AddUploadRef("abc123.png", models.UploadRefMessage, "msg1")
+	store.AddUploadRef("abc123.png", models.UploadRefMessage, "msg2")
+	store.AddUploadRef("abc123.png", models.UploadRefMessage, "msg2")
+
+	got, err := store.GetUpload("abc123.png")
+	if err != nil || got == nil {
+		t.Fatalf("GetUpload() = %v, %v", got, err)
+	}
+	if got.RefCount != 2 {
+		t.Errorf("GetUpload() RefCount = %d, want 2", got.RefCount)
+	}
+
+	names, err := store.ReleaseUploadRefs(models.UploadRefMessage, "msg1")
+	if err != nil {
+		t.Fatalf("ReleaseUploadRefs() error = %v", err)
+	}
+	if len(names) != 1 || names[0] != "abc123.png" {
+		t.Errorf("ReleaseUploadRefs() = %v, want [abc123.png]", names)
+	}
+
+	if deleted, _ := store.DeleteUploadIfUnreferenced("abc123.png"); deleted {
+		t.Error("DeleteUploadIfUnreferenced() should keep an upload that is still referenced")
+	}
+
+	store.ReleaseUploadRefs(models.UploadRefMessage, "msg2")
+	if deleted, _ := store.DeleteUploadIfUnreferenced("abc123.png"); !deleted {
+		t.Error("DeleteUploadIfUnreferenced() should delete an unreferenced upload")
+	}
+	if got, _ := store.GetUpload("abc123.png"); got != nil {
+		t.Error("GetUpload() should return nil after deletion")
+	}
+}
+
+func TestGetOrphanUploads(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().UnixMilli()
+	store.SaveUpload(&models.Upload{Name: "old", Hash: "old", CreatedAt: now - 10000})
+	store.SaveUpload(&models.Upload{Name: "new", Hash: "new", CreatedAt: now})
+	store.SaveUpload(&models.Upload{Name: "used", Hash: "used", CreatedAt: now - 10000})
+	store.AddUploadRef("used", models.UploadRefAvatar, "user1")
+
+	orphans, err := store.GetOrphanUploads(now - 5000)
+	if err != nil {
+		t.Fatalf("GetOrphanUploads() error = %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Name != "old" {
+		t.Errorf("GetOrphanUploads() returned %v, want only 'old'", orphans)
+	}
+}
+
+func TestImageMessagePreview(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.SaveUpload(&models.Upload{Name: "img.jpg", Hash: "img", CreatedAt: time.Now().UnixMilli()})
+	if err := store.SetUploadPreview("img.jpg", 640, 480, "img_thumb.jpg"); err != nil {
+		t.Fatalf("SetUploadPreview() error = %v", err)
+	}
+	upload, _ := store.GetUpload("img.jpg")
+	if upload == nil || upload.Width != 640 || upload.Height != 480 || upload.Thumb != "img_thumb.jpg" {
+		t.Errorf("GetUpload() = %+v, want 640x480 with thumbnail", upload)
+	}
+
+	msg := &models.Message{
+		ID:        "img_msg",
+		Type:      models.TypeImage,
+		From:      "user1",
+		FromName:  "Test",
+		Content:   "/uploads/img.jpg",
+		Timestamp: time.Now().UnixMilli(),
+		Width:     640,
+		Height:    480,
+		ThumbURL:  "/uploads/img_thumb.jpg",
+	}
+	store.SaveMessage(msg)
+
+	messages, _ := store.GetMessages(time.Now().UnixMilli()+10000, 10)
+	if len(messages) != 1 {
+		t.Fatalf("GetMessages() returned %d messages, want 1", len(messages))
+	}
+	if messages[0].Width != 640 || messages[0].Height != 480 || messages[0].ThumbURL != msg.ThumbURL {
+		t.Errorf("SaveMessage() should preserve image preview, got %+v", messages[0])
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().UnixMilli()
+	store.SaveSession("live", "user1", now+60000)
+	store.SaveSession("stale", "user2", now-1)
+
+	if userID, err := store.GetSessionUser("live", now); err != nil || userID != "user1" {
+		t.Errorf("GetSessionUser(live) = %q, %v, want user1", userID, err)
+	}
+	if userID, _ := store.GetSessionUser("stale", now); userID != "" {
+		t.Errorf("GetSessionUser(stale) = %q, want empty", userID)
+	}
+	if userID, _ := store.GetSessionUser("unknown", now); userID != "" {
+		t.Errorf("GetSessionUser(unknown) = %q, want empty", userID)
+	}
+
+	store.DeleteExpiredSessions(now)
+	if userID, _ := store.GetSessionUser("live", now); userID != "user1" {
+		t.Error("DeleteExpiredSessions() should keep live sessions")
+	}
+}
+
+func TestRenameUserHistory(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	user := models.NewUser("user1", "Alice")
+	user.Status = "Out to lunch"
+	user.Timezone = "Europe/Berlin"
+	store.SaveUser(user)
+
+	user.Name = "Alicia"
+	if err := store.RenameUser(user, "Alice", 1000); err != nil {
+		t.Fatalf("RenameUser() error = %v", err)
+	}
+	user.Name = "Ali"
+	store.RenameUser(user, "Alicia", 2000)
+
+	got, err := store.GetUser("user1")
+	if err != nil || got == nil {
+		t.Fatalf("GetUser() = %v, %v", got, err)
+	}
+	if got.Name != "Ali" || got.Status != "Out to lunch" || got.Timezone != "Europe/Berlin" {
+		t.Errorf("GetUser() = %+v, want renamed user with profile kept", got)
+	}
+
+	history, err := store.GetNameHistory("user1")
+	if err != nil {
+		t.Fatalf("GetNameHistory() error = %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("GetNameHistory() returned %d entries, want 2", len(history))
+	}
+	if history[0].OldName != "Alicia" || history[0].NewName != "Ali" {
+		t.Errorf("GetNameHistory()[0] = %+v, want newest first", history[0])
+	}
+
+	if missing, _ := store.GetUser("nobody"); missing != nil {
+		t.Errorf("GetUser(nobody) = %+v, want nil", missing)
+	}
+}
+
+func TestUserPresenceAndLastSeen(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	user := models.NewUser("user1", "Alice")
+	store.SaveUser(user)
+
+	if err := store.SetUserPresence("user1", models.PresenceInvisible); err != nil {
+		t.Fatalf("SetUserPresence() error = %v", err)
+	}
+	if err := store.UpdateLastSeen("user1", 12345); err != nil {
+		t.Fatalf("UpdateLastSeen() error = %v", err)
+	}
+
+	got, _ := store.GetUser("user1")
+	if got.Presence != models.PresenceInvisible {
+		t.Errorf("GetUser() Presence = %q, want %q", got.Presence, models.PresenceInvisible)
+	}
+	if got.LastSeen != 12345 {
+		t.Errorf("GetUser() LastSeen = %d, want 12345", got.LastSeen)
+	}
+}
+
+func TestSetUserAvatar(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	user := models.NewUser("user1", "Alice")
+	user.Status = "busy"
+	store.SaveUser(user)
+
+	found, err := store.SetUserAvatar("user1", "/uploads/a.png")
+	if err != nil || !found {
+		t.Fatalf("SetUserAvatar() = %v, %v, want true", found, err)
+	}
+	got, _ := store.GetUser("user1")
+	if got.Avatar != "/uploads/a.png" || got.Name != "Alice" || got.Status != "busy" {
+		t.Errorf("GetUser() = %+v, want only the avatar changed", got)
+	}
+
+	if found, err := store.SetUserAvatar("missing", "/uploads/a.png"); err != nil || found {
+		t.Errorf("SetUserAvatar(missing) = %v, %v, want false", found, err)
+	}
+}
+
+func TestRolesAndMutes(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if has, _ := store.HasAdmin(); has {
+		t.Error("HasAdmin() should be false for an empty store")
+	}
+
+	user := models.NewUser("user1", "Alice")
+	user.Role = models.RoleAdmin
+	store.SaveUser(user)
+	if has, _ := store.HasAdmin(); !has {
+		t.Error("HasAdmin() should be true after saving an admin")
+	}
+
+	// SaveUser must not overwrite role or mute of an existing user
+	store.SetMute("user1", 5000)
+	user.Role = models.RoleMember
+	user.Name = "Alicia"
+	store.SaveUser(user)
+
+	got, _ := store.GetUser("user1")
+	if got.Role != models.RoleAdmin {
+		t.Errorf("GetUser() Role = %q, want %q", got.Role, models.RoleAdmin)
+	}
+	if got.MutedUntil != 5000 {
+		t.Errorf("GetUser() MutedUntil = %d, want 5000", got.MutedUntil)
+	}
+
+	store.SetUserRole("user1", models.RoleModerator)
+	got, _ = store.GetUser("user1")
+	if got.Role != models.RoleModerator {
+		t.Errorf("GetUser() Role = %q after SetUserRole, want %q", got.Role, models.RoleModerator)
+	}
+}
+
+func TestBans(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.BanUser(&models.Ban{UserID: "perm", ActorID: "admin", Reason: "spam", CreatedAt: 1})
+	store.BanUser(&models.Ban{UserID: "timed", ActorID: "admin", CreatedAt: 1, ExpiresAt: 2000})
+
+	ban, err := store.GetBan("perm", 1e12)
+	if err != nil || ban == nil {
+		t.Fatalf("GetBan(perm) = %v, %v, want a ban", ban, err)
+	}
+	if ban.Reason != "spam" {
+		t.Errorf("GetBan() Reason = %q, want spam", ban.Reason)
+	}
+	if ban, _ := store.GetBan("timed", 1000); ban == nil {
+		t.Error("GetBan(timed) should return the ban before it expires")
+	}
+	if ban, _ := store.GetBan("timed", 2000); ban != nil {
+		t.Error("GetBan(timed) should return nil after it expires")
+	}
+
+	store.UnbanUser("perm")
+	if ban, _ := store.GetBan("perm", 1); ban != nil {
+		t.Error("GetBan() should return nil after UnbanUser()")
+	}
+}
+
+func TestModLog(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i, action := range []string{models.ModKick, models.ModMute, models.ModBan} {
+		entry := &models.ModAction{Action: action, ActorID: "admin", TargetID: "user1", CreatedAt: int64(i)}
+		if err := store.LogModAction(entry); err != nil {
+			t.Fatalf("LogModAction() error = %v", err)
+		}
+		if entry.ID == 0 {
+			t.Error("LogModAction() should set the entry ID")
+		}
+	}
+
+	entries, err := store.GetModLog(0, 10)
+	if err != nil {
+		t.Fatalf("GetModLog() error = %v", err)
+	}
+	if len(entries) != 3 || entries[0].Action != models.ModBan {
+		t.Fatalf("GetModLog() = %d entries, want 3 newest first", len(entries))
+	}
+
+	older, _ := store.GetModLog(entries[0].ID, 10)
+	if len(older) != 2 || older[0].Action != models.ModMute {
+		t.Errorf("GetModLog(before) = %d entries, want 2 starting with mute", len(older))
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := models.NewMessage(models.TypeText, "user1", "Alice", "hello")
+	store.SaveMessage(msg)
+	if err := store.DeleteMessage(msg.ID); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+
+	messages, _ := store.GetMessages(0, 10)
+	if len(messages) != 0 {
+		t.Errorf("GetMessages() returned %d messages after DeleteMessage(), want 0", len(messages))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	events := []*models.AuditEvent{
+		{Time: 100, Type: models.AuditAuthFailure, ActorID: "user1", RemoteAddr: "10.0.0.1", Details: map[string]string{"reason": "invalid password"}},
+		{Time: 200, Type: models.AuditAuthSuccess, ActorID: "user1", RemoteAddr: "10.0.0.1"},
+		{Time: 300, Type: models.AuditRecall, ActorID: "user2", TargetID: "msg1"},
+	}
+	for _, e := range events {
+		if err := store.AppendAudit(e); err != nil {
+			t.Fatalf("AppendAudit() error = %v", err)
+		}
+	}
+
+	all, err := store.QueryAudit(models.AuditFilter{})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	if len(all) != 3 || all[0].Type != models.AuditRecall {
+		t.Fatalf("QueryAudit() = %d events, want 3 newest first", len(all))
+	}
+	if all[2].Details["reason"] != "invalid password" || all[2].RemoteAddr != "10.0.0.1" {
+		t.Errorf("QueryAudit() oldest = %+v, want details and remote address kept", all[2])
+	}
+
+	tests := []struct {
+		name   string
+		filter models.AuditFilter
+		want   int
+	}{
+		{"by type", models.AuditFilter{Type: models.AuditAuthFailure}, 1},
+		{"by actor", models.AuditFilter{ActorID: "user1"}, 2},
+		{"by target", models.AuditFilter{TargetID: "msg1"}, 1},
+		{"time range", models.AuditFilter{Since: 200, Until: 300}, 1},
+		{"before id", models.AuditFilter{BeforeID: all[0].ID}, 2},
+		{"limit", models.AuditFilter{Limit: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.QueryAudit(tt.filter)
+			if err != nil {
+				t.Fatalf("QueryAudit() error = %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("QueryAudit() = %d events, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	if _, err := store.db.Exec("UPDATE audit_log SET type = 'x'"); err == nil {
+		t.Error("audit log should reject updates")
+	}
+	if _, err := store.db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("audit log should reject deletes")
+	}
+}
+
+func TestPruneAudit(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, ts := range []int64{100, 200, 300} {
+		if err := store.AppendAudit(&models.AuditEvent{Time: ts, Type: models.AuditAuthFailure}); err != nil {
+			t.Fatalf("AppendAudit() error = %v", err)
+		}
+	}
+
+	n, err := store.PruneAudit(250)
+	if err != nil || n != 2 {
+		t.Fatalf("PruneAudit(250) = %d, %v, want 2", n, err)
+	}
+	// The floor never moves back, so an earlier cutoff deletes nothing new
+	if n, err := store.PruneAudit(150); err != nil || n != 0 {
+		t.Errorf("PruneAudit(150) = %d, %v, want 0", n, err)
+	}
+	if v, _ := store.GetSetting("audit_pruned_before"); v != "250" {
+		t.Errorf("retention floor = %q, want 250", v)
+	}
+	if _, err := store.db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("audit log should reject deletes inside the retention window")
+	}
+	left, _ := store.QueryAudit(models.AuditFilter{})
+	if len(left) != 1 || left[0].Time != 300 {
+		t.Errorf("QueryAudit() after prune = %d events, want only the newest", len(left))
+	}
+}
+
+func TestSettings(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if v, err := store.GetSetting("missing"); err != nil || v != "" {
+		t.Errorf("GetSetting(missing) = %q, %v, want empty", v, err)
+	}
+	store.SetSetting("key", "one")
+	store.SetSetting("key", "two")
+	if v, _ := store.GetSetting("key"); v != "two" {
+		t.Errorf("GetSetting() = %q, want two", v)
+	}
+}
+
+func TestPing(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if err := store.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	// The write check must not leave a transaction open
+	if err := store.SetSetting("k", "v"); err != nil {
+		t.Fatalf("SetSetting() after Ping() error = %v", err)
+	}
+
+	// A write holding the store lock makes Ping give up at its deadline
+	store.mutex.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err := store.Ping(ctx)
+	cancel()
+	store.mutex.Unlock()
+	if err != context.DeadlineExceeded {
+		t.Errorf("Ping() while locked error = %v, want DeadlineExceeded", err)
+	}
+
+	store.Close()
+	if err := store.Ping(context.Background()); err == nil {
+		t.Error("Ping() should fail on a closed database")
+	}
+}
+
+func TestPurgeUserMessages(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	spam := models.NewMessage(models.TypeImage, "spammer", "Spam", "/uploads/a.png")
+	keep := models.NewMessage(models.TypeText, "user1", "Alice", "hello")
+	store.SaveMessage(spam)
+	store.SaveMessage(keep)
+	store.AddUploadRef("a.png", models.UploadRefMessage, spam.ID)
+
+	n, err := store.PurgeUserMessages("spammer")
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeUserMessages() = %d, %v, want 1", n, err)
+	}
+
+	var ids []string
+	store.EachMessage(func(m *models.Message) error {
+		ids = append(ids, m.ID)
+		return nil
+	})
+	if len(ids) != 1 || ids[0] != keep.ID {
+		t.Errorf("messages after purge = %v, want only %s", ids, keep.ID)
+	}
+	if names, _ := store.ReleaseUploadRefs(models.UploadRefMessage, spam.ID); len(names) != 0 {
+		t.Errorf("PurgeUserMessages() should remove upload refs, %v left", names)
+	}
+}
+
+func TestEachMessage(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i, content := range []string{"one", "two", "three"} {
+		msg := models.NewMessage(models.TypeText, "user1", "Alice", content)
+		msg.Timestamp = int64(1000 - i)
+		store.SaveMessage(msg)
+	}
+
+	var got []string
+	err := store.EachMessage(func(m *models.Message) error {
+		got = append(got, m.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachMessage() error = %v", err)
+	}
+	if len(got) != 3 || got[0] != "three" || got[2] != "one" {
+		t.Errorf("EachMessage() order = %v, want oldest first", got)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = store.EachMessage(func(*models.Message) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("EachMessage() = %v after %d calls, want the callback's error after 1", err, calls)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.SaveUser(models.NewUser("user1", "Alice"))
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := store.Backup(path); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	if err := store.Backup(path); err == nil {
+		t.Error("Backup() should refuse to overwrite a file")
+	}
+
+	restored, err := Init(path)
+	if err != nil {
+		t.Fatalf("Init(backup) error = %v", err)
+	}
+	defer restored.Close()
+	if user, _ := restored.GetUser("user1"); user == nil || user.Name != "Alice" {
+		t.Errorf("backup user = %+v, want Alice", user)
+	}
+}
+
+func TestDeleteAllSessions(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().UnixMilli()
+	store.SaveSession("a", "user1", now+60000)
+	store.SaveSession("b", "user2", now+60000)
+	if err := store.DeleteAllSessions(); err != nil {
+		t.Fatalf("DeleteAllSessions() error = %v", err)
+	}
+	for _, token := range []string{"a", "b"} {
+		if userID, _ := store.GetSessionUser(token, now); userID != "" {
+			t.Errorf("GetSessionUser(%s) = %q after DeleteAllSessions(), want empty", token, userID)
+		}
+	}
+}
+
+func TestDeleteUserSessions(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().UnixMilli()
+	store.SaveSession("a", "user1", now+60000)
+	store.SaveSession("b", "user2", now+60000)
+	if err := store.DeleteUserSessions("user1"); err != nil {
+		t.Fatalf("DeleteUserSessions() error = %v", err)
+	}
+	if userID, _ := store.GetSessionUser("a", now); userID != "" {
+		t.Errorf("GetSessionUser(a) = %q after DeleteUserSessions(user1), want empty", userID)
+	}
+	if userID, _ := store.GetSessionUser("b", now); userID != "user2" {
+		t.Errorf("GetSessionUser(b) = %q, want user2 to stay signed in", userID)
+	}
+}
+
+func TestStaffKey(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.SaveUser(models.NewUser("user1", "Alice"))
+	if hash, err := store.GetStaffKey("user1"); err != nil || hash != "" {
+		t.Errorf("GetStaffKey() = %q, %v, want none", hash, err)
+	}
+	if err := store.SetStaffKey("user1", "hash1"); err != nil {
+		t.Fatalf("SetStaffKey() error = %v", err)
+	}
+	// Saving the profile must not touch the key
+	store.SaveUser(models.NewUser("user1", "Alice B"))
+	if hash, _ := store.GetStaffKey("user1"); hash != "hash1" {
+		t.Errorf("GetStaffKey() = %q, want hash1", hash)
+	}
+	if hash, err := store.GetStaffKey("missing"); err != nil || hash != "" {
+		t.Errorf("GetStaffKey(missing) = %q, %v, want none", hash, err)
+	}
+}
+
+func TestUploadUsage(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if count, size, err := store.UploadUsage(); err != nil || count != 0 || size != 0 {
+		t.Errorf("UploadUsage() on empty store = %d, %d, %v, want 0, 0", count, size, err)
+	}
+	store.SaveUpload(&models.Upload{Name: "a", Hash: "a", Size: 100, CreatedAt: 1})
+	store.SaveUpload(&models.Upload{Name: "b", Hash: "b", Size: 250, CreatedAt: 1})
+	if count, size, err := store.UploadUsage(); err != nil || count != 2 || size != 350 {
+		t.Errorf("UploadUsage() = %d, %d, %v, want 2, 350", count, size, err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.SaveWebhook(&models.Webhook{ID: "h1", URL: "http://a", Secret: "s1", CreatedAt: 1})
+	store.SaveWebhook(&models.Webhook{ID: "h2", URL: "http://b", Secret: "s2", Room: "main",
+		Events: []string{models.EventMessageCreated, models.EventUserJoined}, CreatedAt: 2})
+
+	hooks, err := store.GetWebhooks()
+	if err != nil || len(hooks) != 2 {
+		t.Fatalf("GetWebhooks() = %d hooks, %v, want 2", len(hooks), err)
+	}
+	if hooks[0].ID != "h1" || hooks[0].Events != nil || hooks[0].Secret != "s1" {
+		t.Errorf("GetWebhooks()[0] = %+v, want h1 with no events", hooks[0])
+	}
+	if hooks[1].Room != "main" || len(hooks[1].Events) != 2 || hooks[1].Events[1] != models.EventUserJoined {
+		t.Errorf("GetWebhooks()[1] = %+v, want room and events kept", hooks[1])
+	}
+
+	if ok, err := store.DeleteWebhook("h1"); !ok || err != nil {
+		t.Errorf("DeleteWebhook(h1) = %v, %v, want true", ok, err)
+	}
+	if ok, _ := store.DeleteWebhook("h1"); ok {
+		t.Error("DeleteWebhook() of a missing webhook should return false")
+	}
+	if hooks, _ := store.GetWebhooks(); len(hooks) != 1 {
+		t.Errorf("GetWebhooks() after delete = %d hooks, want 1", len(hooks))
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	first := &models.DeadLetter{WebhookID: "h1", EventID: "e1", EventType: models.EventUserLeft,
+		Payload: `{"id":"e1"}`, Attempts: 5, LastError: "503 Service Unavailable", CreatedAt: 1}
+	if err := store.SaveDeadLetter(first); err != nil || first.ID == 0 {
+		t.Fatalf("SaveDeadLetter() = %v, ID %d", err, first.ID)
+	}
+	store.SaveDeadLetter(&models.DeadLetter{WebhookID: "h1", EventID: "e2", EventType: models.EventUserLeft,
+		Payload: `{"id":"e2"}`, Attempts: 5, CreatedAt: 2})
+
+	letters, err := store.GetDeadLetters(10)
+	if err != nil || len(letters) != 2 || letters[0].EventID != "e2" {
+		t.Fatalf("GetDeadLetters() = %v, %v, want e2 then e1", letters, err)
+	}
+	got, err := store.GetDeadLetter(first.ID)
+	if err != nil || got == nil || got.LastError != first.LastError || got.Payload != first.Payload {
+		t.Errorf("GetDeadLetter() = %+v, %v, want %+v", got, err, first)
+	}
+
+	if ok, err := store.DeleteDeadLetter(first.ID); !ok || err != nil {
+		t.Errorf("DeleteDeadLetter() = %v, %v, want true", ok, err)
+	}
+	if got, _ := store.GetDeadLetter(first.ID); got != nil {
+		t.Error("GetDeadLetter() after delete should return nil")
+	}
+}
+
+func TestBots(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ci := &models.Bot{ID: "ci", Name: "CI", Kind: models.BotKindAPI, Room: models.MainRoom, CreatedAt: 1}
+	if err := store.SaveBot(ci, "hash-ci"); err != nil {
+		t.Fatalf("SaveBot() error = %v", err)
+	}
+	store.SaveBot(&models.Bot{ID: "alerts", Name: "Alerts", Kind: models.BotKindWebhook, Room: models.MainRoom, CreatedAt: 2}, "hash-alerts")
+	if err := store.SaveBot(&models.Bot{ID: "dup", Name: "Dup", Kind: models.BotKindAPI, Room: models.MainRoom, CreatedAt: 3}, "hash-ci"); err == nil {
+		t.Error("SaveBot() should reject a key hash that is already in use")
+	}
+
+	got, err := store.GetBotByKey("hash-alerts")
+	if err != nil || got == nil || got.ID != "alerts" || got.Kind != models.BotKindWebhook {
+		t.Fatalf("GetBotByKey() = %+v, %v, want alerts", got, err)
+	}
+	if got, _ := store.GetBotByKey("unknown"); got != nil {
+		t.Error("GetBotByKey() of an unknown key should return nil")
+	}
+
+	store.TouchBot("ci", 500)
+	bots, err := store.GetBots()
+	if err != nil || len(bots) != 2 || bots[0].ID != "ci" || bots[0].LastUsed != 500 {
+		t.Errorf("GetBots() = %v, %v, want ci (last used 500) then alerts", bots, err)
+	}
+
+	if ok, err := store.DeleteBot("ci"); !ok || err != nil {
+		t.Errorf("DeleteBot(ci) = %v, %v, want true", ok, err)
+	}
+	if got, _ := store.GetBotByKey("hash-ci"); got != nil {
+		t.Error("a deleted bot's key should no longer authenticate")
+	}
+}
+
+func TestBotCommands(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store.SaveBot(&models.Bot{ID: "ci", Name: "CI", Kind: models.BotKindAPI, Room: models.MainRoom, CreatedAt: 1}, "hash-ci")
+	deploy := &models.BotCommand{Name: "deploy", BotID: "ci", Usage: "<env>", Role: models.RoleModerator,
+		URL: "http://ci/deploy", Secret: "s", CreatedAt: 1}
+	if err := store.SaveBotCommand(deploy); err != nil {
+		t.Fatalf("SaveBotCommand() error = %v", err)
+	}
+	store.SaveBotCommand(&models.BotCommand{Name: "build", BotID: "ci", Role: models.RoleMember, URL: "http://ci/build", Secret: "s", CreatedAt: 2})
+
+	got, err := store.GetBotCommand("deploy")
+	if err != nil || got == nil || got.Usage != "<env>" || got.Role != models.RoleModerator || got.Secret != "s" {
+		t.Fatalf("GetBotCommand() = %+v, %v, want deploy", got, err)
+	}
+	if cmds, _ := store.GetBotCommands("ci"); len(cmds) != 2 || cmds[0].Name != "build" {
+		t.Errorf("GetBotCommands(ci) = %v, want build then deploy", cmds)
+	}
+	if ok, _ := store.DeleteBotCommand("deploy", "other"); ok {
+		t.Error("DeleteBotCommand() should not remove another bot's command")
+	}
+	if ok, err := store.DeleteBotCommand("deploy", "ci"); !ok || err != nil {
+		t.Errorf("DeleteBotCommand() = %v, %v, want true", ok, err)
+	}
+
+	store.DeleteBot("ci")
+	if cmds, _ := store.GetBotCommands(""); len(cmds) != 0 {
+		t.Errorf("GetBotCommands() after DeleteBot() = %v, want none", cmds)
+	}
+}
+
+func TestPolls(t *testing.T) {
+	store, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	p := &models.Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}, CreatedBy: "user1", CreatedAt: 1}
+	if err := store.CreatePoll(p); err != nil || p.ID == 0 {
+		t.Fatalf("CreatePoll() = %v, ID %d", err, p.ID)
+	}
+	store.VotePoll(p.ID, "user1", 0)
+	store.VotePoll(p.ID, "user2", 0)
+	store.VotePoll(p.ID, "user2", 1) // Changed vote
+
+	got, err := store.GetPoll(p.ID)
+	if err != nil || got == nil {
+		t.Fatalf("GetPoll() = %v, %v", got, err)
+	}
+	if got.Question != "Lunch?" || len(got.Options) != 2 || got.Votes[0] != 1 || got.Votes[1] != 1 || got.Total() != 2 {
+		t.Errorf("GetPoll() = %+v, want one vote each", got)
+	}
+
+	store.ClosePoll(p.ID)
+	if got, _ := store.GetPoll(p.ID); !got.Closed {
+		t.Error("GetPoll() after ClosePoll() should be closed")
+	}
+	if got, _ := store.GetPoll(999); got != nil {
+		t.Error("GetPoll() of an unknown poll should return nil")
+	}
+}
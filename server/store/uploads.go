@@ -0,0 +1,183 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// SaveUpload records an upload. Re-uploading existing content refreshes created_at
+// so the orphan sweep does not collect a file that is about to be referenced.
+func (s *Store) SaveUpload(upload *models.Upload) error {
+	defer s.observe("SaveUpload", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO uploads (name, hash, size, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET created_at = excluded.created_at
+	`, upload.Name, upload.Hash, upload.Size, upload.CreatedAt)
+
+	return err
+}
+
+// GetUpload retrieves an upload with its current reference count, or nil if unknown
+func (s *Store) GetUpload(name string) (*models.Upload, error) {
+	defer s.observe("GetUpload", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT u.name, u.hash, u.size, u.created_at, u.width, u.height, u.thumb,
+			(SELECT COUNT(*) FROM upload_refs r WHERE r.name = u.name)
+		FROM uploads u
+		WHERE u.name = ?
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	upload := &models.Upload{}
+	var thumb sql.NullString
+	if err := rows.Scan(&upload.Name, &upload.Hash, &upload.Size, &upload.CreatedAt,
+		&upload.Width, &upload.Height, &thumb, &upload.RefCount); err != nil {
+		return nil, err
+	}
+	upload.Thumb = thumb.String
+	return upload, nil
+}
+
+// SetUploadPreview records the image dimensions and thumbnail of an upload
+func (s *Store) SetUploadPreview(name string, width, height int, thumb string) error {
+	defer s.observe("SetUploadPreview", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec("UPDATE uploads SET width = ?, height = ?, thumb = ? WHERE name = ?",
+		width, height, thumb, name)
+	return err
+}
+
+// AddUploadRef records that a message or avatar references an upload
+func (s *Store) AddUploadRef(name, refType, refID string) error {
+	defer s.observe("AddUploadRef", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO upload_refs (name, ref_type, ref_id)
+		VALUES (?, ?, ?)
+	`, name, refType, refID)
+
+	return err
+}
+
+// ReleaseUploadRefs drops all references held by an owner and returns the
+// names of the uploads it referenced, which may now be unreferenced
+func (s *Store) ReleaseUploadRefs(refType, refID string) ([]string, error) {
+	defer s.observe("ReleaseUploadRefs", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT name FROM upload_refs WHERE ref_type = ? AND ref_id = ?", refType, refID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM upload_refs WHERE ref_type = ? AND ref_id = ?", refType, refID); err != nil {
+		return nil, err
+	}
+
+	return names, tx.Commit()
+}
+
+// DeleteUploadIfUnreferenced removes the upload record when nothing references it.
+// It reports whether the record was removed, in which case the file may be deleted.
+func (s *Store) DeleteUploadIfUnreferenced(name string) (bool, error) {
+	defer s.observe("DeleteUploadIfUnreferenced", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec(`
+		DELETE FROM uploads
+		WHERE name = ? AND NOT EXISTS (SELECT 1 FROM upload_refs WHERE upload_refs.name = uploads.name)
+	`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetOrphanUploads returns unreferenced uploads created before the given timestamp
+func (s *Store) GetOrphanUploads(before int64) ([]*models.Upload, error) {
+	defer s.observe("GetOrphanUploads", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT name, hash, size, created_at, thumb
+		FROM uploads
+		WHERE created_at < ?
+			AND NOT EXISTS (SELECT 1 FROM upload_refs WHERE upload_refs.name = uploads.name)
+	`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*models.Upload, 0)
+	for rows.Next() {
+		upload := &models.Upload{}
+		var thumb sql.NullString
+		if err := rows.Scan(&upload.Name, &upload.Hash, &upload.Size, &upload.CreatedAt, &thumb); err != nil {
+			continue
+		}
+		upload.Thumb = thumb.String
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, nil
+}
+
+// UploadUsage returns how many uploads are stored and their total size
+func (s *Store) UploadUsage() (int, int64, error) {
+	defer s.observe("UploadUsage", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var count int
+	var size int64
+	err := s.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM uploads").Scan(&count, &size)
+	return count, size, err
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"sec-chat/server/models"
+)
+
+// SaveWebhook adds or replaces a webhook subscription
+func (s *Store) SaveWebhook(h *models.Webhook) error {
+	defer s.observe("SaveWebhook", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO webhooks (id, url, secret, events, room, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, h.ID, h.URL, h.Secret, strings.Join(h.Events, ","), h.Room, h.CreatedAt)
+
+	return err
+}
+
+// GetWebhooks returns every webhook subscription, secrets included, oldest first
+func (s *Store) GetWebhooks() ([]*models.Webhook, error) {
+	defer s.observe("GetWebhooks", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, url, secret, events, room, created_at
+		FROM webhooks
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []*models.Webhook
+	for rows.Next() {
+		h := &models.Webhook{}
+		var events, room sql.NullString
+		if err := rows.Scan(&h.ID, &h.URL, &h.Secret, &events, &room, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		if events.String != "" {
+			h.Events = strings.Split(events.String, ",")
+		}
+		h.Room = room.String
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook subscription, reporting whether it existed.
+// Its dead letters are kept.
+func (s *Store) DeleteWebhook(id string) (bool, error) {
+	defer s.observe("DeleteWebhook", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SaveDeadLetter records a webhook delivery that failed every attempt
+func (s *Store) SaveDeadLetter(d *models.DeadLetter) error {
+	defer s.observe("SaveDeadLetter", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO webhook_dead_letters (webhook_id, event_id, event_type, payload, attempts, last_error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, d.WebhookID, d.EventID, d.EventType, d.Payload, d.Attempts, d.LastError, d.CreatedAt)
+	if err != nil {
+		return err
+	}
+	d.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// GetDeadLetters returns up to limit dead letters, newest first
+func (s *Store) GetDeadLetters(limit int) ([]*models.DeadLetter, error) {
+	defer s.observe("GetDeadLetters", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, webhook_id, event_id, event_type, payload, attempts, last_error, created_at
+		FROM webhook_dead_letters
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []*models.DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// GetDeadLetter returns one dead letter, or nil if there is none with id
+func (s *Store) GetDeadLetter(id int64) (*models.DeadLetter, error) {
+	defer s.observe("GetDeadLetter", time.Now())
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, webhook_id, event_id, event_type, payload, attempts, last_error, created_at
+		FROM webhook_dead_letters
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanDeadLetter(rows)
+}
+
+// DeleteDeadLetter removes a dead letter, reporting whether it existed
+func (s *Store) DeleteDeadLetter(id int64) (bool, error) {
+	defer s.observe("DeleteDeadLetter", time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM webhook_dead_letters WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// scanDeadLetter reads a dead letter from the current row
+func scanDeadLetter(rows *sql.Rows) (*models.DeadLetter, error) {
+	d := &models.DeadLetter{}
+	var lastError sql.NullString
+	if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload,
+		&d.Attempts, &lastError, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	d.LastError = lastError.String
+	return d, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sec-chat/server/tlscert"
+)
+
+// certPollInterval is how often the certificate files are checked for changes
+const certPollInterval = 30 * time.Second
+
+// tlsListener terminates TLS on ln with the certificate held by certs
+func tlsListener(ln net.Listener, certs *tlscert.Reloader) net.Listener {
+	return tls.NewListener(ln, &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// WebSocket upgrades need HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	})
+}
+
+// watchCertificate reloads the certificate when its files change. SIGHUP
+// reloads it at once, see watchHangup.
+func watchCertificate(certs *tlscert.Reloader) {
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if certs.Changed() {
+			reloadCertificate(certs)
+		}
+	}
+}
+
+// reloadCertificate loads the certificate files again, keeping the current
+// certificate if they are unusable
+func reloadCertificate(certs *tlscert.Reloader) {
+	if err := certs.Reload(); err != nil {
+		slog.Error("Failed to reload TLS certificate, keeping the current one", "err", err)
+		return
+	}
+	logCertificate(certs)
+}
+
+// logCertificate logs who the served certificate is for and when it expires
+func logCertificate(certs *tlscert.Reloader) {
+	leaf := certs.Leaf()
+	names := leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+	slog.Info("Loaded TLS certificate", "names", strings.Join(names, ","), "expires", leaf.NotAfter.Format(time.RFC3339))
+}
+
+// redirectHandler sends plain HTTP requests to the same URL over HTTPS on
+// httpsPort
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,101 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate with the given serial number
+// and its key, stamping both files with modTime
+func writePair(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeFile(t *testing.T, name string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Fatal("NewReloader() should fail without the files")
+	}
+
+	writePair(t, certFile, keyFile, 1, start)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	if got := r.Leaf().SerialNumber.Int64(); got != 1 {
+		t.Fatalf("serial = %d, want 1", got)
+	}
+	if r.Changed() {
+		t.Error("Changed() should be false right after loading")
+	}
+
+	writePair(t, certFile, keyFile, 2, start.Add(time.Minute))
+	if !r.Changed() {
+		t.Fatal("Changed() should notice the new files")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	cert, _ := r.GetCertificate(nil)
+	if got := cert.Leaf.SerialNumber.Int64(); got != 2 {
+		t.Errorf("serial after reload = %d, want 2", got)
+	}
+	if r.Changed() {
+		t.Error("Changed() should be false after reloading")
+	}
+
+	// A half-written renewal keeps the old certificate and is retried
+	writeFile(t, certFile, []byte("not a certificate"), start.Add(2*time.Minute))
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() should fail on a broken certificate")
+	}
+	if got := r.Leaf().SerialNumber.Int64(); got != 2 {
+		t.Errorf("serial after failed reload = %d, want 2", got)
+	}
+	if !r.Changed() {
+		t.Error("Changed() should stay true until a reload succeeds")
+	}
+}
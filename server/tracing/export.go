@@ -0,0 +1,281 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// Options configures tracing
+type Options struct {
+	// Exporter is "none", "stdout" or "otlp"
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector base URL; spans are posted to
+	// Endpoint + "/v1/traces"
+	Endpoint string
+	// SampleRatio is the fraction of new traces recorded, from 0 to 1
+	SampleRatio float64
+	ServiceName string
+	Version     string
+}
+
+// Init starts exporting spans as configured. With the "none" exporter
+// tracing stays disabled and Start costs next to nothing.
+func Init(opts Options) error {
+	var exp exporter
+	resource := []Attr{String("service.name", opts.ServiceName), String("service.version", opts.Version)}
+	switch strings.ToLower(opts.Exporter) {
+	case "", "none":
+		return nil
+	case "stdout":
+		exp = &stdoutExporter{w: os.Stdout}
+	case "otlp":
+		if opts.Endpoint == "" {
+			return fmt.Errorf("the otlp exporter needs an endpoint")
+		}
+		exp = &otlpExporter{
+			url:      strings.TrimSuffix(opts.Endpoint, "/") + "/v1/traces",
+			resource: resource,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q (want none, stdout or otlp)", opts.Exporter)
+	}
+
+	active.Store(&tracer{sampleRatio: opts.SampleRatio, batch: newBatcher(exp)})
+	return nil
+}
+
+// Shutdown stops tracing and flushes spans that have ended
+func Shutdown(ctx context.Context) error {
+	t := active.Swap(nil)
+	if t == nil {
+		return nil
+	}
+	return t.batch.shutdown(ctx)
+}
+
+// exporter sends finished spans somewhere
+type exporter interface {
+	export(ctx context.Context, spans []*Span) error
+}
+
+// batcher queues finished spans and exports them in batches from one
+// goroutine, dropping spans rather than blocking when the queue is full
+type batcher struct {
+	exp     exporter
+	queue   chan *Span
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+func newBatcher(exp exporter) *batcher {
+	b := &batcher{
+		exp:   exp,
+		queue: make(chan *Span, queueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) add(s *Span) {
+	select {
+	case b.queue <- s:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var pending []*Span
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := b.exp.export(ctx, pending); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(pending), "err", err)
+		}
+		cancel()
+		pending = nil
+	}
+
+	for {
+		select {
+		case s := <-b.queue:
+			pending = append(pending, s)
+			if len(pending) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if n := b.dropped.Swap(0); n > 0 {
+				slog.Warn("Dropped spans, export queue full", "spans", n)
+			}
+			flush()
+		case <-b.stop:
+			for {
+				select {
+				case s := <-b.queue:
+					pending = append(pending, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *batcher) shutdown(ctx context.Context) error {
+	close(b.stop)
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stdoutExporter writes one JSON span per line, for local testing
+type stdoutExporter struct {
+	w io.Writer
+}
+
+func (e *stdoutExporter) export(ctx context.Context, spans []*Span) error {
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(encodeSpan(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter posts spans to a collector using OTLP/HTTP with JSON encoding
+type otlpExporter struct {
+	url      string
+	resource []Attr
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, spans []*Span) error {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		encoded[i] = encodeSpan(s)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": encodeAttrs(e.resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "sec-chat/server"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpSpan is the OTLP/JSON form of a span; IDs are hex and times are
+// nanosecond strings as the protobuf JSON mapping requires
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        encodeAttrs(s.attrs),
+	}
+	if s.parent != (SpanID{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		out.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return out
+}
+
+func encodeAttrs(attrs []Attr) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch val := a.Value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		out = append(out, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return out
+}
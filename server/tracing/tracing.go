@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace and SpanID a span within it
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc has non-zero IDs
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Kind describes a span's role, using the OTLP numbering
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr is a span attribute; Value is a string, int64, float64 or bool
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String, Int and Bool build attributes
+func String(key, value string) Attr    { return Attr{key, value} }
+func Int(key string, value int) Attr   { return Attr{key, int64(value)} }
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// Span is an operation being timed. A nil *Span is valid and does nothing,
+// which is what Start returns while tracing is disabled.
+type Span struct {
+	tracer *tracer
+	sc     SpanContext
+	parent SpanID
+	name   string
+	kind   Kind
+	start  time.Time
+	end    time.Time
+	attrs  []Attr
+	err    string
+	ended  atomic.Bool
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// SetKind marks the span as a server span or other kind
+func (s *Span) SetKind(kind Kind) {
+	if s != nil {
+		s.kind = kind
+	}
+}
+
+// SetError marks the span as failed with err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	s.endAt(time.Now())
+}
+
+func (s *Span) endAt(t time.Time) {
+	if s == nil || !s.ended.CompareAndSwap(false, true) {
+		return
+	}
+	s.end = t
+	if s.sc.Sampled {
+		s.tracer.batch.add(s)
+	}
+}
+
+// Context returns the span's propagated identity
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// tracer creates spans and hands finished ones to the batcher
+type tracer struct {
+	sampleRatio float64
+	batch       *batcher
+}
+
+var active atomic.Pointer[tracer]
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span that is a child of the span in ctx, or of a remote
+// parent set with ContextWithRemoteParent. It returns a context carrying the
+// new span. While tracing is disabled it returns ctx and a nil span.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	t := active.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	s := t.newSpan(parentOf(ctx), name, time.Now())
+	s.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Record adds a finished child of the span in ctx that ran from start until
+// now. It does nothing unless ctx carries a span, so untraced callers do not
+// produce stray root spans.
+func Record(ctx context.Context, name string, start time.Time, attrs ...Attr) {
+	t := active.Load()
+	parent := parentOf(ctx)
+	if t == nil || !parent.IsValid() {
+		return
+	}
+	s := t.newSpan(parent, name, start)
+	s.SetAttributes(attrs...)
+	s.End()
+}
+
+// SpanFromContext returns the span carried by ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent makes sc, received from another process, the
+// parent of spans started from the returned context
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func parentOf(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// newSpan creates a span under parent, deciding on sampling for new traces
+func (t *tracer) newSpan(parent SpanContext, name string, start time.Time) *Span {
+	s := &Span{tracer: t, name: name, kind: KindInternal, start: start}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sample(s.sc.TraceID)
+	}
+	rand.Read(s.sc.SpanID[:])
+	return s
+}
+
+// sample keeps a trace when the low bits of its ID fall under the ratio, so
+// every process makes the same decision for a trace
+func (t *tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(t.sampleRatio * (1 << 63) * 2)
+	return binary.BigEndian.Uint64(id[8:]) < bound
+}
+
+// Extract reads a W3C traceparent header
+func Extract(h http.Header) SpanContext {
+	parts := strings.Split(strings.TrimSpace(h.Get("Traceparent")), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return SpanContext{}
+	}
+	var sc SpanContext
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return SpanContext{}
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func Traceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
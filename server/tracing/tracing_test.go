@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureExporter keeps exported spans for inspection
+type captureExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (c *captureExporter) export(ctx context.Context, spans []*Span) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, spans...)
+	return nil
+}
+
+func startCapture(ratio float64) *captureExporter {
+	c := &captureExporter{}
+	active.Store(&tracer{sampleRatio: ratio, batch: newBatcher(c)})
+	return c
+}
+
+func TestDisabled(t *testing.T) {
+	Shutdown(context.Background())
+	ctx, span := Start(context.Background(), "noop")
+	if span != nil {
+		t.Fatal("Start() should return a nil span while disabled")
+	}
+	// Nil spans are safe to use
+	span.SetAttributes(String("k", "v"))
+	span.SetError(errors.New("x"))
+	span.End()
+	Record(ctx, "store", time.Now())
+}
+
+func TestParentChild(t *testing.T) {
+	c := startCapture(1)
+
+	ctx, root := Start(context.Background(), "ws.text", String("user_id", "u1"))
+	root.SetKind(KindServer)
+	childCtx, child := Start(ctx, "hub.broadcast")
+	child.SetError(errors.New("boom"))
+	child.End()
+	Record(childCtx, "store.SaveMessage", time.Now().Add(-time.Millisecond))
+	Record(context.Background(), "orphan", time.Now())
+	root.End()
+	root.End() // a second End is ignored
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(c.spans))
+	}
+	byName := map[string]*Span{}
+	for _, s := range c.spans {
+		byName[s.name] = s
+		if s.sc.TraceID != root.sc.TraceID {
+			t.Errorf("%s has trace %x, want %x", s.name, s.sc.TraceID, root.sc.TraceID)
+		}
+	}
+	if byName["hub.broadcast"].parent != root.sc.SpanID {
+		t.Error("hub.broadcast should be a child of ws.text")
+	}
+	if byName["store.SaveMessage"].parent != child.sc.SpanID {
+		t.Error("store.SaveMessage should be a child of hub.broadcast")
+	}
+	if byName["ws.text"].kind != KindServer || len(byName["ws.text"].attrs) != 1 {
+		t.Error("root span lost its kind or attributes")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	c := startCapture(0)
+	ctx, root := Start(context.Background(), "unsampled")
+	_, child := Start(ctx, "child")
+	if child.sc.TraceID != root.sc.TraceID || child.sc.Sampled {
+		t.Error("children should join the unsampled trace")
+	}
+	child.End()
+	root.End()
+
+	// A sampled remote parent is honoured
+	remote := SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true}
+	_, s := Start(ContextWithRemoteParent(context.Background(), remote), "from remote")
+	s.End()
+
+	Shutdown(context.Background())
+	if len(c.spans) != 1 || c.spans[0].name != "from remote" || c.spans[0].parent != remote.SpanID {
+		t.Errorf("exported %d spans, want only the remote child", len(c.spans))
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	sc := SpanContext{TraceID: TraceID{0xab, 1}, SpanID: SpanID{0xcd, 2}, Sampled: true}
+	h := http.Header{}
+	h.Set("traceparent", Traceparent(sc))
+	if got := Extract(h); got != sc {
+		t.Errorf("Extract(Traceparent()) = %+v, want %+v", got, sc)
+	}
+
+	for _, bad := range []string{"", "garbage", "01-" + Traceparent(sc)[3:], "00-abc-def-01"} {
+		h.Set("traceparent", bad)
+		if Extract(h).IsValid() {
+			t.Errorf("Extract(%q) should be invalid", bad)
+		}
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var mu sync.Mutex
+	var path string
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+	}))
+	defer srv.Close()
+
+	if err := Init(Options{Exporter: "otlp", Endpoint: srv.URL + "/", SampleRatio: 1, ServiceName: "secchat", Version: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "GET /api/members", Int("http.status_code", 200))
+	span.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if path != "/v1/traces" {
+		t.Errorf("posted to %q, want /v1/traces", path)
+	}
+	rs := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	ss := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	spans := ss["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	s := spans[0].(map[string]interface{})
+	if s["name"] != "GET /api/members" || len(s["traceId"].(string)) != 32 {
+		t.Errorf("unexpected span %v", s)
+	}
+	attr := s["attributes"].([]interface{})[0].(map[string]interface{})
+	if attr["value"].(map[string]interface{})["intValue"] != "200" {
+		t.Errorf("unexpected attribute %v", attr)
+	}
+
+	if err := Init(Options{Exporter: "zipkin"}); err == nil {
+		t.Error("Init() should reject an unknown exporter")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// upgradeSignals is empty where the listening socket cannot be handed over
+var upgradeSignals []os.Signal
+
+// startUpgrade is not supported on this platform
+func startUpgrade(listeners []handoff) error {
+	return errors.New("zero-downtime upgrade is not supported on this platform")
+}
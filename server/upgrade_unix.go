@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// upgradeSignals start a zero-downtime upgrade: the binary at the current
+// path is started with the listening sockets and this process then drains.
+// The replacement outlives this process, so this suits servers run under a
+// supervisor that tracks the socket rather than the PID.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// startUpgrade starts a new copy of the server that inherits the listeners
+func startUpgrade(listeners []handoff) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	for i, h := range listeners {
+		tl, ok := h.ln.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener is not a TCP listener")
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// ExtraFiles start at descriptor 3
+		cmd.Env = append(cmd.Env, h.env+"="+strconv.Itoa(3+i))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,441 @@
+// Package webhook delivers chat events to subscribed HTTP endpoints.
+//
+// Each event is POSTed as JSON with these headers:
+//
+//	X-SecChat-Event:     message.created
+//	X-SecChat-Delivery:  <event ID, the same on every retry>
+//	X-SecChat-Timestamp: <Unix seconds of this attempt>
+//	X-SecChat-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// The HMAC key is the subscription's secret. Receivers should recompute the
+// signature and reject old timestamps. A delivery that does not get a 2xx
+// response is retried with exponential backoff; once every attempt has failed
+// it is kept in the store as a dead letter, from which it can be redelivered.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sec-chat/server/crypto"
+	"sec-chat/server/metrics"
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+	"sec-chat/server/tracing"
+)
+
+// Delivery headers
+const (
+	HeaderEvent     = "X-SecChat-Event"
+	HeaderDelivery  = "X-SecChat-Delivery"
+	HeaderTimestamp = "X-SecChat-Timestamp"
+	HeaderSignature = "X-SecChat-Signature"
+)
+
+const (
+	queueSize       = 1024
+	workers         = 4
+	maxAttempts     = 6
+	baseBackoff     = 2 * time.Second // Doubled after each failed attempt
+	requestTimeout  = 10 * time.Second
+	callTimeout     = 5 * time.Second
+	maxResponseSize = 64 << 10
+)
+
+var deliveries = metrics.NewCounterVec("secchat_webhook_deliveries_total",
+	"Webhook delivery attempts, by result (delivered, retried or dead_letter).", "result")
+
+// ErrUnknownWebhook is returned when redelivering to a deleted subscription
+var ErrUnknownWebhook = errors.New("webhook not found")
+
+// ErrQueueFull is returned when the delivery queue has no room
+var ErrQueueFull = errors.New("webhook delivery queue is full")
+
+// Event is the JSON body of a delivery
+type Event struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Room string      `json:"room"`
+	Time int64       `json:"time"` // Unix milliseconds
+	Data interface{} `json:"data"`
+}
+
+// Sign returns the signature header value of body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// delivery is one event on its way to one subscription
+type delivery struct {
+	hook      *models.Webhook
+	eventID   string
+	eventType string
+	payload   []byte
+	attempts  int
+	lastErr   string
+}
+
+// Dispatcher queues events for the subscriptions they match and delivers
+// them from a pool of workers
+type Dispatcher struct {
+	store       *store.Store
+	client      *http.Client
+	maxAttempts int
+	backoff     func(attempts int) time.Duration
+
+	hooksMu sync.RWMutex
+	hooks   []*models.Webhook
+
+	queue  chan *delivery
+	ctx    context.Context // Cancelled to abort in-flight requests
+	cancel context.CancelFunc
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	retries map[*delivery]*time.Timer
+}
+
+var active atomic.Pointer[Dispatcher]
+
+// Init loads the subscriptions from st and starts delivering events
+func Init(st *store.Store) (*Dispatcher, error) {
+	d := newDispatcher(st)
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	d.start()
+	active.Store(d)
+	return d, nil
+}
+
+// Get returns the running dispatcher, or nil before Init
+func Get() *Dispatcher {
+	return active.Load()
+}
+
+// Emit sends an event to the subscriptions that match it. It does nothing
+// when webhooks are not running, as in the admin commands.
+func Emit(eventType string, data interface{}) {
+	if d := active.Load(); d != nil {
+		d.Emit(eventType, data)
+	}
+}
+
+// Shutdown stops delivering. Deliveries still queued or waiting to retry
+// when ctx ends are saved as dead letters.
+func Shutdown(ctx context.Context) error {
+	d := active.Swap(nil)
+	if d == nil {
+		return nil
+	}
+	return d.shutdown(ctx)
+}
+
+func newDispatcher(st *store.Store) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		store:       st,
+		client:      &http.Client{Timeout: requestTimeout},
+		maxAttempts: maxAttempts,
+		backoff:     func(attempts int) time.Duration { return baseBackoff << (attempts - 1) },
+		queue:       make(chan *delivery, queueSize),
+		ctx:         ctx,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		retries:     make(map[*delivery]*time.Timer),
+	}
+}
+
+func (d *Dispatcher) start() {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// Refresh reloads the subscriptions from the store
+func (d *Dispatcher) Refresh() error {
+	hooks, err := d.store.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	d.hooksMu.Lock()
+	d.hooks = hooks
+	d.hooksMu.Unlock()
+	return nil
+}
+
+// Emit queues an event of type eventType for every subscription it matches
+func (d *Dispatcher) Emit(eventType string, data interface{}) {
+	d.hooksMu.RLock()
+	var matched []*models.Webhook
+	for _, h := range d.hooks {
+		if h.Matches(eventType, models.MainRoom) {
+			matched = append(matched, h)
+		}
+	}
+	d.hooksMu.RUnlock()
+	if len(matched) == 0 {
+		return
+	}
+
+	event := Event{
+		ID:   crypto.RandomToken(16),
+		Type: eventType,
+		Room: models.MainRoom,
+		Time: time.Now().UnixMilli(),
+		Data: data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "type", eventType, "err", err)
+		return
+	}
+	for _, h := range matched {
+		dl := &delivery{hook: h, eventID: event.ID, eventType: eventType, payload: payload}
+		if err := d.enqueue(dl); err != nil {
+			dl.lastErr = err.Error()
+			d.deadLetter(dl)
+		}
+	}
+}
+
+// Redeliver queues a dead letter for another round of attempts to its
+// subscription, which must still exist
+func (d *Dispatcher) Redeliver(dl *models.DeadLetter) error {
+	d.hooksMu.RLock()
+	var hook *models.Webhook
+	for _, h := range d.hooks {
+		if h.ID == dl.WebhookID {
+			hook = h
+		}
+	}
+	d.hooksMu.RUnlock()
+	if hook == nil {
+		return ErrUnknownWebhook
+	}
+	return d.enqueue(&delivery{
+		hook:      hook,
+		eventID:   dl.EventID,
+		eventType: dl.EventType,
+		payload:   []byte(dl.Payload),
+	})
+}
+
+// enqueue adds a delivery to the queue without blocking
+func (d *Dispatcher) enqueue(dl *delivery) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errors.New("server shut down before delivery")
+	}
+	select {
+	case d.queue <- dl:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case dl := <-d.queue:
+			d.attempt(dl)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// attempt makes one delivery attempt, then schedules a retry or saves a
+// dead letter if it failed
+func (d *Dispatcher) attempt(dl *delivery) {
+	dl.attempts++
+	err := d.post(dl)
+	if err == nil {
+		deliveries.With("delivered").Inc()
+		return
+	}
+	dl.lastErr = err.Error()
+
+	// Once scheduled, the retry may already be running on another worker
+	hookID, eventID, attempts := dl.hook.ID, dl.eventID, dl.attempts
+	if attempts < d.maxAttempts && d.scheduleRetry(dl) {
+		deliveries.With("retried").Inc()
+		slog.Debug("Webhook delivery failed, retrying", "webhook", hookID, "event", eventID,
+			"attempts", attempts, "err", err)
+		return
+	}
+	d.deadLetter(dl)
+}
+
+// post sends a delivery, signed with the current time
+func (d *Dispatcher) post(dl *delivery) error {
+	ctx, span := tracing.Start(d.ctx, "webhook.deliver",
+		tracing.String("webhook.id", dl.hook.ID),
+		tracing.String("event.type", dl.eventType),
+		tracing.Int("attempt", dl.attempts))
+	defer span.End()
+	span.SetKind(tracing.KindClient)
+
+	_, err := send(ctx, d.client, dl.hook.URL, dl.hook.Secret, dl.eventType, dl.eventID, dl.payload)
+	span.SetError(err)
+	return err
+}
+
+// Call posts body to url, signed with secret like a delivery, and returns
+// the body of a 2xx response. It is not retried; it serves requests that
+// want an answer at once, such as bot commands.
+func Call(ctx context.Context, url, secret, eventType, id string, body []byte) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "webhook.call", tracing.String("event.type", eventType))
+	defer span.End()
+	span.SetKind(tracing.KindClient)
+
+	resp, err := send(ctx, callClient, url, secret, eventType, id, body)
+	span.SetError(err)
+	return resp, err
+}
+
+// callClient makes Calls, which someone is waiting on
+var callClient = &http.Client{Timeout: callTimeout}
+
+// send posts a signed body and returns up to maxResponseSize bytes of the
+// response, or an error unless the status is 2xx
+func send(ctx context.Context, client *http.Client, url, secret, eventType, id string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SecChat-Webhook")
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, now, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	tracing.SpanFromContext(ctx).SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return data, err
+}
+
+// scheduleRetry queues dl again after its backoff, reporting false if the
+// dispatcher is shutting down
+func (d *Dispatcher) scheduleRetry(dl *delivery) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.retries[dl] = time.AfterFunc(d.backoff(dl.attempts), func() {
+		d.mu.Lock()
+		delete(d.retries, dl)
+		d.mu.Unlock()
+		// The failed attempt's error says more than why it was not retried
+		if err := d.enqueue(dl); err != nil {
+			d.deadLetter(dl)
+		}
+	})
+	return true
+}
+
+// deadLetter saves a delivery that will not be attempted again
+func (d *Dispatcher) deadLetter(dl *delivery) {
+	deliveries.With("dead_letter").Inc()
+	slog.Warn("Webhook delivery failed, saved as a dead letter", "webhook", dl.hook.ID,
+		"event", dl.eventID, "type", dl.eventType, "attempts", dl.attempts, "err", dl.lastErr)
+	err := d.store.SaveDeadLetter(&models.DeadLetter{
+		WebhookID: dl.hook.ID,
+		EventID:   dl.eventID,
+		EventType: dl.eventType,
+		Payload:   string(dl.payload),
+		Attempts:  dl.attempts,
+		LastError: dl.lastErr,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("Failed to save webhook dead letter", "webhook", dl.hook.ID, "event", dl.eventID, "err", err)
+	}
+}
+
+// shutdown lets in-flight deliveries finish until ctx ends, then saves the
+// ones that are left as dead letters
+func (d *Dispatcher) shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	var waiting []*delivery
+	for dl, timer := range d.retries {
+		if timer.Stop() {
+			waiting = append(waiting, dl)
+		}
+	}
+	d.retries = nil
+	d.mu.Unlock()
+	close(d.stop)
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+
+drain:
+	for {
+		select {
+		case dl := <-d.queue:
+			waiting = append(waiting, dl)
+		default:
+			break drain
+		}
+	}
+	for _, dl := range waiting {
+		if dl.lastErr == "" {
+			dl.lastErr = "server shut down before delivery"
+		}
+		d.deadLetter(dl)
+	}
+	return err
+}
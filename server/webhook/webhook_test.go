@@ -0,0 +1,260 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sec-chat/server/models"
+	"sec-chat/server/store"
+)
+
+// received is a request seen by the stand-in receiver
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is a local HTTP stand-in for a webhook endpoint that fails the
+// first failures requests
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	got      []received
+}
+
+func newReceiver(failures int) *receiver {
+	r := &receiver{failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.got = append(r.got, received{req.Header.Clone(), body})
+		if len(r.got) <= r.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return r
+}
+
+func (r *receiver) requests() []received {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]received(nil), r.got...)
+}
+
+func setupDispatcher(t *testing.T, hooks ...*models.Webhook) (*Dispatcher, *store.Store) {
+	tmpFile, err := os.CreateTemp("", "test_*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+	st, err := store.Init(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+
+	for _, h := range hooks {
+		if err := st.SaveWebhook(h); err != nil {
+			t.Fatalf("SaveWebhook() error = %v", err)
+		}
+	}
+	d := newDispatcher(st)
+	d.backoff = func(int) time.Duration { return time.Millisecond }
+	d.maxAttempts = 3
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	d.start()
+
+	t.Cleanup(func() {
+		d.shutdown(context.Background())
+		st.Close()
+		os.Remove(tmpFile.Name())
+	})
+	return d, st
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	sig := Sign("secret", 1700000000, body)
+	if sig != Sign("secret", 1700000000, body) {
+		t.Error("Sign() should be deterministic")
+	}
+	if sig == Sign("other", 1700000000, body) || sig == Sign("secret", 1700000001, body) {
+		t.Error("Sign() should depend on the secret and timestamp")
+	}
+	if len(sig) != len("sha256=")+64 || sig[:7] != "sha256=" {
+		t.Errorf("Sign() = %q, want sha256=<64 hex digits>", sig)
+	}
+}
+
+func TestEmitDeliversSignedEvent(t *testing.T) {
+	recv := newReceiver(0)
+	defer recv.Close()
+	d, _ := setupDispatcher(t, &models.Webhook{ID: "h1", URL: recv.URL, Secret: "s3cret", CreatedAt: 1})
+
+	d.Emit(models.EventUserJoined, map[string]string{"userId": "alice"})
+	waitFor(t, "delivery", func() bool { return len(recv.requests()) == 1 })
+
+	req := recv.requests()[0]
+	if req.header.Get(HeaderEvent) != models.EventUserJoined {
+		t.Errorf("%s = %q, want %q", HeaderEvent, req.header.Get(HeaderEvent), models.EventUserJoined)
+	}
+	ts, err := strconv.ParseInt(req.header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("%s = %q, want Unix seconds", HeaderTimestamp, req.header.Get(HeaderTimestamp))
+	}
+	if got, want := req.header.Get(HeaderSignature), Sign("s3cret", ts, req.body); got != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, got, want)
+	}
+
+	var event Event
+	if err := json.Unmarshal(req.body, &event); err != nil {
+		t.Fatalf("body is not an event: %v", err)
+	}
+	if event.Type != models.EventUserJoined || event.Room != models.MainRoom || event.ID != req.header.Get(HeaderDelivery) {
+		t.Errorf("event = %+v, want type, room and ID set", event)
+	}
+}
+
+func TestEmitFiltersByEventType(t *testing.T) {
+	recv := newReceiver(0)
+	defer recv.Close()
+	d, _ := setupDispatcher(t,
+		&models.Webhook{ID: "h1", URL: recv.URL, Secret: "s", Events: []string{models.EventMessageCreated}, CreatedAt: 1})
+
+	d.Emit(models.EventUserLeft, nil)
+	d.Emit(models.EventMessageCreated, nil)
+	waitFor(t, "delivery", func() bool { return len(recv.requests()) >= 1 })
+	time.Sleep(20 * time.Millisecond)
+
+	got := recv.requests()
+	if len(got) != 1 || got[0].header.Get(HeaderEvent) != models.EventMessageCreated {
+		t.Errorf("received %d deliveries, want only %s", len(got), models.EventMessageCreated)
+	}
+}
+
+func TestRetryThenDeliver(t *testing.T) {
+	recv := newReceiver(2)
+	defer recv.Close()
+	d, st := setupDispatcher(t, &models.Webhook{ID: "h1", URL: recv.URL, Secret: "s", CreatedAt: 1})
+
+	d.Emit(models.EventUploadCreated, nil)
+	waitFor(t, "third attempt", func() bool { return len(recv.requests()) == 3 })
+
+	got := recv.requests()
+	if got[0].header.Get(HeaderDelivery) != got[2].header.Get(HeaderDelivery) {
+		t.Error("retries should keep the delivery ID")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if letters, _ := st.GetDeadLetters(10); len(letters) != 0 {
+		t.Errorf("GetDeadLetters() = %d letters after a successful retry, want 0", len(letters))
+	}
+}
+
+func TestDeadLetterAndRedeliver(t *testing.T) {
+	recv := newReceiver(3)
+	defer recv.Close()
+	d, st := setupDispatcher(t, &models.Webhook{ID: "h1", URL: recv.URL, Secret: "s", CreatedAt: 1})
+
+	d.Emit(models.EventMessageRecalled, map[string]string{"id": "m1"})
+	var letters []*models.DeadLetter
+	waitFor(t, "dead letter", func() bool {
+		letters, _ = st.GetDeadLetters(10)
+		return len(letters) == 1
+	})
+
+	dl := letters[0]
+	if dl.WebhookID != "h1" || dl.EventType != models.EventMessageRecalled || dl.Attempts != 3 {
+		t.Errorf("dead letter = %+v, want h1, %s after 3 attempts", dl, models.EventMessageRecalled)
+	}
+	if dl.LastError == "" {
+		t.Error("dead letter should record the last error")
+	}
+
+	// The receiver has recovered
+	if err := d.Redeliver(dl); err != nil {
+		t.Fatalf("Redeliver() error = %v", err)
+	}
+	waitFor(t, "redelivery", func() bool { return len(recv.requests()) == 4 })
+	if got := recv.requests()[3]; string(got.body) != dl.Payload {
+		t.Errorf("redelivered body = %s, want %s", got.body, dl.Payload)
+	}
+
+	if err := d.Redeliver(&models.DeadLetter{WebhookID: "gone"}); err != ErrUnknownWebhook {
+		t.Errorf("Redeliver() to a deleted webhook error = %v, want ErrUnknownWebhook", err)
+	}
+}
+
+func TestShutdownSavesPendingRetries(t *testing.T) {
+	recv := newReceiver(1)
+	defer recv.Close()
+	d, st := setupDispatcher(t, &models.Webhook{ID: "h1", URL: recv.URL, Secret: "s", CreatedAt: 1})
+	d.backoff = func(int) time.Duration { return time.Hour }
+
+	d.Emit(models.EventUserLeft, nil)
+	waitFor(t, "first attempt", func() bool { return len(recv.requests()) == 1 })
+	time.Sleep(20 * time.Millisecond)
+
+	if err := d.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+	letters, _ := st.GetDeadLetters(10)
+	if len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Fatalf("GetDeadLetters() = %v, want the delivery waiting to retry", letters)
+	}
+	if err := d.enqueue(&delivery{}); err == nil {
+		t.Error("enqueue() after shutdown should fail")
+	}
+}
+
+func TestCall(t *testing.T) {
+	var got received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = received{req.Header.Clone(), body}
+		if req.URL.Path == "/fail" {
+			http.Error(w, "nope", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"text":"pong"}`))
+	}))
+	defer srv.Close()
+
+	resp, err := Call(context.Background(), srv.URL, "s3cret", "command", "inv1", []byte(`{"command":"ping"}`))
+	if err != nil || string(resp) != `{"text":"pong"}` {
+		t.Fatalf("Call() = %s, %v, want the response body", resp, err)
+	}
+	ts, _ := strconv.ParseInt(got.header.Get(HeaderTimestamp), 10, 64)
+	if got.header.Get(HeaderSignature) != Sign("s3cret", ts, got.body) || got.header.Get(HeaderDelivery) != "inv1" {
+		t.Errorf("Call() headers = %v, want a signed request", got.header)
+	}
+
+	if _, err := Call(context.Background(), srv.URL+"/fail", "s3cret", "command", "inv2", nil); err == nil {
+		t.Error("Call() should fail on a non-2xx status")
+	}
+}